@@ -16,18 +16,15 @@
 package airplay
 
 import (
-	"bytes"
-	"crypto/md5"
+	"context"
 	"errors"
-	"fmt"
 	"github.com/nu7hatch/gouuid"
-	"io"
 	"net"
-	"net/http"
 	"net/textproto"
-	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -36,458 +33,253 @@ var (
 	ErrAuthUnsupported  = errors.New("Authentication not supported")
 	ErrNoOptions        = errors.New("Airplay server did not respond to OPTIONS request")
 	ErrInvalidOptions   = errors.New("Airplay server reported invalid OPTIONS")
+	ErrNotConnected     = errors.New("Not connected to an Airplay server")
+
+	// How long Dial waits for a device to accept the connection
+	DialTimeout = 10 * time.Second
+
+	// How long a request may take when its context has no deadline, unless Airplay.Timeout says otherwise
+	RequestTimeout = 10 * time.Second
 )
 
 type Airplay struct {
 	Password    string
+	Username    string        // Who to authenticate as. Receivers don't usually care. Empty means DefaultUsername
+	Codec       int           // Which codec to ANNOUNCE and send audio with, CodecALAC (the default) or CodecPCM
+	Encryption  int           // How to encrypt audio, EncryptionNone or EncryptionRSA
+	Verified    bool          // Whether the device answered our Apple-Challenge, see Verify
+	Timeout     time.Duration // How long each request may take when its context has no deadline. 0 means RequestTimeout
 	conn        *textproto.Conn
+	netConn     net.Conn // The connection underneath conn, for addresses and deadlines
 	reverseConn *textproto.Conn
 	sessionID   string
-	nonce       string
-	realm       string
+	auth        *authState // How to answer the receiver's password challenge, once it's sent one
 	cseq        int
 	ip          net.IP
 	port        uint16
+
+	reverseNetConn net.Conn      // The connection underneath reverseConn
+	reverseDone    chan struct{} // Closed once serveEvents has stopped answering on reverseConn
+	slideshow      *slideshow    // Where the images come from while a slideshow is running, see photo.go
+
+	// Reconnects are reported here, see keepalive.go. Sends don't block, so give it a buffer
+	Events chan<- Event
+
+	// What the receiver says is happening, once StartEvents has been called, see events.go. Sends don't block either
+	PlaybackEvents chan<- PlaybackEvent
+
+	lock      *sync.Mutex // Held while using the connection or session, so the keepalive can share them
+	keepalive *keepalive  // Running if StartKeepalive was called
+
+	metadataTypes []int      // What the device said it shows, from DialDevice. nil if we don't know
+	advertised    ServerInfo // What the device's TXT records said about it, from DialDevice. See serverinfo.go
+
+	// RAOP session state, see session.go
+	url         string        // The URL of our RAOP session
+	session     string        // The RTSP session id from SETUP
+	serverPort  int           // Where the receiver wants audio sent
+	controlPort int           // The receiver's control port
+	timingPort  int           // The receiver's timing port
+	controlConn *net.UDPConn  // Our end of the control channel
+	timing      *timingServer // Answers the receiver's timing requests while the session is up
+	aesKey      []byte        // The session's audio key, if we're encrypting. See encryption.go
+	aesIV       []byte
+
+	// What we need to pick the session up again after reconnecting, see keepalive.go
+	sdp        string       // What we ANNOUNCEd
+	recording  bool         // Whether we've sent RECORD since SETUP
+	recordSeq  uint16       // Where the receiver last started playing or flushed from
+	recordTime uint32       // The RTP timestamp that goes with recordSeq
+	sender     *AudioSender // The session's sender, to move over to the receiver's new ports
 }
 
 func Dial(ip net.IP, port uint16, password string) (a Airplay, err error) {
+	return DialContext(context.Background(), ip, port, password)
+}
+
+// Connect to a device, giving up if ctx is done before it answers. Connecting takes at most DialTimeout
+func DialContext(ctx context.Context, ip net.IP, port uint16, password string) (a Airplay, err error) {
 	a.ip = ip
 	a.port = port
 	a.Password = password
+	a.Codec = CodecALAC // Almost every receiver wants it
 	uuid, err := uuid.NewV4()
 	if err != nil {
 		return a, err
 	}
 	a.sessionID = uuid.String()
 	a.cseq = 0
+	a.lock = new(sync.Mutex)
 
 	// Immediately make a connection and ask for OPTIONS, just to make sure we can connect
-	a.conn, err = textproto.Dial("tcp", ip.String()+":"+strconv.Itoa(int(port)))
-	if err != nil {
-		return a, err
-	}
-
-	resp, err := a.makeRTSPRequest("OPTIONS", "*", nil)
+	err = a.connect(ctx)
 	if err != nil {
 		return a, err
 	}
 
-	if resp.StatusCode != 200 {
-		return a, ErrNoOptions
-	}
-
-	methods := resp.Header.Get("Public")
-	if methods == "" || strings.Contains(methods, "ANNOUNCE") == false {
-		return a, ErrInvalidOptions
-	}
-
-	// Good, now ANNOUNCE our capabilities
-
-	/*
-		// Reverse connection stuff, maybe unnecessary
-		a.reverseConn, err = textproto.Dial("tcp", ip.String()+":"+strconv.Itoa(int(port)))
-		if err != nil {
-			return a, err
-		}
-
-		err = a.makeReverseRequest()
-		if err != nil {
-			return a, err
-		}
-	*/
+	// Good, now the caller can ANNOUNCE what they want to stream, or StartEvents to hear about playback
 
 	return a, nil
 }
 
-func (a *Airplay) IsConnected() bool {
-	if a.conn == nil {
-		return false
-	}
-
-	return true
-}
-
-func (a *Airplay) GetServerInfo() (err error) {
-	resp, err := a.makeHTTPRequest("GET", "/server-info")
+// Open the connection and check the device answers OPTIONS like a RAOP receiver
+func (a *Airplay) connect(ctx context.Context) (err error) {
+	dialer := net.Dialer{Timeout: DialTimeout}
+	a.netConn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(a.ip.String(), strconv.Itoa(int(a.port))))
 	if err != nil {
 		return err
 	}
+	a.conn = textproto.NewConn(a.netConn)
 
-	fmt.Println(resp.Body)
-	return nil
-}
-
-func (a *Airplay) Announce() (err error) {
-	u := url.URL{
-		Scheme: "rtsp",
-		Host:   a.ip.String() + ":" + strconv.Itoa(int(a.port)),
-		Path:   "/test",
-	}
-
-	resp, err := a.makeRTSPRequest("ANNOUNCE", u.String(), nil)
+	err = a.checkOptions(ctx)
 	if err != nil {
-		return err
+		// Hang up, so a failed dial doesn't leave the connection open
+		a.conn.Close()
+		a.conn = nil
+		a.netConn = nil
 	}
 
-	fmt.Println(resp.Body)
-	return nil
+	return err
 }
 
-func (a *Airplay) makeRTSPRequest(method string, path string, body io.Reader) (resp http.Response, err error) {
-	a.cseq++
-	err = a.conn.PrintfLine("%s %s RTSP/1.0", method, path)
+// Ask for OPTIONS and check we can ANNOUNCE
+func (a *Airplay) checkOptions(ctx context.Context) (err error) {
+	resp, err := a.makeRTSPRequest(ctx, "OPTIONS", "*", nil, nil)
 	if err != nil {
-		return resp, err
+		return err
 	}
 
-	var contentLength int64
-	if body != nil {
-		switch v := body.(type) {
-		case *bytes.Buffer:
-			contentLength = int64(v.Len())
-		case *bytes.Reader:
-			contentLength = int64(v.Len())
-		case *strings.Reader:
-			contentLength = int64(v.Len())
-		}
-
-		a.conn.PrintfLine("Content-Type: application/sdp")
-	} else {
-		contentLength = 0
+	if resp.StatusCode != 200 {
+		return ErrNoOptions
 	}
 
-	a.conn.PrintfLine("Content-Length: %d", contentLength)
-	a.conn.PrintfLine("User-Agent: go-airplay/1.0")
-	a.conn.PrintfLine("X-Apple-Session-ID: %s", a.sessionID)
-	a.conn.PrintfLine("CSeq: %d", a.cseq)
-
-	/*
-		Client-Instance: 56B29BB6CB904862
-		DACP-ID: 56B29BB6CB904862
-		Active-Remote: 1986535575
-	*/
-
-	// Add auth headers, if necessary
-	if a.realm != "" {
-		username := ""
-		if a.realm == "raop" {
-			username = "iTunes"
-		} else if a.realm == "Airplay" {
-			username = "Airplay"
-		}
-
-		hash := md5.New()
-		io.WriteString(hash, username+":"+a.realm+":"+a.Password)
-		ha1 := fmt.Sprintf("%x", hash.Sum(nil))
-		hash.Reset()
-
-		io.WriteString(hash, method+":"+path)
-		ha2 := fmt.Sprintf("%x", hash.Sum(nil))
-		hash.Reset()
-
-		io.WriteString(hash, ha1+":"+a.nonce+":"+ha2)
-		response := fmt.Sprintf("%x", hash.Sum(nil))
-
-		a.conn.PrintfLine("Authorization: Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", username, a.realm, a.nonce, path, response)
+	methods := resp.Header.Get("Public")
+	if methods == "" || strings.Contains(methods, "ANNOUNCE") == false {
+		return ErrInvalidOptions
 	}
 
-	// Submit request
-	err = a.conn.PrintfLine("")
-	if err != nil {
-		return resp, err
-	}
+	return nil
+}
 
-	if body != nil {
-		_, err = io.Copy(a.conn.W, io.LimitReader(body, contentLength))
-		if err != nil {
-			return resp, err
-		}
-	}
+// Connect to a discovered device. If the device is asleep behind a sleep proxy, it is woken up first
+// and we keep trying to connect until it answers or WakeTimeout passes
+func DialDevice(device AirplayDevice, password string) (a Airplay, err error) {
+	return DialDeviceContext(context.Background(), device, password)
+}
 
-	// Read response
-	line, err := a.conn.ReadLine()
-	if err != nil {
-		return resp, err
+// DialDevice, giving up if ctx is done first
+func DialDeviceContext(ctx context.Context, device AirplayDevice, password string) (a Airplay, err error) {
+	if device.Asleep == false {
+		a, err = DialContext(ctx, device.IP, device.Port, password)
+		a.Codec = deviceCodec(device)
+		a.Encryption = deviceEncryption(device)
+		a.metadataTypes = device.MetadataTypes()
+		a.advertised = device.ServerInfo()
+		return a, err
 	}
 
-	//fmt.Println(line)
-	f := strings.SplitN(line, " ", 3) // Proto, Code, Status
-	reasonPhrase := ""
-	if len(f) > 2 {
-		reasonPhrase = f[2]
-	}
-	resp.Status = f[1] + " " + reasonPhrase
-	resp.StatusCode, err = strconv.Atoi(f[1])
+	err = Wake(device)
 	if err != nil {
-		return resp, err
+		return a, err
 	}
 
-	resp.Proto = f[0]
-
-	headers, err := a.conn.ReadMIMEHeader()
-	if err != nil {
-		return resp, err
-	}
+	deadline := time.Now().Add(WakeTimeout)
+	for {
+		a, err = DialContext(ctx, device.IP, device.Port, password)
+		if err == nil || time.Now().After(deadline) || ctx.Err() != nil {
+			a.Codec = deviceCodec(device)
+			a.Encryption = deviceEncryption(device)
+			a.metadataTypes = device.MetadataTypes()
+			a.advertised = device.ServerInfo()
+			return a, err
+		}
 
-	resp.Header = http.Header(headers)
-
-	//fmt.Println(headers)
-
-	// Do auth
-	if f[1] == "401" {
-		if a.Password == "" {
-			return resp, ErrPasswordRequired
-		} else if a.realm == "" {
-			// Parse the headers
-			auth := headers.Get("WWW-Authenticate")
-			if auth == "" {
-				return resp, ErrAuthUnsupported
-			}
-
-			authParts := strings.Split(auth, " ")
-			if authParts[0] != "Digest" {
-				return resp, ErrAuthUnsupported
-			}
-
-			for i := range authParts {
-				if i == 0 {
-					continue
-				}
-
-				parts := strings.SplitN(authParts[i], "=", 2)
-				value := strings.Trim(parts[1], "\"")
-				if parts[0] == "nonce" {
-					a.nonce = value
-
-				} else if parts[0] == "realm" {
-					a.realm = value
-				}
-			}
-
-			// Make another request with the new auth information
-			return a.makeRTSPRequest(method, path, body)
-
-		} else {
-			// We've already tried auth and failed
-			return resp, ErrPasswordInvalid
+		select {
+		case <-ctx.Done():
+			return a, ctx.Err()
+		case <-time.After(time.Second):
 		}
 	}
-
-	return resp, nil
 }
 
-func (a *Airplay) makeHTTPRequest(method string, path string) (resp http.Response, err error) {
-	a.cseq++
-	err = a.conn.PrintfLine("%s %s HTTP/1.1", method, path)
-	if err != nil {
-		return resp, err
+// Send ALAC unless the device says it only takes PCM
+func deviceCodec(device AirplayDevice) int {
+	codecs := device.AudioCodecs()
+	for _, c := range codecs {
+		if c == CodecALAC {
+			return CodecALAC
+		}
 	}
 
-	a.conn.PrintfLine("Content-Length: 0")
-	a.conn.PrintfLine("User-Agent: go-airplay/1.0")
-	a.conn.PrintfLine("X-Apple-Session-ID: %s", a.sessionID)
-	a.conn.PrintfLine("CSeq: %d", a.cseq)
-
-	// Add auth headers, if necessary
-	if a.realm != "" {
-		username := ""
-		if a.realm == "raop" {
-			username = "iTunes"
-		} else if a.realm == "Airplay" {
-			username = "Airplay"
+	for _, c := range codecs {
+		if c == CodecPCM {
+			return CodecPCM
 		}
-
-		hash := md5.New()
-		io.WriteString(hash, username+":"+a.realm+":"+a.Password)
-		ha1 := fmt.Sprintf("%x", hash.Sum(nil))
-		hash.Reset()
-
-		io.WriteString(hash, method+":"+path)
-		ha2 := fmt.Sprintf("%x", hash.Sum(nil))
-		hash.Reset()
-
-		io.WriteString(hash, ha1+":"+a.nonce+":"+ha2)
-		response := fmt.Sprintf("%x", hash.Sum(nil))
-
-		a.conn.PrintfLine("Authorization: Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", username, a.realm, a.nonce, path, response)
 	}
 
-	// Submit request
-	err = a.conn.PrintfLine("")
-	if err != nil {
-		return resp, err
-	}
+	return CodecALAC
+}
 
-	// Read response
-	line, err := a.conn.ReadLine()
-	if err != nil {
-		return resp, err
+// Only encrypt audio for devices that won't take it in the clear
+func deviceEncryption(device AirplayDevice) int {
+	hasRSA := false
+	for _, t := range device.EncryptionTypes() {
+		if t == EncryptionNone {
+			return EncryptionNone
+		}
+		if t == EncryptionRSA {
+			hasRSA = true
+		}
 	}
 
-	fmt.Println(line)
-	f := strings.SplitN(line, " ", 3) // Proto, Code, Status
-	reasonPhrase := ""
-	if len(f) > 2 {
-		reasonPhrase = f[2]
-	}
-	resp.Status = f[1] + " " + reasonPhrase
-	resp.StatusCode, err = strconv.Atoi(f[1])
-	if err != nil {
-		return resp, err
+	if hasRSA {
+		return EncryptionRSA
 	}
 
-	resp.Proto = f[0]
+	return EncryptionNone
+}
 
-	headers, err := a.conn.ReadMIMEHeader()
-	if err != nil {
-		return resp, err
-	}
+func (a *Airplay) IsConnected() bool {
+	a.lockSession()
+	defer a.unlockSession()
 
-	resp.Header = http.Header(headers)
-
-	//fmt.Println(headers)
-
-	// Do auth
-	if f[1] == "401" {
-		if a.Password == "" {
-			return resp, ErrPasswordRequired
-		} else if a.realm == "" {
-			// Parse the headers
-			auth := headers.Get("WWW-Authenticate")
-			if auth == "" {
-				return resp, ErrAuthUnsupported
-			}
-
-			authParts := strings.Split(auth, " ")
-			if authParts[0] != "Digest" {
-				return resp, ErrAuthUnsupported
-			}
-
-			for i := range authParts {
-				if i == 0 {
-					continue
-				}
-
-				parts := strings.SplitN(authParts[i], "=", 2)
-				value := strings.Trim(parts[1], "\"")
-				if parts[0] == "nonce" {
-					a.nonce = value
-
-				} else if parts[0] == "realm" {
-					a.realm = value
-				}
-			}
-
-			// Make another request with the new auth information
-			return a.makeHTTPRequest(method, path)
-
-		} else {
-			// We've already tried auth and failed
-			return resp, ErrPasswordInvalid
-		}
+	if a.conn == nil {
+		return false
 	}
 
-	return resp, nil
+	return true
 }
 
-// Sets up the reverse HTTP connection
-func (a *Airplay) makeReverseRequest() (err error) {
-	err = a.reverseConn.PrintfLine("POST /reverse RTSP/1.0")
-	if err != nil {
-		return err
-	}
-	a.reverseConn.PrintfLine("Upgrade: PTTH/1.0")
-	a.reverseConn.PrintfLine("Connection: Upgrade")
-	a.reverseConn.PrintfLine("X-Apple-Purpose: Event")
-	a.reverseConn.PrintfLine("Content-Length: 0")
-	a.reverseConn.PrintfLine("User-Agent: go-airplay/1.0")
-	a.reverseConn.PrintfLine("X-Apple-Session-ID: %s", a.sessionID)
-
-	// Add auth headers, if necessary
-	if a.realm != "" {
-		username := ""
-		if a.realm == "raop" {
-			username = "iTunes"
-		} else if a.realm == "Airplay" {
-			username = "Airplay"
-		}
+// Hang up on the device, without tearing down any RAOP session first
+func (a *Airplay) Close() (err error) {
+	a.StopKeepalive()
 
-		hash := md5.New()
-		io.WriteString(hash, username+":"+a.realm+":"+a.Password)
-		ha1 := fmt.Sprintf("%x", hash.Sum(nil))
-		hash.Reset()
+	a.lockSession()
+	defer a.unlockSession()
 
-		io.WriteString(hash, "POST:/reverse")
-		ha2 := fmt.Sprintf("%x", hash.Sum(nil))
-		hash.Reset()
-
-		io.WriteString(hash, ha1+":"+a.nonce+":"+ha2)
-		response := fmt.Sprintf("%x", hash.Sum(nil))
-
-		a.reverseConn.PrintfLine("Authorization: Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"/reverse\", response=\"%s\"", username, a.realm, a.nonce, response)
-	}
+	a.closeSessionSockets()
+	a.closeReverse()
 
-	// Submit request
-	err = a.reverseConn.PrintfLine("")
-	if err != nil {
-		return err
+	if a.conn == nil {
+		return nil
 	}
 
-	// Read response
-	line, err := a.reverseConn.ReadLine()
-	if err != nil {
-		return err
-	}
+	err = a.conn.Close()
+	a.conn = nil
+	a.netConn = nil
 
-	fmt.Println(line)
-	f := strings.SplitN(line, " ", 3) // Proto, Code, Status
+	return err
+}
 
-	headers, err := a.reverseConn.ReadMIMEHeader()
-	if err != nil {
-		return err
+// Take the lock on the connection and session. Airplays we didn't dial ourselves don't have one, and don't need it
+func (a *Airplay) lockSession() {
+	if a.lock != nil {
+		a.lock.Lock()
 	}
+}
 
-	fmt.Println(headers)
-
-	// Do auth
-	if f[1] == "401" {
-		if a.Password == "" {
-			return ErrPasswordRequired
-		} else if a.realm == "" {
-			// Parse the headers
-			auth := headers.Get("WWW-Authenticate")
-			if auth == "" {
-				return ErrAuthUnsupported
-			}
-
-			authParts := strings.Split(auth, " ")
-			if authParts[0] != "Digest" {
-				return ErrAuthUnsupported
-			}
-
-			for i := range authParts {
-				if i == 0 {
-					continue
-				}
-
-				parts := strings.SplitN(authParts[i], "=", 2)
-				value := strings.Trim(parts[1], "\"")
-				if parts[0] == "nonce" {
-					a.nonce = value
-
-				} else if parts[0] == "realm" {
-					a.realm = value
-				}
-			}
-
-			// Make another request with the new auth information
-			return a.makeReverseRequest()
-
-		} else {
-			// We've already tried auth and failed
-			return ErrPasswordInvalid
-		}
+func (a *Airplay) unlockSession() {
+	if a.lock != nil {
+		a.lock.Unlock()
 	}
-
-	return nil
 }
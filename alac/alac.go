@@ -0,0 +1,106 @@
+//
+// Apple Lossless (ALAC). The encoder does what RAOP needs, 16-bit stereo in
+// short frames; the decoder also handles mono and 24-bit audio.
+//
+// A frame is a sequence of elements, each starting with a 3-bit tag, and
+// ends with an END tag and padding to a whole byte. Mono audio is one single
+// channel element (SCE) and stereo audio is one channel pair element (CPE):
+//
+//	tag (3) instance (4) unused (12) partial (1) shift (2) escape (1)
+//	[sample count (32), if partial]
+//
+// An escape frame then has the samples, uncompressed and interleaved. A
+// compressed frame has the stereo mixing parameters, then for each channel
+// the predictor mode, quantization, Rice multiplier and coefficients, then
+// the low bytes of each sample if "shift" says some were split off (24-bit
+// audio does this), then the prediction residuals of each channel, coded
+// with adaptive Golomb codes.
+//
+// https://github.com/macosforge/alac - Apple's reference implementation
+// http://alac.macosforge.org/trac/browser/trunk/ALACMagicCookieDescription.txt
+//
+
+package alac
+
+import (
+	"errors"
+)
+
+// Element tags
+const (
+	idSCE = 0 // Single channel
+	idCPE = 1 // Channel pair
+	idEND = 7
+)
+
+const (
+	maxOrder     = 8 // Predictor coefficients per channel
+	denShift     = 9 // Predictor quantization
+	pbFactor     = 4 // Scales Config.PB, 4 leaves it as is
+	mixBits      = 2 // Stereo mixing resolution
+	maxMixRes    = 2 // Largest mixing weight we try
+	maxPrefix    = 9 // Longest unary prefix before a Golomb code escapes
+	qbShift      = 9
+	qb           = 1 << qbShift
+	mmulShift    = 2
+	mdenShift    = qbShift - mmulShift - 1
+	moff         = 1 << (mdenShift - 2)
+	bitOff       = 24
+	maxMeanClamp = 0xffff
+	maxZeroRun   = 65535
+)
+
+// Other element tags we understand. Coupling channels (2) and program configs (5) never turn up
+const (
+	idLFE = 3 // Low frequency effects channel, coded like a single channel
+	idDSE = 4 // Data stream, skipped
+	idFIL = 6 // Fill, skipped
+)
+
+var (
+	ErrUnsupportedConfig = errors.New("ALAC configuration is not supported")
+	ErrFrameLength       = errors.New("Frame has the wrong number of samples")
+	ErrCorruptFrame      = errors.New("ALAC frame is corrupt")
+)
+
+// The ALAC "magic cookie" (ALACSpecificConfig). The fields are the same as sdp.ALACParams, so one converts
+// straight to the other
+type Config struct {
+	FrameLength       uint32 // Samples per frame, 352 for RAOP
+	CompatibleVersion uint8  // Always 0
+	BitDepth          uint8  // 16 or 24
+	PB                uint8  // Rice history multiplier, usually 40
+	MB                uint8  // Rice initial history, usually 10
+	KB                uint8  // Rice parameter limit, usually 14
+	NumChannels       uint8
+	MaxRun            uint16 // Usually 255
+	MaxFrameBytes     uint32 // 0 if unknown
+	AvgBitRate        uint32 // 0 if unknown
+	SampleRate        uint32
+}
+
+// The configuration RAOP receivers expect: 352 samples of 44.1kHz 16-bit stereo per frame
+func RAOPConfig() Config {
+	return Config{
+		FrameLength: 352,
+		BitDepth:    16,
+		PB:          40,
+		MB:          10,
+		KB:          14,
+		NumChannels: 2,
+		MaxRun:      255,
+		SampleRate:  44100,
+	}
+}
+
+// -1, 0 or 1
+func sign(i int32) int32 {
+	if i > 0 {
+		return 1
+	}
+	if i < 0 {
+		return -1
+	}
+
+	return 0
+}
@@ -0,0 +1,84 @@
+package alac
+
+// Writes big-endian bit fields, most significant bit first
+type bitWriter struct {
+	buf   []byte
+	cache uint64 // Bits not yet in buf, in the low n bits
+	n     uint
+}
+
+// Write the low n bits of value, n <= 32
+func (w *bitWriter) write(value uint32, n uint) {
+	w.cache = w.cache<<n | uint64(value)&(1<<n-1)
+	w.n += n
+
+	for w.n >= 8 {
+		w.n -= 8
+		w.buf = append(w.buf, byte(w.cache>>w.n))
+	}
+}
+
+// How many bits have been written
+func (w *bitWriter) len() int {
+	return len(w.buf)*8 + int(w.n)
+}
+
+// Pad with zeroes to a whole byte and return what we've written
+func (w *bitWriter) bytes() []byte {
+	if w.n > 0 {
+		w.write(0, 8-w.n)
+	}
+
+	return w.buf
+}
+
+// Reads big-endian bit fields, most significant bit first. Reading past the end gives zeroes; check overrun
+type bitReader struct {
+	data []byte
+	pos  uint // In bits
+}
+
+// Read n bits, n <= 32
+func (r *bitReader) read(n uint) (v uint32) {
+	for n > 0 {
+		var b byte
+		if i := r.pos >> 3; i < uint(len(r.data)) {
+			b = r.data[i]
+		}
+
+		avail := 8 - r.pos&7
+		take := avail
+		if n < take {
+			take = n
+		}
+
+		v = v<<take | uint32(b>>(avail-take))&(1<<take-1)
+		n -= take
+		r.pos += take
+	}
+
+	return v
+}
+
+// Read n bits without moving on
+func (r *bitReader) peek(n uint) uint32 {
+	pos := r.pos
+	v := r.read(n)
+	r.pos = pos
+
+	return v
+}
+
+func (r *bitReader) skip(n uint) {
+	r.pos += n
+}
+
+// Skip to the next whole byte
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+// Whether we've read past the end
+func (r *bitReader) overrun() bool {
+	return r.pos > uint(len(r.data))*8
+}
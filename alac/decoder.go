@@ -0,0 +1,281 @@
+package alac
+
+// Decodes ALAC frames into interleaved little-endian PCM
+type Decoder struct {
+	config Config
+
+	mixU, mixV []int32
+	predictor  []int32
+}
+
+// The per-channel parameters of a compressed element
+type channelParams struct {
+	mode     uint32
+	denShift uint
+	pbFactor uint32
+	coefs    []int16
+}
+
+// Make a decoder from the parameters of the stream, usually from the SDP fmtp attribute:
+//
+//	alac.NewDecoder(alac.Config(params))
+func NewDecoder(config Config) (d *Decoder, err error) {
+	if (config.BitDepth != 16 && config.BitDepth != 24) || config.NumChannels == 0 || config.FrameLength == 0 || config.KB == 0 {
+		return nil, ErrUnsupportedConfig
+	}
+
+	d = &Decoder{
+		config:    config,
+		mixU:      make([]int32, config.FrameLength),
+		mixV:      make([]int32, config.FrameLength),
+		predictor: make([]int32, config.FrameLength),
+	}
+
+	return d, nil
+}
+
+// Decode one frame. The PCM has BitDepth/8 bytes per sample, interleaved across the channels
+func (d *Decoder) Decode(frame []byte) (pcm []byte, err error) {
+	bytesPerSample := int(d.config.BitDepth) / 8
+	numChannels := int(d.config.NumChannels)
+	pcm = make([]byte, int(d.config.FrameLength)*numChannels*bytesPerSample)
+
+	r := &bitReader{data: frame}
+	numSamples := int(d.config.FrameLength)
+	channel := 0
+
+	for {
+		if r.overrun() || r.pos >= uint(len(frame))*8 {
+			return nil, ErrCorruptFrame
+		}
+
+		tag := r.read(3)
+		switch tag {
+		case idSCE, idLFE:
+			if channel+1 > numChannels {
+				return nil, ErrCorruptFrame
+			}
+
+			numSamples, err = d.decodeSingle(r, pcm, channel)
+			if err != nil {
+				return nil, err
+			}
+			channel++
+			break
+
+		case idCPE:
+			if channel+2 > numChannels {
+				return nil, ErrCorruptFrame
+			}
+
+			numSamples, err = d.decodePair(r, pcm, channel)
+			if err != nil {
+				return nil, err
+			}
+			channel += 2
+			break
+
+		case idDSE:
+			// Instance, then a flag to byte align before the data
+			r.skip(4)
+			aligned := r.read(1)
+			count := r.read(8)
+			if count == 255 {
+				count += r.read(8)
+			}
+			if aligned == 1 {
+				r.align()
+			}
+			r.skip(uint(count) * 8)
+			break
+
+		case idFIL:
+			count := r.read(4)
+			if count == 15 {
+				count += r.read(8) - 1
+			}
+			r.skip(uint(count) * 8)
+			break
+
+		case idEND:
+			if r.overrun() {
+				return nil, ErrCorruptFrame
+			}
+			return pcm[:numSamples*numChannels*bytesPerSample], nil
+
+		default:
+			// Coupling channels and program configs never turn up in practice
+			return nil, ErrCorruptFrame
+		}
+	}
+}
+
+// Read the start of a single channel or channel pair element, after the tag
+func (d *Decoder) readElementHeader(r *bitReader) (numSamples int, bytesShifted uint, escape bool, err error) {
+	r.skip(4) // Element instance
+	if r.read(12) != 0 {
+		return 0, 0, false, ErrCorruptFrame
+	}
+
+	flags := r.read(4)
+	bytesShifted = uint(flags>>1) & 0x3
+	escape = flags&1 != 0
+	if bytesShifted == 3 {
+		return 0, 0, false, ErrCorruptFrame
+	}
+
+	numSamples = int(d.config.FrameLength)
+	if flags>>3 != 0 {
+		// Partial frame
+		n := r.read(32)
+		if n > d.config.FrameLength {
+			return 0, 0, false, ErrCorruptFrame
+		}
+		numSamples = int(n)
+	}
+
+	return numSamples, bytesShifted, escape, nil
+}
+
+func readChannelParams(r *bitReader) (p channelParams) {
+	header := r.read(8)
+	p.mode = header >> 4
+	p.denShift = uint(header & 0xf)
+
+	header = r.read(8)
+	p.pbFactor = header >> 5
+	p.coefs = make([]int16, header&0x1f)
+	for i := range p.coefs {
+		p.coefs[i] = int16(r.read(16))
+	}
+
+	return p
+}
+
+// Decode one compressed channel into out
+func (d *Decoder) decodeChannel(r *bitReader, p channelParams, out []int32, chanBits uint) (err error) {
+	predictor := d.predictor[:len(out)]
+
+	err = decompress(r, predictor, newGolombParams(d.config, p.pbFactor), chanBits)
+	if err != nil {
+		return err
+	}
+
+	if p.mode != 0 {
+		accumulate(predictor, predictor, chanBits)
+	}
+	unpredict(predictor, out, p.coefs, chanBits, p.denShift)
+
+	return nil
+}
+
+// Read uncompressed samples of chanBits each, interleaved across channels
+func readEscape(r *bitReader, channels [][]int32, chanBits uint) {
+	shift := 32 - chanBits
+	for i := range channels[0] {
+		for _, samples := range channels {
+			samples[i] = int32(r.read(chanBits)<<shift) >> shift
+		}
+	}
+}
+
+func (d *Decoder) decodeSingle(r *bitReader, pcm []byte, channel int) (numSamples int, err error) {
+	numSamples, bytesShifted, escape, err := d.readElementHeader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	u := d.mixU[:numSamples]
+	chanBits := uint(d.config.BitDepth) - bytesShifted*8
+
+	if escape {
+		readEscape(r, [][]int32{u}, uint(d.config.BitDepth))
+	} else {
+		r.skip(16) // No mixing for one channel
+		p := readChannelParams(r)
+
+		// The shifted off bytes come before the compressed samples
+		var shifted bitReader
+		if bytesShifted != 0 {
+			shifted = *r
+			r.skip(bytesShifted * 8 * uint(numSamples))
+		}
+
+		err = d.decodeChannel(r, p, u, chanBits)
+		if err != nil {
+			return 0, err
+		}
+
+		if bytesShifted != 0 {
+			for i := 0; i < numSamples; i++ {
+				u[i] = u[i]<<(bytesShifted*8) | int32(shifted.read(bytesShifted*8))
+			}
+		}
+	}
+
+	d.output(pcm, channel, u)
+	return numSamples, nil
+}
+
+func (d *Decoder) decodePair(r *bitReader, pcm []byte, channel int) (numSamples int, err error) {
+	numSamples, bytesShifted, escape, err := d.readElementHeader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	u := d.mixU[:numSamples]
+	v := d.mixV[:numSamples]
+	chanBits := uint(d.config.BitDepth) - bytesShifted*8 + 1 // Mixing can add a bit
+
+	if escape {
+		readEscape(r, [][]int32{u, v}, uint(d.config.BitDepth))
+	} else {
+		mixBits := uint(r.read(8))
+		mixRes := int32(int8(r.read(8)))
+		pu := readChannelParams(r)
+		pv := readChannelParams(r)
+
+		var shifted bitReader
+		if bytesShifted != 0 {
+			shifted = *r
+			r.skip(bytesShifted * 8 * 2 * uint(numSamples))
+		}
+
+		err = d.decodeChannel(r, pu, u, chanBits)
+		if err != nil {
+			return 0, err
+		}
+		err = d.decodeChannel(r, pv, v, chanBits)
+		if err != nil {
+			return 0, err
+		}
+
+		unmix(u, v, mixBits, mixRes)
+
+		if bytesShifted != 0 {
+			for i := 0; i < numSamples; i++ {
+				u[i] = u[i]<<(bytesShifted*8) | int32(shifted.read(bytesShifted*8))
+				v[i] = v[i]<<(bytesShifted*8) | int32(shifted.read(bytesShifted*8))
+			}
+		}
+	}
+
+	d.output(pcm, channel, u)
+	d.output(pcm, channel+1, v)
+	return numSamples, nil
+}
+
+// Write one channel's samples into their places in the interleaved PCM
+func (d *Decoder) output(pcm []byte, channel int, samples []int32) {
+	bytesPerSample := int(d.config.BitDepth) / 8
+	stride := int(d.config.NumChannels) * bytesPerSample
+
+	for i, s := range samples {
+		o := pcm[i*stride+channel*bytesPerSample:]
+		o[0] = byte(s)
+		o[1] = byte(s >> 8)
+		if bytesPerSample == 3 {
+			o[2] = byte(s >> 16)
+		}
+	}
+}
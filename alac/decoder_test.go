@@ -0,0 +1,317 @@
+package alac
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// Write a compressed element for any number of channels and bit depth, the way Apple's encoder does. 24-bit
+// samples have their low byte shifted off and sent as is
+func writeTestElement(w *bitWriter, config Config, tag uint32, channels [][]int32, mixRes int32) {
+	numSamples := len(channels[0])
+	bytesShifted := uint(0)
+	if config.BitDepth == 24 {
+		bytesShifted = 1
+	}
+	chanBits := uint(config.BitDepth) - bytesShifted*8 + uint(len(channels)-1)
+
+	high := make([][]int32, len(channels))
+	for c := range channels {
+		high[c] = make([]int32, numSamples)
+		for i, s := range channels[c] {
+			high[c][i] = s >> (bytesShifted * 8)
+		}
+	}
+	if len(channels) == 2 {
+		u := make([]int32, numSamples)
+		v := make([]int32, numSamples)
+		mix(high[0], high[1], u, v, mixRes)
+		high[0], high[1] = u, v
+	}
+
+	partial := uint32(0)
+	if numSamples != int(config.FrameLength) {
+		partial = 1
+	}
+
+	w.write(tag, 3)
+	w.write(0, 4)
+	w.write(0, 12)
+	w.write(partial<<3|uint32(bytesShifted)<<1, 4)
+	if partial != 0 {
+		w.write(uint32(numSamples), 32)
+	}
+
+	if len(channels) == 2 {
+		w.write(mixBits, 8)
+		w.write(uint32(uint8(mixRes)), 8)
+	} else {
+		w.write(0, 16)
+	}
+
+	coefs := make([][]int16, len(channels))
+	for c := range channels {
+		coefs[c] = make([]int16, maxOrder)
+		initCoefs(coefs[c])
+
+		w.write(denShift, 8)
+		w.write(pbFactor<<5|maxOrder, 8)
+		for _, coef := range coefs[c] {
+			w.write(uint32(uint16(coef)), 16)
+		}
+	}
+
+	if bytesShifted != 0 {
+		for i := 0; i < numSamples; i++ {
+			for c := range channels {
+				w.write(uint32(channels[c][i]), bytesShifted*8)
+			}
+		}
+	}
+
+	for c := range channels {
+		residuals := make([]int32, numSamples)
+		predict(high[c], residuals, coefs[c], chanBits)
+		compress(w, residuals, newGolombParams(config, pbFactor), chanBits)
+	}
+}
+
+// A chord at any bit depth
+func testWave(numSamples int, bitDepth uint, phase float64) []int32 {
+	samples := make([]int32, numSamples)
+	scale := float64(int32(1)<<(bitDepth-1)) / 3
+
+	for i := range samples {
+		t := float64(i) / 44100
+		samples[i] = int32(scale * (math.Sin(2*math.Pi*440*t+phase) + math.Sin(2*math.Pi*554.37*t)))
+	}
+
+	return samples
+}
+
+// Interleaved little-endian PCM
+func testInterleave(channels [][]int32, bitDepth uint) []byte {
+	var pcm []byte
+	for i := range channels[0] {
+		for c := range channels {
+			s := channels[c][i]
+			pcm = append(pcm, byte(s), byte(s>>8))
+			if bitDepth == 24 {
+				pcm = append(pcm, byte(s>>16))
+			}
+		}
+	}
+
+	return pcm
+}
+
+func testDecode(t *testing.T, config Config, frame []byte, expected []byte) {
+	d, err := NewDecoder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcm, err := d.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pcm) != len(expected) {
+		t.Fatalf("Expected %d bytes of PCM, got %d", len(expected), len(pcm))
+	}
+	for i := range pcm {
+		if pcm[i] != expected[i] {
+			t.Fatalf("PCM differs at byte %d: expected %x, got %x", i, expected[i], pcm[i])
+		}
+	}
+}
+
+////////
+
+func TestNewDecoder(t *testing.T) {
+	config := RAOPConfig()
+	config.BitDepth = 20
+	if _, err := NewDecoder(config); err != ErrUnsupportedConfig {
+		t.Errorf("Expected ErrUnsupportedConfig, got %v", err)
+	}
+
+	config = RAOPConfig()
+	config.NumChannels = 0
+	if _, err := NewDecoder(config); err != ErrUnsupportedConfig {
+		t.Errorf("Expected ErrUnsupportedConfig, got %v", err)
+	}
+}
+
+// Whatever the encoder makes should come back out as it went in
+func TestDecodeEncoded(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+	d, _ := NewDecoder(RAOPConfig())
+
+	var frames [][]int16
+	for i := 0; i < 10; i++ {
+		frames = append(frames, testMusic(352, i*352, 20))
+	}
+	frames = append(frames, make([]int16, 2*352), testMusic(100, 0, 20))
+
+	for i, samples := range frames {
+		pcm := testPCM(samples)
+		frame, err := e.Encode(pcm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := d.Decode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(decoded, pcm) == false {
+			t.Errorf("Frame %d didn't survive encoding and decoding", i)
+		}
+	}
+
+	e.Uncompressed = true
+	pcm := testPCM(testMusic(352, 0, 20))
+	frame, _ := e.Encode(pcm)
+	decoded, err := d.Decode(frame)
+	if err != nil || bytes.Equal(decoded, pcm) == false {
+		t.Errorf("Escape frame didn't survive encoding and decoding: %v", err)
+	}
+}
+
+func TestDecodeMono(t *testing.T) {
+	config := RAOPConfig()
+	config.NumChannels = 1
+	samples := testWave(352, 16, 0)
+
+	w := &bitWriter{}
+	writeTestElement(w, config, idSCE, [][]int32{samples}, 0)
+	w.write(idEND, 3)
+
+	testDecode(t, config, w.bytes(), testInterleave([][]int32{samples}, 16))
+
+	// And uncompressed
+	w = &bitWriter{}
+	w.write(idSCE, 3)
+	w.write(0, 16)
+	w.write(1, 4)
+	for _, s := range samples {
+		w.write(uint32(s), 16)
+	}
+	w.write(idEND, 3)
+
+	testDecode(t, config, w.bytes(), testInterleave([][]int32{samples}, 16))
+}
+
+func TestDecode24Bit(t *testing.T) {
+	config := RAOPConfig()
+	config.BitDepth = 24
+	left := testWave(352, 24, 0)
+	right := testWave(352, 24, 1)
+
+	for mixRes := int32(0); mixRes <= 2; mixRes++ {
+		w := &bitWriter{}
+		writeTestElement(w, config, idCPE, [][]int32{left, right}, mixRes)
+		w.write(idEND, 3)
+
+		testDecode(t, config, w.bytes(), testInterleave([][]int32{left, right}, 24))
+	}
+
+	// Partial and uncompressed
+	w := &bitWriter{}
+	w.write(idCPE, 3)
+	w.write(0, 16)
+	w.write(0x9, 4)
+	w.write(10, 32)
+	for i := 0; i < 10; i++ {
+		w.write(uint32(left[i]), 24)
+		w.write(uint32(right[i]), 24)
+	}
+	w.write(idEND, 3)
+
+	testDecode(t, config, w.bytes(), testInterleave([][]int32{left[:10], right[:10]}, 24))
+
+	// Mono
+	config.NumChannels = 1
+	w = &bitWriter{}
+	writeTestElement(w, config, idSCE, [][]int32{left}, 0)
+	w.write(idEND, 3)
+
+	testDecode(t, config, w.bytes(), testInterleave([][]int32{left}, 24))
+}
+
+func TestDecodeSkippedElements(t *testing.T) {
+	config := RAOPConfig()
+	left := testWave(352, 16, 0)
+	right := testWave(352, 16, 1)
+
+	w := &bitWriter{}
+
+	// A data stream element with 3 bytes, byte aligned
+	w.write(idDSE, 3)
+	w.write(0, 4)
+	w.write(1, 1)
+	w.write(3, 8)
+	w.bytes()
+	w.write(0xABCDEF, 24)
+
+	// A fill element with 2 bytes
+	w.write(idFIL, 3)
+	w.write(2, 4)
+	w.write(0xFFFF, 16)
+
+	writeTestElement(w, config, idCPE, [][]int32{left, right}, 2)
+	w.write(idEND, 3)
+
+	testDecode(t, config, w.bytes(), testInterleave([][]int32{left, right}, 16))
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+	d, _ := NewDecoder(RAOPConfig())
+
+	frame, _ := e.Encode(testPCM(testMusic(352, 0, 20)))
+
+	if _, err := d.Decode(frame[:len(frame)/2]); err != ErrCorruptFrame {
+		t.Errorf("Expected ErrCorruptFrame for a truncated frame, got %v", err)
+	}
+	if _, err := d.Decode(nil); err != ErrCorruptFrame {
+		t.Errorf("Expected ErrCorruptFrame for an empty frame, got %v", err)
+	}
+
+	// A coupling channel element
+	if _, err := d.Decode([]byte{0x40, 0x00}); err != ErrCorruptFrame {
+		t.Errorf("Expected ErrCorruptFrame for a CCE, got %v", err)
+	}
+
+	// Two channel pairs is more channels than we have
+	w := &bitWriter{}
+	for i := 0; i < 2; i++ {
+		w.write(idCPE, 3)
+		w.write(0, 16)
+		w.write(0x9, 4)
+		w.write(1, 32)
+		w.write(0, 32)
+	}
+	w.write(idEND, 3)
+	if _, err := d.Decode(w.bytes()); err != ErrCorruptFrame {
+		t.Errorf("Expected ErrCorruptFrame for too many channels, got %v", err)
+	}
+}
+
+func TestBitReader(t *testing.T) {
+	r := &bitReader{data: []byte{0xBF, 0xFD, 0xEA, 0xDB, 0xEE, 0xF0}}
+
+	if r.read(3) != 0x5 || r.read(9) != 0x1FF || r.peek(32) != 0xDEADBEEF || r.read(32) != 0xDEADBEEF {
+		t.Error("Unexpected bits")
+	}
+
+	r.align()
+	if r.pos != 48 || r.overrun() {
+		t.Errorf("Unexpected position after aligning: %d", r.pos)
+	}
+
+	if r.read(8) != 0 || r.overrun() == false {
+		t.Error("Expected zeroes and an overrun past the end")
+	}
+}
@@ -0,0 +1,155 @@
+package alac
+
+// Encodes 16-bit stereo PCM into ALAC frames
+type Encoder struct {
+	// Only write escape frames, which are the samples uncompressed. Cheaper, but twice the bandwidth
+	Uncompressed bool
+
+	config Config
+	params golombParams
+
+	// The predictors carry on from one frame to the next
+	coefsU [maxOrder]int16
+	coefsV [maxOrder]int16
+
+	left, right []int32
+	u, v        []int32
+	residualsU  []int32
+	residualsV  []int32
+}
+
+// Make an encoder for config, which must be 16-bit stereo. RAOPConfig is what receivers want
+func NewEncoder(config Config) (e *Encoder, err error) {
+	if config.BitDepth != 16 || config.NumChannels != 2 || config.FrameLength == 0 {
+		return nil, ErrUnsupportedConfig
+	}
+
+	e = &Encoder{
+		config:     config,
+		params:     newGolombParams(config, pbFactor),
+		left:       make([]int32, config.FrameLength),
+		right:      make([]int32, config.FrameLength),
+		u:          make([]int32, config.FrameLength),
+		v:          make([]int32, config.FrameLength),
+		residualsU: make([]int32, config.FrameLength),
+		residualsV: make([]int32, config.FrameLength),
+	}
+	initCoefs(e.coefsU[:])
+	initCoefs(e.coefsV[:])
+
+	return e, nil
+}
+
+// Encode one frame of interleaved 16-bit little-endian stereo PCM. A frame shorter than the configured
+// frame length is written as a partial frame
+func (e *Encoder) Encode(pcm []byte) (frame []byte, err error) {
+	if len(pcm)%4 != 0 || len(pcm) == 0 || len(pcm)/4 > int(e.config.FrameLength) {
+		return nil, ErrFrameLength
+	}
+
+	numSamples := len(pcm) / 4
+	left := e.left[:numSamples]
+	right := e.right[:numSamples]
+	for i := 0; i < numSamples; i++ {
+		left[i] = int32(int16(uint16(pcm[4*i]) | uint16(pcm[4*i+1])<<8))
+		right[i] = int32(int16(uint16(pcm[4*i+2]) | uint16(pcm[4*i+3])<<8))
+	}
+
+	escape := e.encodeEscape(left, right)
+	if e.Uncompressed {
+		return escape, nil
+	}
+
+	// Try a few ways of mixing the channels and keep whichever comes out smallest
+	var best []byte
+	var bestU, bestV [maxOrder]int16
+	for mixRes := int32(0); mixRes <= maxMixRes; mixRes++ {
+		coefsU := e.coefsU
+		coefsV := e.coefsV
+
+		compressed := e.encodeCompressed(left, right, mixRes, coefsU[:], coefsV[:])
+		if best == nil || len(compressed) < len(best) {
+			best = compressed
+			bestU = coefsU
+			bestV = coefsV
+		}
+	}
+
+	if len(best) >= len(escape) {
+		return escape, nil
+	}
+
+	e.coefsU = bestU
+	e.coefsV = bestV
+
+	return best, nil
+}
+
+// Start a channel pair element, and the frame with it
+func (e *Encoder) writeHeader(w *bitWriter, numSamples int, escape bool) {
+	partial := uint32(0)
+	if numSamples != int(e.config.FrameLength) {
+		partial = 1
+	}
+
+	flags := partial << 3 // No bytes shifted
+	if escape {
+		flags |= 1
+	}
+
+	w.write(idCPE, 3)
+	w.write(0, 4)  // Element instance
+	w.write(0, 12) // Unused
+	w.write(flags, 4)
+
+	if partial != 0 {
+		w.write(uint32(numSamples), 32)
+	}
+}
+
+// The samples as they are
+func (e *Encoder) encodeEscape(left, right []int32) []byte {
+	w := &bitWriter{buf: make([]byte, 0, 8+4*len(left))}
+	e.writeHeader(w, len(left), true)
+
+	for i := range left {
+		w.write(uint32(left[i]), 16)
+		w.write(uint32(right[i]), 16)
+	}
+
+	w.write(idEND, 3)
+	return w.bytes()
+}
+
+// The samples mixed with mixRes, run through the predictors and Golomb coded. coefsU and coefsV are
+// adapted as we go
+func (e *Encoder) encodeCompressed(left, right []int32, mixRes int32, coefsU, coefsV []int16) []byte {
+	numSamples := len(left)
+	chanBits := uint(e.config.BitDepth) + 1 // Mixing can add a bit
+
+	w := &bitWriter{buf: make([]byte, 0, 4*numSamples)}
+	e.writeHeader(w, numSamples, false)
+
+	w.write(mixBits, 8)
+	w.write(uint32(mixRes), 8)
+	for _, coefs := range [][]int16{coefsU, coefsV} {
+		w.write(0<<4|denShift, 8) // Mode 0, the plain predictor
+		w.write(pbFactor<<5|uint32(len(coefs)), 8)
+		for _, coef := range coefs {
+			w.write(uint32(uint16(coef)), 16)
+		}
+	}
+
+	u := e.u[:numSamples]
+	v := e.v[:numSamples]
+	mix(left, right, u, v, mixRes)
+
+	predict(u, e.residualsU[:numSamples], coefsU, chanBits)
+	predict(v, e.residualsV[:numSamples], coefsV, chanBits)
+
+	compress(w, e.residualsU[:numSamples], e.params, chanBits)
+	compress(w, e.residualsV[:numSamples], e.params, chanBits)
+
+	w.write(idEND, 3)
+	return w.bytes()
+}
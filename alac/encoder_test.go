@@ -0,0 +1,404 @@
+//
+// Encoded frames are checked against a reference decoder, written here from
+// the description of the format in ffmpeg's alac.c rather than from Apple's
+// code that the encoder follows, so the two can't share a misreading.
+//
+
+package alac
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Reads big-endian bit fields
+type testBitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *testBitReader) bit() uint32 {
+	if r.pos/8 >= len(r.data) {
+		r.pos++
+		return 0
+	}
+
+	b := r.data[r.pos/8] >> uint(7-r.pos%8) & 1
+	r.pos++
+	return uint32(b)
+}
+
+func (r *testBitReader) bits(n int) (v uint32) {
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+
+	return v
+}
+
+func (r *testBitReader) peek(n int) uint32 {
+	pos := r.pos
+	v := r.bits(n)
+	r.pos = pos
+
+	return v
+}
+
+func signExtend(v int32, bits uint) int32 {
+	return v << (32 - bits) >> (32 - bits)
+}
+
+// ffmpeg's decode_scalar
+func testDecodeScalar(r *testBitReader, k int, bps int) uint32 {
+	x := uint32(0)
+	for x < 9 && r.bit() == 1 {
+		x++
+	}
+
+	if x > 8 {
+		return r.bits(bps)
+	}
+	if k != 1 {
+		extra := r.peek(k)
+		x = x<<uint(k) - x
+		if extra > 1 {
+			x += extra - 1
+			r.bits(k)
+		} else {
+			r.bits(k - 1)
+		}
+	}
+
+	return x
+}
+
+// ffmpeg's rice_decompress
+func testRiceDecompress(r *testBitReader, config Config, out []int32, bps int, historyMult uint32) {
+	history := uint32(config.MB)
+	signModifier := uint32(0)
+
+	for i := 0; i < len(out); i++ {
+		k := int(math.Log2(float64(history>>9 + 3)))
+		if k > int(config.KB) {
+			k = int(config.KB)
+		}
+
+		x := testDecodeScalar(r, k, bps) + signModifier
+		signModifier = 0
+		out[i] = int32(x>>1) ^ -int32(x&1)
+
+		if x > 0xffff {
+			history = 0xffff
+		} else {
+			history += x*historyMult - (history*historyMult)>>9
+		}
+
+		if history < 128 && i+1 < len(out) {
+			k = 7 - int(math.Log2(float64(history))) + int((history+16)>>6)
+			if k > int(config.KB) {
+				k = int(config.KB)
+			}
+
+			block := int(testDecodeScalar(r, k, 16))
+			for j := 0; j < block; j++ {
+				i++
+				out[i] = 0
+			}
+			if block <= 0xffff {
+				signModifier = 1
+			}
+			history = 0
+		}
+	}
+}
+
+// ffmpeg's lpc_prediction. ffmpeg keeps the coefficients oldest first, the opposite way round to the stream
+func testLPCPrediction(residuals []int32, out []int32, bps uint, coefs []int16, quant uint) {
+	order := len(coefs)
+	out[0] = residuals[0]
+
+	i := 1
+	for ; i <= order && i < len(out); i++ {
+		out[i] = signExtend(out[i-1]+residuals[i], bps)
+	}
+
+	for ; i < len(out); i++ {
+		pred := out[i-order-1 : i]
+		d := pred[0]
+		pred = pred[1:]
+
+		val := int32(0)
+		for j := 0; j < order; j++ {
+			val += (pred[j] - d) * int32(coefs[j])
+		}
+		val = (val + 1<<(quant-1)) >> quant
+		errorVal := residuals[i]
+		out[i] = signExtend(val+d+errorVal, bps)
+
+		errorSign := sign(errorVal)
+		for j := 0; j < order && errorVal*errorSign > 0; j++ {
+			val = d - pred[j]
+			s := sign(val) * errorSign
+			coefs[j] -= int16(s)
+			errorVal -= ((val * s) >> quant) * int32(j+1)
+		}
+	}
+}
+
+// Decode a frame into interleaved left and right samples
+func referenceDecode(config Config, frame []byte) (samples []int16, err error) {
+	r := &testBitReader{data: frame}
+
+	if r.bits(3) != idCPE {
+		return nil, errors.New("Not a channel pair element")
+	}
+	r.bits(4)
+	if r.bits(12) != 0 {
+		return nil, errors.New("Unused header bits are set")
+	}
+
+	hasSize := r.bits(1)
+	if r.bits(2) != 0 {
+		return nil, errors.New("Shifted samples aren't supported")
+	}
+	escape := r.bits(1)
+
+	numSamples := int(config.FrameLength)
+	if hasSize == 1 {
+		numSamples = int(r.bits(32))
+	}
+
+	left := make([]int32, numSamples)
+	right := make([]int32, numSamples)
+
+	if escape == 1 {
+		for i := 0; i < numSamples; i++ {
+			left[i] = signExtend(int32(r.bits(16)), 16)
+			right[i] = signExtend(int32(r.bits(16)), 16)
+		}
+	} else {
+		shift := r.bits(8)
+		weight := int32(r.bits(8))
+
+		var quant [2]uint
+		var mult [2]uint32
+		var coefs [2][]int16
+		for ch := 0; ch < 2; ch++ {
+			if r.bits(4) != 0 {
+				return nil, errors.New("Unexpected prediction type")
+			}
+			quant[ch] = uint(r.bits(4))
+			mult[ch] = r.bits(3)
+			coefs[ch] = make([]int16, r.bits(5))
+			for i := len(coefs[ch]) - 1; i >= 0; i-- {
+				coefs[ch][i] = int16(r.bits(16))
+			}
+		}
+
+		bps := int(config.BitDepth) + 1
+		for ch, out := range [][]int32{left, right} {
+			residuals := make([]int32, numSamples)
+			testRiceDecompress(r, config, residuals, bps, uint32(config.PB)*mult[ch]/4)
+			testLPCPrediction(residuals, out, uint(bps), coefs[ch], quant[ch])
+		}
+
+		if weight != 0 {
+			for i := 0; i < numSamples; i++ {
+				a := left[i]
+				b := right[i]
+				a -= (b * weight) >> shift
+				b += a
+				left[i] = b
+				right[i] = a
+			}
+		}
+	}
+
+	if r.bits(3) != idEND {
+		return nil, errors.New("Missing END tag")
+	}
+	if (r.pos+7)/8 != len(frame) {
+		return nil, errors.New("Frame is the wrong length")
+	}
+
+	for i := range left {
+		samples = append(samples, int16(left[i]), int16(right[i]))
+	}
+
+	return samples, nil
+}
+
+// Little-endian PCM from interleaved samples
+func testPCM(samples []int16) []byte {
+	pcm := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		pcm[2*i] = byte(s)
+		pcm[2*i+1] = byte(uint16(s) >> 8)
+	}
+
+	return pcm
+}
+
+// A chord with a bit of noise, with the right channel like the left but quieter
+func testMusic(numSamples int, offset int, noise int) []int16 {
+	random := rand.New(rand.NewSource(int64(offset)))
+
+	samples := make([]int16, 2*numSamples)
+	for i := 0; i < numSamples; i++ {
+		t := float64(offset+i) / 44100
+		v := 6000*math.Sin(2*math.Pi*440*t) + 3000*math.Sin(2*math.Pi*554.37*t) + 2000*math.Sin(2*math.Pi*659.25*t)
+		v += float64(random.Intn(2*noise+1) - noise)
+
+		samples[2*i] = int16(v)
+		samples[2*i+1] = int16(v * 0.7)
+	}
+
+	return samples
+}
+
+func testRoundTrip(t *testing.T, e *Encoder, samples []int16) []byte {
+	frame, err := e.Encode(testPCM(samples))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := referenceDecode(e.config, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != len(samples) {
+		t.Fatalf("Expected %d samples, got %d", len(samples), len(decoded))
+	}
+	for i := range samples {
+		if decoded[i] != samples[i] {
+			t.Fatalf("Sample %d: expected %d, got %d", i, samples[i], decoded[i])
+		}
+	}
+
+	return frame
+}
+
+////////
+
+func TestNewEncoder(t *testing.T) {
+	config := RAOPConfig()
+	config.BitDepth = 24
+	if _, err := NewEncoder(config); err != ErrUnsupportedConfig {
+		t.Errorf("Expected ErrUnsupportedConfig, got %v", err)
+	}
+
+	e, err := NewEncoder(RAOPConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Encode(make([]byte, 353*4)); err != ErrFrameLength {
+		t.Errorf("Expected ErrFrameLength, got %v", err)
+	}
+	if _, err := e.Encode(make([]byte, 7)); err != ErrFrameLength {
+		t.Errorf("Expected ErrFrameLength, got %v", err)
+	}
+}
+
+func TestEncodeEscape(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+	e.Uncompressed = true
+
+	frame := testRoundTrip(t, e, testMusic(352, 0, 100))
+
+	// 23 bits of header, the samples, and 3 bits of END
+	if len(frame) != (23+352*32+3+7)/8 {
+		t.Errorf("Unexpected escape frame length: %d", len(frame))
+	}
+	if frame[0] != 0x20 || frame[2]&0x1E != 0x02 {
+		t.Errorf("Unexpected escape frame header: %x", frame[:3])
+	}
+}
+
+func TestEncodeCompressed(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+
+	// Several frames in a row, since the predictors carry on between them
+	total := 0
+	for i := 0; i < 20; i++ {
+		frame := testRoundTrip(t, e, testMusic(352, i*352, 20))
+		total += len(frame)
+	}
+
+	escape := (23 + 352*32 + 3 + 7) / 8
+	if total >= 20*escape*3/4 {
+		t.Errorf("Music barely compressed: %d bytes vs %d uncompressed", total, 20*escape)
+	}
+}
+
+func TestEncodeSilence(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+
+	frame := testRoundTrip(t, e, make([]int16, 2*352))
+	if len(frame) > 64 {
+		t.Errorf("Silence should be tiny, got %d bytes", len(frame))
+	}
+}
+
+func TestEncodeNoise(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+
+	// Full scale noise doesn't compress, so it should come out as an escape frame
+	random := rand.New(rand.NewSource(1))
+	samples := make([]int16, 2*352)
+	for i := range samples {
+		samples[i] = int16(random.Uint32())
+	}
+
+	frame := testRoundTrip(t, e, samples)
+	if frame[2]&0x02 == 0 {
+		t.Error("Expected an escape frame for noise")
+	}
+}
+
+func TestEncodeExtremes(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+
+	// Square waves between the extremes, with the channels opposite, to push the mixing to its limits
+	samples := make([]int16, 2*352)
+	for i := 0; i < 352; i++ {
+		if i/16%2 == 0 {
+			samples[2*i] = math.MaxInt16
+			samples[2*i+1] = math.MinInt16
+		} else {
+			samples[2*i] = math.MinInt16
+			samples[2*i+1] = math.MaxInt16
+		}
+	}
+
+	testRoundTrip(t, e, samples)
+}
+
+func TestEncodePartial(t *testing.T) {
+	e, _ := NewEncoder(RAOPConfig())
+
+	frame := testRoundTrip(t, e, testMusic(100, 0, 20))
+	if frame[2]&0x10 == 0 {
+		t.Error("Expected the partial frame flag")
+	}
+
+	e.Uncompressed = true
+	testRoundTrip(t, e, testMusic(1, 0, 20))
+}
+
+func TestBitWriter(t *testing.T) {
+	w := &bitWriter{}
+	w.write(0x5, 3)
+	w.write(0x1FF, 9)
+	w.write(0xDEADBEEF, 32)
+
+	if w.len() != 44 {
+		t.Errorf("Expected 44 bits, got %d", w.len())
+	}
+	if bytes.Equal(w.bytes(), []byte{0xBF, 0xFD, 0xEA, 0xDB, 0xEE, 0xF0}) == false {
+		t.Errorf("Unexpected bits: %x", w.buf)
+	}
+}
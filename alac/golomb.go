@@ -0,0 +1,202 @@
+//
+// ALAC's adaptive Golomb coding of prediction residuals. The Golomb parameter
+// follows a running mean of recent values, and when the mean gets small
+// enough, runs of zeroes are sent as a single count.
+//
+// Codes are a unary prefix of up to 8 ones and a zero, then k or k-1 bits
+// of remainder. 9 ones means the value follows as plain bits instead.
+//
+
+package alac
+
+import (
+	"math/bits"
+)
+
+// The parts of a Config that drive the Golomb coder
+type golombParams struct {
+	mb uint32 // Initial mean
+	pb uint32 // How fast the mean moves
+	kb uint32 // Largest Golomb parameter
+	wb uint32 // Mask for the zero run parameter
+}
+
+func newGolombParams(config Config, pbFactor uint32) golombParams {
+	return golombParams{
+		mb: uint32(config.MB),
+		pb: uint32(config.PB) * pbFactor / 4,
+		kb: uint32(config.KB),
+		wb: 1<<uint32(config.KB) - 1,
+	}
+}
+
+// floor(log2(x + 3))
+func lg3a(x uint32) uint32 {
+	return 31 - uint32(bits.LeadingZeros32(x+3))
+}
+
+// The Golomb parameter for a sample, given the running mean
+func sampleK(mb uint32, kb uint32) uint32 {
+	k := lg3a(mb >> qbShift)
+	if k > kb {
+		k = kb
+	}
+
+	return k
+}
+
+// The Golomb parameter for a run of zeroes, given the running mean
+func zeroRunK(mb uint32, wb uint32) (k uint32, m uint32) {
+	k = uint32(bits.LeadingZeros32(mb)) - bitOff + (mb+moff)>>mdenShift
+	m = (1<<k - 1) & wb
+
+	return k, m
+}
+
+// Write n with Golomb parameter k (m is 2^k - 1), escaping to escapeBits plain bits if it's too big
+func writeGolomb(w *bitWriter, n uint32, k uint32, m uint32, escapeBits uint) {
+	div := n / m
+	if div < maxPrefix {
+		mod := n - m*div
+		de := uint32(0)
+		if mod == 0 {
+			de = 1
+		}
+
+		numBits := div + k + 1 - de
+		if numBits <= 25 {
+			value := (1<<div-1)<<(numBits-div) + mod + 1 - de
+			w.write(value, uint(numBits))
+			return
+		}
+	}
+
+	w.write(1<<maxPrefix-1, maxPrefix)
+	w.write(n, escapeBits)
+}
+
+// Write the residuals of one channel. chanBits is how wide they can be
+func compress(w *bitWriter, residuals []int32, params golombParams, chanBits uint) {
+	mb := params.mb
+	zmode := uint32(0)
+
+	for c := 0; c < len(residuals); {
+		k := sampleK(mb, params.kb)
+		del := residuals[c]
+		c++
+
+		// Interleave the sign into the low bit
+		var n uint32
+		if del < 0 {
+			n = uint32(-del)<<1 - 1
+		} else {
+			n = uint32(del) << 1
+		}
+		n -= zmode
+
+		writeGolomb(w, n, k, 1<<k-1, chanBits)
+
+		mb = params.pb*(n+zmode) + mb - (params.pb*mb)>>qbShift
+		if n > maxMeanClamp {
+			mb = maxMeanClamp
+		}
+		zmode = 0
+
+		if mb<<mmulShift < qb && c < len(residuals) {
+			zmode = 1
+
+			run := uint32(0)
+			for c < len(residuals) && residuals[c] == 0 {
+				run++
+				c++
+				if run >= maxZeroRun {
+					zmode = 0
+					break
+				}
+			}
+
+			k, m := zeroRunK(mb, params.wb)
+			writeGolomb(w, run, k, m, 16)
+
+			mb = 0
+		}
+	}
+}
+
+// Read a value written by writeGolomb
+func readGolomb(r *bitReader, k uint32, m uint32, escapeBits uint) uint32 {
+	prefix := uint32(0)
+	for prefix < maxPrefix && r.read(1) == 1 {
+		prefix++
+	}
+
+	if prefix >= maxPrefix {
+		return r.read(escapeBits)
+	}
+
+	// A remainder of 0 is written a bit shorter
+	v := r.peek(uint(k))
+	if v >= 2 {
+		r.skip(uint(k))
+		return prefix*m + v - 1
+	}
+
+	r.skip(uint(k) - 1)
+	return prefix * m
+}
+
+// Read the residuals of one channel, the other way round from compress
+func decompress(r *bitReader, residuals []int32, params golombParams, chanBits uint) (err error) {
+	mb := params.mb
+	zmode := uint32(0)
+
+	for c := 0; c < len(residuals); {
+		if r.overrun() {
+			return ErrCorruptFrame
+		}
+
+		k := sampleK(mb, params.kb)
+		n := readGolomb(r, k, 1<<k-1, chanBits)
+
+		// The low bit is the sign
+		ndecode := n + zmode
+		if ndecode&1 != 0 {
+			residuals[c] = -int32((ndecode + 1) >> 1)
+		} else {
+			residuals[c] = int32(ndecode >> 1)
+		}
+		c++
+
+		mb = params.pb*(n+zmode) + mb - (params.pb*mb)>>qbShift
+		if n > maxMeanClamp {
+			mb = maxMeanClamp
+		}
+		zmode = 0
+
+		if mb<<mmulShift < qb && c < len(residuals) {
+			zmode = 1
+
+			k, m := zeroRunK(mb, params.wb)
+			run := readGolomb(r, k, m, 16)
+			if int(run) > len(residuals)-c {
+				return ErrCorruptFrame
+			}
+
+			for i := uint32(0); i < run; i++ {
+				residuals[c] = 0
+				c++
+			}
+
+			if run >= maxZeroRun {
+				zmode = 0
+			}
+			mb = 0
+		}
+	}
+
+	if r.overrun() {
+		return ErrCorruptFrame
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+//
+// ALAC's adaptive linear predictor. Each sample is predicted from the ones
+// before it, and the coefficients are nudged after every sample in whichever
+// direction would have shrunk the residual. The decoder runs the same
+// adaptation, so only the starting coefficients go in the frame.
+//
+
+package alac
+
+// Starting coefficients for a fresh predictor
+func initCoefs(coefs []int16) {
+	den := int32(1) << denShift
+
+	coefs[0] = int16((38 * den) >> 4)
+	coefs[1] = int16((-29 * den) >> 4)
+	coefs[2] = int16((-2 * den) >> 4)
+	for k := 3; k < len(coefs); k++ {
+		coefs[k] = 0
+	}
+}
+
+// Turn samples into prediction residuals, adapting coefs as we go. chanBits is how many bits the
+// samples have; residuals wrap around to fit in the same number of bits
+func predict(in []int32, residuals []int32, coefs []int16, chanBits uint) {
+	numActive := len(coefs)
+	chanShift := 32 - chanBits
+	denHalf := int32(1) << (denShift - 1)
+
+	if len(in) == 0 {
+		return
+	}
+	residuals[0] = in[0]
+
+	// Until there's enough history, just send differences
+	for j := 1; j <= numActive && j < len(in); j++ {
+		residuals[j] = ((in[j] - in[j-1]) << chanShift) >> chanShift
+	}
+
+	for j := numActive + 1; j < len(in); j++ {
+		top := in[j-numActive-1]
+		previous := in[j-numActive : j]
+
+		var sum int32
+		for k := 0; k < numActive; k++ {
+			sum += int32(coefs[k]) * (previous[numActive-1-k] - top)
+		}
+
+		del := in[j] - top - ((sum + denHalf) >> denShift)
+		del = (del << chanShift) >> chanShift
+		residuals[j] = del
+
+		adapt(coefs, previous, top, del)
+	}
+}
+
+// Nudge the coefficients after a residual of del. previous are the samples the prediction was made from,
+// oldest first, and top is the one before those
+func adapt(coefs []int16, previous []int32, top int32, del int32) {
+	numActive := len(coefs)
+
+	if del > 0 {
+		for k := numActive - 1; k >= 0; k-- {
+			dd := top - previous[numActive-1-k]
+			sgn := sign(dd)
+			coefs[k] -= int16(sgn)
+			del -= int32(numActive-k) * ((sgn * dd) >> denShift)
+			if del <= 0 {
+				break
+			}
+		}
+	} else if del < 0 {
+		for k := numActive - 1; k >= 0; k-- {
+			dd := top - previous[numActive-1-k]
+			sgn := sign(dd)
+			coefs[k] += int16(sgn)
+			del -= int32(numActive-k) * ((-sgn * dd) >> denShift)
+			if del >= 0 {
+				break
+			}
+		}
+	}
+}
+
+// Split left and right into the two channels we compress. With a mixing weight of 0 they're left as they are,
+// otherwise u is a weighted mid channel and v is the difference
+func mix(left, right, u, v []int32, mixRes int32) {
+	if mixRes == 0 {
+		copy(u, left)
+		copy(v, right)
+		return
+	}
+
+	m2 := int32(1<<mixBits) - mixRes
+	for i := range left {
+		u[i] = (mixRes*left[i] + m2*right[i]) >> mixBits
+		v[i] = left[i] - right[i]
+	}
+}
+
+// Turn residuals back into samples, adapting coefs the same way predict did. out can't be residuals
+func unpredict(residuals []int32, out []int32, coefs []int16, chanBits uint, denShift uint) {
+	numActive := len(coefs)
+	chanShift := 32 - chanBits
+
+	if len(residuals) == 0 {
+		return
+	}
+	out[0] = residuals[0]
+
+	if numActive == 0 {
+		copy(out[1:], residuals[1:])
+		return
+	}
+
+	for j := 1; j <= numActive && j < len(residuals); j++ {
+		out[j] = ((residuals[j] + out[j-1]) << chanShift) >> chanShift
+	}
+
+	denHalf := int32(1) << (denShift - 1)
+	for j := numActive + 1; j < len(residuals); j++ {
+		top := out[j-numActive-1]
+		previous := out[j-numActive : j]
+
+		var sum int32
+		for k := 0; k < numActive; k++ {
+			sum += int32(coefs[k]) * (previous[numActive-1-k] - top)
+		}
+
+		del := residuals[j]
+		out[j] = ((del + top + (sum+denHalf)>>denShift) << chanShift) >> chanShift
+
+		adapt(coefs, previous, top, del)
+	}
+}
+
+// The first-order predictor of mode 31: each residual is the difference from the sample before. Works in place
+func accumulate(residuals []int32, out []int32, chanBits uint) {
+	chanShift := 32 - chanBits
+
+	if len(residuals) == 0 {
+		return
+	}
+	out[0] = residuals[0]
+
+	for j := 1; j < len(residuals); j++ {
+		out[j] = ((residuals[j] + out[j-1]) << chanShift) >> chanShift
+	}
+}
+
+// Undo mix, turning u and v back into left and right in place
+func unmix(u, v []int32, mixBits uint, mixRes int32) {
+	if mixRes == 0 {
+		return
+	}
+
+	for i := range u {
+		l := u[i] + v[i] - (mixRes*v[i])>>mixBits
+		u[i] = l
+		v[i] = l - v[i]
+	}
+}
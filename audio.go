@@ -0,0 +1,367 @@
+//
+// Sending audio to a receiver once a RAOP session is set up. Audio goes
+// out as RTP over UDP to the server port from SETUP, one packet per frame
+// of 352 samples, paced to play back in real time.
+//
+// http://www.ietf.org/rfc/rfc3550.txt - RTP
+// http://www.ietf.org/rfc/rfc3551.txt - RTP Profile for Audio and Video, for L16
+//
+// Receivers almost all want ALAC (see the alac package), but some will
+// take big-endian L16 PCM too.
+//
+
+package airplay
+
+import (
+	"context"
+	"errors"
+	"github.com/grantmd/go-airplay/alac"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audio codecs, numbered the same as the cn TXT flag (see AirplayDevice.AudioCodecs)
+const (
+	CodecPCM  = 0
+	CodecALAC = 1
+)
+
+const (
+	FrameSamples    = 352              // Samples per channel in each packet
+	SampleRate      = 44100            // Samples per second
+	FrameBytes      = FrameSamples * 4 // Bytes of 16-bit stereo PCM in each packet
+	rtpPayloadType  = 96
+	rtpHeaderLength = 12
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("Audio codec is not supported")
+	ErrShortFrame       = errors.New("Audio frame is the wrong length")
+)
+
+// Sends audio to the receiver of a RAOP session
+type AudioSender struct {
+	airplay     *Airplay
+	conn        *net.UDPConn    // Connected to the receiver's server port
+	control     *net.UDPConn    // Our end of the control channel, if the session has one
+	controlAddr *net.UDPAddr    // The receiver's end of the control channel
+	encoder     *alac.Encoder   // For CodecALAC
+	ctx         context.Context // When it's done, we stop sending and tear the session down
+
+	lock      sync.Mutex // Protects everything below, which the control channel goroutines also use
+	seq       uint16     // Sequence number of the next packet
+	timestamp uint32     // RTP timestamp of the next packet, in samples
+	ssrc      uint32
+	marker    bool                     // Set the marker bit on the next packet, to mark the start of a stream
+	needSync  bool                     // Send a sync packet with the extension bit before the next packet
+	start     time.Time                // When we sent the first frame, for pacing
+	sent      int64                    // Frames sent since start
+	recent    [resendBufferSize][]byte // Packets we've sent, for retransmission
+	suspended bool                     // The connection to the receiver is down, so frames go nowhere for now
+	lost      error                    // Why we gave up reconnecting, if we did
+
+	done        chan struct{} // Closed to stop the sync loop
+	controlDone chan struct{} // Closed once serveControl has returned
+	closeOnce   sync.Once
+	closeErr    error
+}
+
+// Create a sender for the session. Call this after Setup, and pass Seq and Timestamp to Record before streaming
+func (a *Airplay) NewAudioSender() (s *AudioSender, err error) {
+	return a.NewAudioSenderContext(context.Background())
+}
+
+// Like NewAudioSender, but once ctx is done WriteFrame stops sending, tears the session down and returns ctx.Err()
+func (a *Airplay) NewAudioSenderContext(ctx context.Context) (s *AudioSender, err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.serverPort == 0 {
+		return nil, ErrNoSession
+	}
+
+	var encoder *alac.Encoder
+	switch a.Codec {
+	case CodecPCM:
+		break
+	case CodecALAC:
+		encoder, err = alac.NewEncoder(alacConfig())
+		if err != nil {
+			return nil, err
+		}
+		break
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(a.ip.String(), strconv.Itoa(a.serverPort)))
+	if err != nil {
+		return nil, err
+	}
+
+	s = &AudioSender{
+		airplay:     a,
+		conn:        conn.(*net.UDPConn),
+		encoder:     encoder,
+		ctx:         ctx,
+		seq:         uint16(rand.Uint32()),
+		timestamp:   rand.Uint32(),
+		ssrc:        rand.Uint32(),
+		marker:      true,
+		needSync:    true,
+		done:        make(chan struct{}),
+		controlDone: make(chan struct{}),
+	}
+
+	if a.controlConn != nil && a.controlPort != 0 {
+		s.control = a.controlConn
+		s.controlAddr = &net.UDPAddr{
+			IP:   a.ip,
+			Port: a.controlPort,
+		}
+
+		go s.serveControl()
+		go s.syncLoop(syncInterval)
+	} else {
+		close(s.controlDone)
+	}
+
+	a.sender = s
+
+	return s, nil
+}
+
+// The sequence number the next packet will have
+func (s *AudioSender) Seq() uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.seq
+}
+
+// The RTP timestamp the next packet will have
+func (s *AudioSender) Timestamp() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.timestamp
+}
+
+// Send one frame of audio: FrameSamples samples of interleaved 16-bit little-endian stereo PCM.
+// Blocks until it's time to send the frame, so that audio plays back in real time
+func (s *AudioSender) WriteFrame(pcm []byte) (err error) {
+	if len(pcm) != FrameBytes {
+		return ErrShortFrame
+	}
+
+	if s.ctx.Err() != nil {
+		return s.cancel()
+	}
+
+	payload, err := s.encode(pcm)
+	if err != nil {
+		return err
+	}
+
+	if s.airplay.aesKey != nil {
+		err = encryptPayload(payload, s.airplay.aesKey, s.airplay.aesIV)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.wait()
+	if err != nil {
+		return s.cancel()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.lost != nil {
+		return s.lost
+	}
+
+	// Let the receiver know where we're starting from
+	if s.needSync && s.suspended == false {
+		s.sendSync(true)
+		s.needSync = false
+	}
+
+	// While we're reconnecting the frame is dropped, but time moves on as if it had played
+	packet := s.packet(payload)
+	if s.suspended == false {
+		_, err = s.conn.Write(packet)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.rememberPacket(s.seq, packet)
+	s.seq++
+	s.timestamp += FrameSamples
+	s.sent++
+
+	return nil
+}
+
+// Send PCM from r until it runs out, in the format WriteFrame takes. A partial frame at the end is padded with silence
+func (s *AudioSender) Stream(r io.Reader) error {
+	frame := make([]byte, FrameBytes)
+	for {
+		read, err := io.ReadFull(r, frame)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			for i := read; i < len(frame); i++ {
+				frame[i] = 0
+			}
+		} else if err != nil {
+			return err
+		}
+
+		err = s.WriteFrame(frame)
+		if err != nil {
+			return err
+		}
+
+		if read < len(frame) {
+			return nil
+		}
+	}
+}
+
+// Throw away whatever the receiver has buffered, to pause or seek. Frames written afterwards start a fresh stream
+func (s *AudioSender) Flush() (err error) {
+	s.lock.Lock()
+	seq := s.seq
+	timestamp := s.timestamp
+	s.marker = true
+	s.needSync = true
+	s.start = time.Time{}
+	s.sent = 0
+	s.lock.Unlock()
+
+	return s.airplay.FlushContext(s.ctx, seq, timestamp)
+}
+
+// Stop sending. This doesn't end the session, Teardown does that. Closing more than once does nothing
+func (s *AudioSender) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		// Wake up serveControl without closing the session's control port
+		if s.control != nil {
+			s.control.SetReadDeadline(time.Now())
+			<-s.controlDone
+			s.control.SetReadDeadline(time.Time{})
+		}
+
+		s.lock.Lock()
+		s.closeErr = s.conn.Close()
+		s.lock.Unlock()
+
+		s.airplay.lockSession()
+		if s.airplay.sender == s {
+			s.airplay.sender = nil
+		}
+		s.airplay.unlockSession()
+	})
+
+	return s.closeErr
+}
+
+// Stop sending and tear the session down, because ctx is done. The TEARDOWN gets the usual request timeout
+// of its own, since ctx is already over
+func (s *AudioSender) cancel() error {
+	s.Close()
+
+	// This does nothing if the session is already gone
+	ctx, cancel := context.WithTimeout(context.Background(), s.airplay.timeout())
+	s.airplay.TeardownContext(ctx)
+	cancel()
+
+	return s.ctx.Err()
+}
+
+// Sleep until the next frame is due, or until ctx is done
+func (s *AudioSender) wait() error {
+	s.lock.Lock()
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	due := s.start.Add(time.Duration(s.sent*FrameSamples) * time.Second / SampleRate)
+	s.lock.Unlock()
+
+	if wait := due.Sub(time.Now()); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			break
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Turn a frame of PCM into an RTP payload for the session's codec
+func (s *AudioSender) encode(pcm []byte) (payload []byte, err error) {
+	switch s.airplay.Codec {
+	case CodecPCM:
+		// L16 is big-endian
+		payload = make([]byte, len(pcm))
+		for i := 0; i < len(pcm); i += 2 {
+			payload[i] = pcm[i+1]
+			payload[i+1] = pcm[i]
+		}
+		return payload, nil
+
+	case CodecALAC:
+		return s.encoder.Encode(pcm)
+	}
+
+	return nil, ErrUnsupportedCodec
+}
+
+// How we encode ALAC, which is also what we ANNOUNCE
+func alacConfig() alac.Config {
+	config := alac.RAOPConfig()
+	config.FrameLength = FrameSamples
+	config.SampleRate = SampleRate
+
+	return config
+}
+
+// Wrap a payload in an RTP header with the current sequence number and timestamp
+func (s *AudioSender) packet(payload []byte) []byte {
+	packet := make([]byte, rtpHeaderLength+len(payload))
+
+	packet[0] = 0x80 // Version 2, no padding, extension or CSRCs
+	packet[1] = rtpPayloadType
+	if s.marker {
+		packet[1] |= 0x80
+		s.marker = false
+	}
+	packet[2] = byte(s.seq >> 8)
+	packet[3] = byte(s.seq)
+	packet[4] = byte(s.timestamp >> 24)
+	packet[5] = byte(s.timestamp >> 16)
+	packet[6] = byte(s.timestamp >> 8)
+	packet[7] = byte(s.timestamp)
+	packet[8] = byte(s.ssrc >> 24)
+	packet[9] = byte(s.ssrc >> 16)
+	packet[10] = byte(s.ssrc >> 8)
+	packet[11] = byte(s.ssrc)
+
+	copy(packet[rtpHeaderLength:], payload)
+
+	return packet
+}
@@ -0,0 +1,245 @@
+package airplay
+
+import (
+	"bytes"
+	"context"
+	"github.com/grantmd/go-airplay/alac"
+	"net"
+	"testing"
+	"time"
+)
+
+// Set up an Airplay that looks like it has been through SETUP, with its server port pointed at a local socket
+func testAudioSession(t *testing.T) (a *Airplay, server *net.UDPConn) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a = &Airplay{
+		ip:         net.IPv4(127, 0, 0, 1),
+		serverPort: server.LocalAddr().(*net.UDPAddr).Port,
+		session:    "DEADBEEF",
+	}
+
+	return a, server
+}
+
+func readTestPacket(t *testing.T, conn *net.UDPConn) []byte {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 2048)
+	read, _, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer[:read]
+}
+
+func TestAudioSender(t *testing.T) {
+	a, server := testAudioSession(t)
+	defer server.Close()
+
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	seq := s.Seq()
+	timestamp := s.Timestamp()
+
+	// Two and a half frames of a ramp, so we can check the byte order and the padding
+	pcm := make([]byte, FrameBytes*5/2)
+	for i := 0; i < len(pcm); i += 2 {
+		pcm[i] = byte(i / 2)
+		pcm[i+1] = 0x01
+	}
+
+	////////
+	start := time.Now()
+	err = s.Stream(bytes.NewReader(pcm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	// The third frame can't go out until two frames' worth of time has passed
+	if elapsed < 2*FrameSamples*time.Second/SampleRate {
+		t.Errorf("Frames were not paced, took %s", elapsed)
+	}
+
+	////////
+	for i := 0; i < 3; i++ {
+		packet := readTestPacket(t, server)
+		if len(packet) != rtpHeaderLength+FrameBytes {
+			t.Fatalf("Unexpected packet length: %d", len(packet))
+		}
+
+		if packet[0] != 0x80 {
+			t.Errorf("Unexpected RTP version byte: %x", packet[0])
+		}
+
+		marker := packet[1]&0x80 != 0
+		if marker != (i == 0) {
+			t.Errorf("Unexpected marker bit on packet %d: %t", i, marker)
+		}
+		if packet[1]&0x7F != rtpPayloadType {
+			t.Errorf("Unexpected payload type: %d", packet[1]&0x7F)
+		}
+
+		packetSeq := uint16(packet[2])<<8 | uint16(packet[3])
+		if packetSeq != seq+uint16(i) {
+			t.Errorf("Expected sequence number %d, got %d", seq+uint16(i), packetSeq)
+		}
+
+		packetTimestamp := uint32(packet[4])<<24 | uint32(packet[5])<<16 | uint32(packet[6])<<8 | uint32(packet[7])
+		if packetTimestamp != timestamp+uint32(i*FrameSamples) {
+			t.Errorf("Expected timestamp %d, got %d", timestamp+uint32(i*FrameSamples), packetTimestamp)
+		}
+
+		payload := packet[rtpHeaderLength:]
+		if i < 2 {
+			// Big-endian
+			if payload[0] != 0x01 || payload[1] != byte(i*FrameBytes/2) {
+				t.Errorf("Unexpected first sample in packet %d: %x", i, payload[:2])
+			}
+		} else {
+			// Only half of this one was real, the rest is silence
+			if payload[FrameBytes/2-2] != 0x01 || payload[FrameBytes/2] != 0 || payload[FrameBytes-1] != 0 {
+				t.Error("Last frame was not padded with silence")
+			}
+		}
+	}
+
+	if s.Seq() != seq+3 || s.Timestamp() != timestamp+3*FrameSamples {
+		t.Errorf("Unexpected sender position: %d, %d", s.Seq(), s.Timestamp())
+	}
+}
+
+func TestAudioSenderALAC(t *testing.T) {
+	a, server := testAudioSession(t)
+	defer server.Close()
+	a.Codec = CodecALAC
+
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A slow ramp, which compresses well
+	pcm := make([]byte, FrameBytes)
+	for i := 0; i < len(pcm); i += 2 {
+		pcm[i] = byte(i / 4)
+	}
+
+	err = s.WriteFrame(pcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := readTestPacket(t, server)[rtpHeaderLength:]
+	if len(payload) >= FrameBytes/2 {
+		t.Errorf("Audio didn't compress: %d bytes", len(payload))
+	}
+
+	d, err := alac.NewDecoder(alacConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := d.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(decoded, pcm) == false {
+		t.Error("Decoded audio doesn't match what we sent")
+	}
+}
+
+func TestAudioSenderErrors(t *testing.T) {
+	var a Airplay
+	if _, err := a.NewAudioSender(); err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession, got %v", err)
+	}
+
+	a.serverPort = 6000
+	a.Codec = 2
+	if _, err := a.NewAudioSender(); err != ErrUnsupportedCodec {
+		t.Errorf("Expected ErrUnsupportedCodec, got %v", err)
+	}
+
+	a2, server := testAudioSession(t)
+	defer server.Close()
+
+	s, err := a2.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.WriteFrame(make([]byte, 100)) != ErrShortFrame {
+		t.Error("Expected ErrShortFrame")
+	}
+}
+
+func TestAudioSenderCancel(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if err = a.Announce(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send the audio somewhere that's listening
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	a.serverPort = server.LocalAddr().(*net.UDPAddr).Port
+	a.controlPort = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := a.NewAudioSenderContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	////////
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err = s.Stream(bytes.NewReader(make([]byte, 100*FrameBytes)))
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Stream kept going for %v after being cancelled", time.Since(start))
+	}
+
+	if len(receiver.Requests("TEARDOWN")) != 1 {
+		t.Errorf("Expected 1 TEARDOWN, got %d", len(receiver.Requests("TEARDOWN")))
+	}
+	if a.session != "" || a.controlConn != nil || a.timing != nil {
+		t.Error("Session was not torn down")
+	}
+
+	// Once it's over, it stays over
+	if err = s.WriteFrame(make([]byte, FrameBytes)); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if len(receiver.Requests("TEARDOWN")) != 1 {
+		t.Errorf("Expected no more TEARDOWNs, got %d", len(receiver.Requests("TEARDOWN")))
+	}
+}
@@ -0,0 +1,275 @@
+//
+// HTTP authentication, as receivers with a password ask for it. Most want
+// Digest, some only Basic. A 401 carries one or more challenges in
+// WWW-Authenticate headers:
+//
+//	WWW-Authenticate: Digest realm="My Speaker", nonce="8c4a...", qop="auth", opaque="5ccc..."
+//
+// and every request after that has an Authorization header answering it.
+//
+// http://www.ietf.org/rfc/rfc2617.txt - Digest and Basic authentication
+//
+
+package airplay
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// Who we authenticate as when Airplay.Username isn't set. Receivers don't generally check it, and iTunes says "iTunes"
+var DefaultUsername = "iTunes"
+
+// What a receiver asked for in WWW-Authenticate
+type authChallenge struct {
+	Scheme string            // "Digest" or "Basic"
+	Params map[string]string // Parameter names are lower case
+}
+
+// How we're answering a receiver's challenge, shared by every connection to it
+type authState struct {
+	scheme    string
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string // MD5 or MD5-sess. Empty means MD5, but isn't sent back
+	qop       string // "auth" if the receiver offered it
+	stale     bool   // Whether the challenge said the last nonce had expired
+	nc        uint32 // How many times we've used nonce
+}
+
+// Parse every challenge in the WWW-Authenticate headers. A header can hold more than one, separated by commas
+func parseChallenges(values []string) (challenges []authChallenge) {
+	for _, value := range values {
+		var current *authChallenge
+
+		for value != "" {
+			var token string
+			token, value = authToken(value)
+			if token == "" {
+				// Skip anything we don't understand
+				if value != "" {
+					value = value[1:]
+				}
+				continue
+			}
+
+			value = strings.TrimLeft(value, " \t")
+			if strings.HasPrefix(value, "=") {
+				// A parameter of the current challenge
+				var param string
+				param, value = authValue(strings.TrimLeft(value[1:], " \t"))
+				if current != nil {
+					current.Params[strings.ToLower(token)] = param
+				}
+			} else {
+				// A new challenge
+				challenges = append(challenges, authChallenge{Scheme: token, Params: make(map[string]string)})
+				current = &challenges[len(challenges)-1]
+			}
+
+			value = strings.TrimLeft(value, " \t,")
+		}
+	}
+
+	return challenges
+}
+
+// Split a token off the front of s
+func authToken(s string) (token string, rest string) {
+	s = strings.TrimLeft(s, " \t")
+	i := strings.IndexAny(s, " \t=,\"")
+	if i == -1 {
+		return s, ""
+	}
+
+	return s[:i], s[i:]
+}
+
+// Split a parameter value, quoted or not, off the front of s
+func authValue(s string) (value string, rest string) {
+	if strings.HasPrefix(s, "\"") == false {
+		i := strings.IndexAny(s, " \t,")
+		if i == -1 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+			break
+
+		case '"':
+			return b.String(), s[i+1:]
+
+		default:
+			b.WriteByte(s[i])
+			break
+		}
+	}
+
+	// Unterminated, take what we have
+	return b.String(), ""
+}
+
+// Pick the challenge to answer and set up to answer it. We prefer Digest, since it doesn't send the password
+func newAuthState(headers textproto.MIMEHeader) (state *authState, err error) {
+	var basic *authChallenge
+
+	challenges := parseChallenges(headers["Www-Authenticate"])
+	for i := range challenges {
+		challenge := &challenges[i]
+
+		switch strings.ToLower(challenge.Scheme) {
+		case "digest":
+			algorithm := challenge.Params["algorithm"]
+			if algorithm != "" && strings.EqualFold(algorithm, "MD5") == false && strings.EqualFold(algorithm, "MD5-sess") == false {
+				continue
+			}
+
+			qop := ""
+			if offered, ok := challenge.Params["qop"]; ok {
+				for _, q := range strings.Split(offered, ",") {
+					if strings.TrimSpace(q) == "auth" {
+						qop = "auth"
+					}
+				}
+				if qop == "" {
+					// auth-int only, which would mean hashing every body
+					continue
+				}
+			}
+
+			state = &authState{
+				scheme:    "Digest",
+				realm:     challenge.Params["realm"],
+				nonce:     challenge.Params["nonce"],
+				opaque:    challenge.Params["opaque"],
+				algorithm: algorithm,
+				qop:       qop,
+				stale:     strings.EqualFold(challenge.Params["stale"], "true"),
+			}
+			return state, nil
+
+		case "basic":
+			if basic == nil {
+				basic = challenge
+			}
+			break
+		}
+	}
+
+	if basic != nil {
+		return &authState{scheme: "Basic", realm: basic.Params["realm"]}, nil
+	}
+
+	return nil, ErrAuthUnsupported
+}
+
+// Whether a new challenge only says our nonce has expired, so the password was right and we should try again
+func (s *authState) isStale(next *authState) bool {
+	return next.stale && s.scheme == "Digest" && next.scheme == "Digest" && next.nonce != s.nonce
+}
+
+// The Authorization header for a request
+func (s *authState) authorization(username string, password string, method string, uri string) string {
+	if s.scheme == "Basic" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	s.nc++
+	nc := fmt.Sprintf("%08x", s.nc)
+	cnonce := newCnonce()
+
+	ha1 := md5Hex(username + ":" + s.realm + ":" + password)
+	if strings.EqualFold(s.algorithm, "MD5-sess") {
+		ha1 = md5Hex(ha1 + ":" + s.nonce + ":" + cnonce)
+	}
+	ha2 := md5Hex(method + ":" + uri)
+
+	var response string
+	if s.qop != "" {
+		response = md5Hex(ha1 + ":" + s.nonce + ":" + nc + ":" + cnonce + ":" + s.qop + ":" + ha2)
+	} else {
+		response = md5Hex(ha1 + ":" + s.nonce + ":" + ha2)
+	}
+
+	header := fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", quoteAuth(username), quoteAuth(s.realm), quoteAuth(s.nonce), quoteAuth(uri), response)
+	if s.algorithm != "" {
+		header += ", algorithm=" + s.algorithm
+	}
+	if s.opaque != "" {
+		header += fmt.Sprintf(", opaque=\"%s\"", quoteAuth(s.opaque))
+	}
+	if s.qop != "" {
+		header += fmt.Sprintf(", qop=%s, nc=%s, cnonce=\"%s\"", s.qop, nc, cnonce)
+	}
+
+	return header
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newCnonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Escape a value for a quoted string
+func quoteAuth(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s)
+}
+
+// The username we authenticate with: Airplay.Username, or DefaultUsername if that's not set
+func (a *Airplay) username() string {
+	if a.Username != "" {
+		return a.Username
+	}
+
+	return DefaultUsername
+}
+
+// The Authorization header for a request, or "" if the receiver hasn't asked for one
+func (a *Airplay) authorization(method string, uri string) string {
+	if a.auth == nil {
+		return ""
+	}
+
+	return a.auth.authorization(a.username(), a.Password, method, uri)
+}
+
+// Deal with a 401. Returns nil if the request should be made again with new credentials
+func (a *Airplay) handleUnauthorized(headers textproto.MIMEHeader) (err error) {
+	if a.Password == "" {
+		return ErrPasswordRequired
+	}
+
+	state, err := newAuthState(headers)
+	if err != nil {
+		return err
+	}
+
+	if a.auth == nil || a.auth.isStale(state) {
+		a.auth = state
+		return nil
+	}
+
+	// We've already tried auth and failed
+	return ErrPasswordInvalid
+}
@@ -0,0 +1,329 @@
+package airplay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A stand-in receiver handler that wants a password. It checks Digest responses the way a receiver would,
+// and hands out a fresh nonce with stale=true once staleAfter requests have been let through
+type testAuth struct {
+	t          *testing.T
+	password   string
+	challenge  string // Everything after the nonce
+	basic      bool
+	staleAfter int
+
+	lock   sync.Mutex
+	nonce  string
+	passed int
+}
+
+func (h *testAuth) handle(req *testRequest) *testResponse {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.nonce == "" {
+		h.nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	}
+
+	unauthorized := func(stale bool) *testResponse {
+		challenge := "Digest realm=\"My Speaker\", nonce=\"" + h.nonce + "\"" + h.challenge
+		if stale {
+			challenge += ", stale=TRUE"
+		}
+		if h.basic {
+			challenge = "Basic realm=\"My Speaker\""
+		}
+
+		return &testResponse{
+			StatusCode: 401,
+			Status:     "401 Unauthorized",
+			Header:     map[string]string{"WWW-Authenticate": challenge},
+		}
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		return unauthorized(false)
+	}
+
+	if h.basic {
+		if authorization != "Basic "+base64.StdEncoding.EncodeToString([]byte("iTunes:"+h.password)) {
+			return unauthorized(false)
+		}
+		return nil
+	}
+
+	challenges := parseChallenges([]string{authorization})
+	if len(challenges) != 1 || challenges[0].Scheme != "Digest" {
+		h.t.Errorf("Unexpected Authorization: %s", authorization)
+		return unauthorized(false)
+	}
+	params := challenges[0].Params
+
+	if params["uri"] != req.URI || params["realm"] != "My Speaker" {
+		h.t.Errorf("Unexpected Authorization: %s", authorization)
+	}
+
+	ha1 := md5Hex(params["username"] + ":My Speaker:" + h.password)
+	if params["algorithm"] == "MD5-sess" {
+		ha1 = md5Hex(ha1 + ":" + params["nonce"] + ":" + params["cnonce"])
+	}
+	ha2 := md5Hex(req.Method + ":" + req.URI)
+
+	expected := md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	if params["qop"] != "" {
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":" + params["qop"] + ":" + ha2)
+	}
+
+	if params["response"] != expected {
+		return unauthorized(false)
+	}
+	if params["nonce"] != h.nonce {
+		return unauthorized(true)
+	}
+
+	h.passed++
+	if h.passed == h.staleAfter {
+		h.nonce = "0a4f113b"
+	}
+
+	return nil
+}
+
+////////
+
+func TestParseChallenges(t *testing.T) {
+	challenges := parseChallenges([]string{
+		`Digest realm="My \"Big\" Speaker", nonce="abc, def", qop="auth,auth-int", algorithm=MD5-sess, Basic realm=raop`,
+		`Newauth`,
+	})
+
+	if len(challenges) != 3 {
+		t.Fatalf("Expected 3 challenges, got %d", len(challenges))
+	}
+
+	digest := challenges[0]
+	if digest.Scheme != "Digest" {
+		t.Errorf("Expected Digest, got %s", digest.Scheme)
+	}
+	if digest.Params["realm"] != `My "Big" Speaker` || digest.Params["nonce"] != "abc, def" || digest.Params["qop"] != "auth,auth-int" || digest.Params["algorithm"] != "MD5-sess" {
+		t.Errorf("Unexpected parameters: %v", digest.Params)
+	}
+
+	if challenges[1].Scheme != "Basic" || challenges[1].Params["realm"] != "raop" {
+		t.Errorf("Unexpected Basic challenge: %v", challenges[1])
+	}
+	if challenges[2].Scheme != "Newauth" || len(challenges[2].Params) != 0 {
+		t.Errorf("Unexpected challenge: %v", challenges[2])
+	}
+}
+
+func TestNewAuthState(t *testing.T) {
+	header := func(values ...string) map[string][]string {
+		return map[string][]string{"Www-Authenticate": values}
+	}
+
+	// Digest wins over Basic, whichever comes first
+	state, err := newAuthState(header(`Basic realm="x"`, `Digest realm="y", nonce="n", qop="auth-int,auth"`))
+	if err != nil || state.scheme != "Digest" || state.realm != "y" || state.qop != "auth" {
+		t.Errorf("Unexpected state: %v %v", state, err)
+	}
+
+	// We can't do auth-int or SHA-256, but Basic will do
+	state, err = newAuthState(header(`Digest realm="y", nonce="n", qop="auth-int"`, `Digest realm="y", nonce="n", algorithm=SHA-256`, `Basic realm="x"`))
+	if err != nil || state.scheme != "Basic" {
+		t.Errorf("Unexpected state: %v %v", state, err)
+	}
+
+	_, err = newAuthState(header(`Negotiate`))
+	if err != ErrAuthUnsupported {
+		t.Errorf("Expected ErrAuthUnsupported, got %v", err)
+	}
+	_, err = newAuthState(header())
+	if err != ErrAuthUnsupported {
+		t.Errorf("Expected ErrAuthUnsupported, got %v", err)
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	challenges := []string{
+		"",
+		", opaque=\"5ccc069c403ebaf9f0171e9517f40e41\"",
+		", qop=\"auth\", opaque=\"5ccc069c403ebaf9f0171e9517f40e41\"",
+		", qop=\"auth\", algorithm=MD5-sess",
+	}
+
+	for _, challenge := range challenges {
+		h := &testAuth{t: t, password: "secret", challenge: challenge}
+		receiver := startTestReceiver(t, h.handle)
+
+		a, err := Dial(receiver.IP(), receiver.Port(), "secret")
+		if err != nil {
+			t.Fatalf("Dial with %q: %v", challenge, err)
+		}
+
+		err = a.Announce()
+		if err != nil {
+			t.Errorf("Announce with %q: %v", challenge, err)
+		}
+
+		announces := receiver.Requests("ANNOUNCE")
+		if len(announces) != 1 || len(announces[0].Body) == 0 {
+			t.Errorf("Expected one ANNOUNCE with an SDP body, got %d", len(announces))
+		}
+
+		////////
+		authorization := announces[0].Header.Get("Authorization")
+		params := parseChallenges([]string{authorization})[0].Params
+		if params["username"] != "iTunes" {
+			t.Errorf("Expected iTunes, got %s", params["username"])
+		}
+		if strings.Contains(challenge, "opaque") && params["opaque"] != "5ccc069c403ebaf9f0171e9517f40e41" {
+			t.Errorf("Expected the opaque value back, got %s", authorization)
+		}
+		if strings.Contains(challenge, "qop") {
+			// The OPTIONS that got through was the first use of the nonce
+			if params["qop"] != "auth" || params["nc"] != "00000002" || len(params["cnonce"]) == 0 {
+				t.Errorf("Unexpected qop parameters: %s", authorization)
+			}
+		} else if params["qop"] != "" || params["cnonce"] != "" {
+			t.Errorf("Unexpected qop parameters: %s", authorization)
+		}
+
+		a.Close()
+		receiver.Close()
+	}
+}
+
+func TestAuthUsername(t *testing.T) {
+	h := &testAuth{t: t, password: "secret"}
+	receiver := startTestReceiver(t, h.handle)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	a.Username = "Living Room Mac"
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorization := receiver.Requests("ANNOUNCE")[0].Header.Get("Authorization")
+	params := parseChallenges([]string{authorization})[0].Params
+	if params["username"] != "Living Room Mac" {
+		t.Errorf("Expected Living Room Mac, got %s", params["username"])
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := &testAuth{t: t, password: "secret", basic: true}
+	receiver := startTestReceiver(t, h.handle)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if len(receiver.Requests("OPTIONS")) != 2 {
+		t.Errorf("Expected 2 OPTIONS, got %d", len(receiver.Requests("OPTIONS")))
+	}
+}
+
+func TestStaleNonce(t *testing.T) {
+	h := &testAuth{t: t, password: "secret", challenge: ", qop=\"auth\"", staleAfter: 1}
+	receiver := startTestReceiver(t, h.handle)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// The nonce goes stale after OPTIONS, so this is challenged again and should go through with the new one
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announces := receiver.Requests("ANNOUNCE")
+	if len(announces) != 2 {
+		t.Fatalf("Expected 2 ANNOUNCEs, got %d", len(announces))
+	}
+
+	if len(announces[1].Body) == 0 || string(announces[1].Body) != string(announces[0].Body) {
+		t.Errorf("Expected the SDP to be sent again, got %q", announces[1].Body)
+	}
+
+	params := parseChallenges([]string{announces[1].Header.Get("Authorization")})[0].Params
+	if params["nonce"] != "0a4f113b" || params["nc"] != "00000001" {
+		t.Errorf("Expected the new nonce, counted from 1, got %v", params)
+	}
+}
+
+func TestStaleForever(t *testing.T) {
+	// Every Authorization is met with a new nonce and stale=true
+	var lock sync.Mutex
+	nonces := 0
+	receiver := startTestReceiver(t, func(req *testRequest) *testResponse {
+		lock.Lock()
+		defer lock.Unlock()
+
+		nonces++
+		challenge := fmt.Sprintf("Digest realm=\"My Speaker\", nonce=\"%08x\"", nonces)
+		if req.Header.Get("Authorization") != "" {
+			challenge += ", stale=true"
+		}
+
+		return &testResponse{StatusCode: 401, Status: "401 Unauthorized", Header: map[string]string{"WWW-Authenticate": challenge}}
+	})
+	defer receiver.Close()
+
+	_, err := Dial(receiver.IP(), receiver.Port(), "secret")
+	if err != ErrPasswordInvalid {
+		t.Errorf("Expected ErrPasswordInvalid, got %v", err)
+	}
+
+	// Once without a password, once with it, and once more with the new nonce
+	if len(receiver.Requests("OPTIONS")) != 3 {
+		t.Errorf("Expected 3 OPTIONS, got %d", len(receiver.Requests("OPTIONS")))
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	h := &testAuth{t: t, password: "secret"}
+	receiver := startTestReceiver(t, h.handle)
+	defer receiver.Close()
+
+	_, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != ErrPasswordRequired {
+		t.Errorf("Expected ErrPasswordRequired, got %v", err)
+	}
+
+	_, err = Dial(receiver.IP(), receiver.Port(), "wrong")
+	if err != ErrPasswordInvalid {
+		t.Errorf("Expected ErrPasswordInvalid, got %v", err)
+	}
+
+	////////
+	receiver = startTestReceiver(t, func(req *testRequest) *testResponse {
+		return &testResponse{StatusCode: 401, Status: "401 Unauthorized", Header: map[string]string{"WWW-Authenticate": "Negotiate"}}
+	})
+	defer receiver.Close()
+
+	_, err = Dial(receiver.IP(), receiver.Port(), "secret")
+	if err != ErrAuthUnsupported {
+		t.Errorf("Expected ErrAuthUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+//
+// Persists the list of discovered devices to disk, so that a freshly started
+// process can talk to the devices it already knows about without waiting on
+// multicast DNS first.
+//
+// Devices loaded from the cache are marked stale until discovery hears from
+// them again, and are dropped if that doesn't happen within DeviceCacheTimeout.
+//
+
+package airplay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Write the current device list to the file at path as JSON
+func SaveDeviceCache(path string) (err error) {
+	devices := snapshotDevices()
+
+	buffer, err := json.MarshalIndent(devices, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so we never leave a half-written cache behind
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, buffer, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Warm-start the device list from a file written by SaveDeviceCache. Call this before
+// Discover. Every loaded device is marked stale until it is seen on the network again,
+// and devices we already know about are left alone.
+func LoadDeviceCache(path string) (err error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var cached []AirplayDevice
+	err = json.Unmarshal(buffer, &cached)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	deviceListLock.Lock()
+	defer deviceListLock.Unlock()
+
+	for _, device := range cached {
+		known := false
+		for i := range deviceList {
+			if deviceList[i].Name == device.Name {
+				known = true
+				break
+			}
+		}
+
+		if known {
+			continue
+		}
+
+		device.Stale = true
+		device.staleSince = now
+		deviceList = append(deviceList, device)
+	}
+
+	return nil
+}
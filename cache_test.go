@@ -0,0 +1,115 @@
+package airplay
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeviceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "airplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+
+	lastSeen := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	deviceList = []AirplayDevice{
+		{
+			Name:     "Living Room",
+			Hostname: "Living-Room.local.",
+			IP:       net.IPv4(192, 168, 1, 120),
+			Port:     5000,
+			Type:     "airplay",
+			Flags:    map[string]string{"cn": "0,1", "et": "0,1"},
+			LastSeen: lastSeen,
+		},
+	}
+	defer func() { deviceList = nil }()
+
+	////////
+	err = SaveDeviceCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceList = nil
+	err = LoadDeviceCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	if len(deviceList) != 1 {
+		t.Fatalf("Expected 1 cached device, got %d", len(deviceList))
+	}
+
+	device := deviceList[0]
+	if device.Name != "Living Room" {
+		t.Errorf("Unexpected device name: %s", device.Name)
+	}
+	if device.Hostname != "Living-Room.local." {
+		t.Errorf("Unexpected device hostname: %s", device.Hostname)
+	}
+	if device.IP.Equal(net.IPv4(192, 168, 1, 120)) == false {
+		t.Errorf("Unexpected device IP: %s", device.IP)
+	}
+	if device.Port != 5000 {
+		t.Errorf("Unexpected device port: %d", device.Port)
+	}
+	if device.Flags["cn"] != "0,1" {
+		t.Errorf("Unexpected device flags: %v", device.Flags)
+	}
+	if device.LastSeen.Equal(lastSeen) == false {
+		t.Errorf("Unexpected last seen time: %s", device.LastSeen)
+	}
+	if device.Stale != true {
+		t.Error("Cached device was not marked stale")
+	}
+
+	////////
+	// Loading again shouldn't duplicate anything
+	err = LoadDeviceCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deviceList) != 1 {
+		t.Errorf("Expected 1 cached device after reloading, got %d", len(deviceList))
+	}
+}
+
+func TestDeviceCachePurge(t *testing.T) {
+	now := time.Now()
+	deviceList = []AirplayDevice{
+		{Name: "Confirmed"},
+		{Name: "Stale", Stale: true, staleSince: now},
+	}
+	defer func() { deviceList = nil }()
+
+	////////
+	if purgeStaleDevices(now) {
+		t.Error("Purged a device before the timeout")
+	}
+
+	// Hearing from a device confirms it
+	deviceList[1].markSeen()
+	deviceList = append(deviceList, AirplayDevice{Name: "Gone", Stale: true, staleSince: now})
+
+	if purgeStaleDevices(now.Add(DeviceCacheTimeout+time.Second)) == false {
+		t.Error("Did not purge an unconfirmed device after the timeout")
+	}
+
+	if len(deviceList) != 2 {
+		t.Fatalf("Expected 2 devices after purging, got %d", len(deviceList))
+	}
+	if deviceList[0].Name != "Confirmed" || deviceList[1].Name != "Stale" {
+		t.Errorf("Unexpected devices after purging: %s, %s", deviceList[0].Name, deviceList[1].Name)
+	}
+	if deviceList[1].Stale {
+		t.Error("Re-confirmed device is still stale")
+	}
+}
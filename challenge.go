@@ -0,0 +1,107 @@
+//
+// Apple-Challenge verification. A genuine RAOP receiver answers an
+// Apple-Challenge header (16 random bytes, base64) with an Apple-Response:
+// an RSA signature (PKCS#1 v1.5, no digest) made with the private half of
+// RAOPPublicKey over the challenge, the receiver's IP address and its MAC
+// address, zero padded to 32 bytes.
+//
+// https://github.com/abrasive/shairport/blob/master/rtsp.c - apple_challenge()
+//
+
+package airplay
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	challengeLength = 16
+)
+
+var (
+	ErrChallengeFailed = errors.New("Airplay server did not answer the Apple-Challenge correctly")
+)
+
+// Check that we're talking to a real RAOP receiver by sending it an Apple-Challenge. mac is the receiver's
+// MAC address, which it signs along with the challenge (see AirplayDevice.MACAddress). Sets Verified if the
+// response checks out, and returns ErrChallengeFailed if it doesn't
+func (a *Airplay) Verify(mac net.HardwareAddr) (err error) {
+	return a.VerifyContext(context.Background(), mac)
+}
+
+// Like Verify, but gives up if ctx is done first
+func (a *Airplay) VerifyContext(ctx context.Context, mac net.HardwareAddr) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	a.Verified = false
+
+	challenge := make([]byte, challengeLength)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return err
+	}
+
+	header := make(map[string][]string)
+	header["Apple-Challenge"] = []string{base64.RawStdEncoding.EncodeToString(challenge)}
+
+	resp, err := a.makeRTSPRequest(ctx, "OPTIONS", "*", header, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return ErrNoOptions
+	}
+
+	// Receivers leave the padding off, but don't count on it
+	signature, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(resp.Header.Get("Apple-Response"), "="))
+	if err != nil || len(signature) == 0 {
+		return ErrChallengeFailed
+	}
+
+	err = rsa.VerifyPKCS1v15(RAOPPublicKey, crypto.Hash(0), challengeMessage(challenge, a.remoteIP(), mac), signature)
+	if err != nil {
+		return ErrChallengeFailed
+	}
+
+	a.Verified = true
+	return nil
+}
+
+// What the receiver should have signed
+func challengeMessage(challenge []byte, ip net.IP, mac net.HardwareAddr) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	message := make([]byte, 0, 32)
+	message = append(message, challenge...)
+	message = append(message, ip...)
+	message = append(message, mac...)
+
+	for len(message) < 32 {
+		message = append(message, 0)
+	}
+
+	return message
+}
+
+// The address we're connected to. This is the local address on the receiver's end of the connection,
+// which is the one it signs
+func (a *Airplay) remoteIP() net.IP {
+	if a.netConn != nil {
+		if addr, ok := a.netConn.RemoteAddr().(*net.TCPAddr); ok {
+			return addr.IP
+		}
+	}
+
+	return a.ip
+}
@@ -0,0 +1,119 @@
+package airplay
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"net"
+	"testing"
+)
+
+func TestChallengeMessage(t *testing.T) {
+	challenge := bytes.Repeat([]byte{0xAA}, challengeLength)
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+	message := challengeMessage(challenge, net.IPv4(192, 168, 1, 10), mac)
+	if len(message) != 32 {
+		t.Fatalf("Expected a padded 32 byte message, got %d bytes", len(message))
+	}
+	if bytes.Equal(message[16:20], []byte{192, 168, 1, 10}) == false {
+		t.Errorf("Expected a 4 byte IPv4 address, got %x", message[16:20])
+	}
+	if bytes.Equal(message[20:26], mac) == false || message[31] != 0 {
+		t.Errorf("Unexpected message tail: %x", message[20:])
+	}
+
+	message = challengeMessage(challenge, net.ParseIP("fe80::1"), mac)
+	if len(message) != 38 {
+		t.Errorf("Expected an unpadded 38 byte message for IPv6, got %d bytes", len(message))
+	}
+}
+
+// Answer Apple-Challenges like a real receiver would, signing with key
+func challengeHandler(t *testing.T, key *rsa.PrivateKey, mac net.HardwareAddr) func(req *testRequest) *testResponse {
+	return func(req *testRequest) *testResponse {
+		if req.Method != "OPTIONS" || req.Header.Get("Apple-Challenge") == "" {
+			return nil
+		}
+
+		challenge, err := base64.RawStdEncoding.DecodeString(req.Header.Get("Apple-Challenge"))
+		if err != nil || len(challenge) != challengeLength {
+			t.Errorf("Unexpected Apple-Challenge: %s", req.Header.Get("Apple-Challenge"))
+		}
+
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.Hash(0), challengeMessage(challenge, net.IPv4(127, 0, 0, 1), mac))
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+
+		return &testResponse{
+			StatusCode: 200,
+			Header: map[string]string{
+				"Public":         "ANNOUNCE, SETUP, RECORD, PAUSE, FLUSH, TEARDOWN, OPTIONS, GET_PARAMETER, SET_PARAMETER",
+				"Apple-Response": base64.RawStdEncoding.EncodeToString(signature),
+			},
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(key *rsa.PublicKey) { RAOPPublicKey = key }(RAOPPublicKey)
+	RAOPPublicKey = &private.PublicKey
+
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	receiver := startTestReceiver(t, challengeHandler(t, private, mac))
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if a.Verified {
+		t.Error("Verified before we sent a challenge")
+	}
+
+	////////
+	err = a.Verify(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Verified == false {
+		t.Error("Expected Verified after a good response")
+	}
+
+	////////
+	// Wrong MAC, so the signature doesn't match
+	err = a.Verify(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66})
+	if err != ErrChallengeFailed {
+		t.Errorf("Expected ErrChallengeFailed, got %v", err)
+	}
+	if a.Verified {
+		t.Error("Still Verified after a bad response")
+	}
+}
+
+func TestVerifyNoResponse(t *testing.T) {
+	// The default handler doesn't know about challenges at all, like a random RTSP server
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.Verify(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != ErrChallengeFailed {
+		t.Errorf("Expected ErrChallengeFailed, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+//
+// The RAOP control channel. We send the receiver a sync packet every second
+// that ties RTP timestamps to NTP time, so it knows when to play what, and
+// the receiver asks us here for audio packets it missed.
+//
+// Sync (0x54), 20 bytes: 0x80 (0x90 for the first after a flush), 0xd4,
+// 0x0007, the RTP timestamp playing now, the NTP time now, and the RTP
+// timestamp of the next packet.
+//
+// Resend request (0x55), 8 bytes: 0x80, 0xd5, a sequence number, then the
+// first missing sequence number and how many packets are missing.
+//
+// Retransmission (0x56): 0x80, 0xd6, 0x0001, then the original RTP packet.
+//
+
+package airplay
+
+import (
+	"time"
+)
+
+const (
+	controlSync       = 0x54
+	controlResend     = 0x55
+	controlRetransmit = 0x56
+
+	// How far behind the next packet the receiver should be playing, in samples. Matches the min-latency we ANNOUNCE
+	syncLatency = 11025
+
+	// How many sent packets we keep around for retransmission, about 4 seconds worth
+	resendBufferSize = 512
+)
+
+var (
+	// How often to send sync packets
+	syncInterval = time.Second
+)
+
+// Answer resend requests on our control port until the sender is closed or the session is torn down
+func (s *AudioSender) serveControl() {
+	defer close(s.controlDone)
+
+	buffer := make([]byte, 128)
+	for {
+		read, addr, err := s.control.ReadFromUDP(buffer)
+		if err != nil {
+			// Closed, or we're being shut down
+			return
+		}
+
+		if read < 8 || buffer[1]&0x7F != controlResend {
+			continue
+		}
+
+		first := uint16(buffer[4])<<8 | uint16(buffer[5])
+		count := uint16(buffer[6])<<8 | uint16(buffer[7])
+		for i := uint16(0); i < count; i++ {
+			packet := s.recentPacket(first + i)
+			if packet == nil {
+				continue
+			}
+
+			retransmit := make([]byte, 4+len(packet))
+			retransmit[0] = 0x80
+			retransmit[1] = 0x80 | controlRetransmit
+			retransmit[2] = 0x00
+			retransmit[3] = 0x01
+			copy(retransmit[4:], packet)
+
+			s.control.WriteToUDP(retransmit, addr)
+		}
+	}
+}
+
+// Send a sync packet every interval while audio is flowing
+func (s *AudioSender) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if s.start.IsZero() == false {
+				s.sendSync(false)
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// Send a sync packet for the current position. The extension bit marks the first one after starting or flushing.
+// Call with the lock held
+func (s *AudioSender) sendSync(extension bool) {
+	if s.control == nil {
+		return
+	}
+
+	packet := make([]byte, 20)
+	packet[0] = 0x80
+	if extension {
+		packet[0] |= 0x10
+	}
+	packet[1] = 0x80 | controlSync
+	packet[2] = 0x00
+	packet[3] = 0x07
+
+	playing := s.timestamp - syncLatency
+	packet[4] = byte(playing >> 24)
+	packet[5] = byte(playing >> 16)
+	packet[6] = byte(playing >> 8)
+	packet[7] = byte(playing)
+
+	putNTPTime(packet[8:16], time.Now())
+
+	packet[16] = byte(s.timestamp >> 24)
+	packet[17] = byte(s.timestamp >> 16)
+	packet[18] = byte(s.timestamp >> 8)
+	packet[19] = byte(s.timestamp)
+
+	s.control.WriteToUDP(packet, s.controlAddr)
+}
+
+// Keep a packet we just sent, in case the receiver asks for it again. Call with the lock held
+func (s *AudioSender) rememberPacket(seq uint16, packet []byte) {
+	s.recent[seq%resendBufferSize] = packet
+}
+
+// A packet we sent recently, or nil if it's too old
+func (s *AudioSender) recentPacket(seq uint16) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	packet := s.recent[seq%resendBufferSize]
+	if packet == nil || uint16(packet[2])<<8|uint16(packet[3]) != seq {
+		return nil
+	}
+
+	return packet
+}
@@ -0,0 +1,146 @@
+package airplay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// Like testAudioSession, but with a control channel. Returns the receiver's end of it too
+func testControlSession(t *testing.T) (a *Airplay, server *net.UDPConn, control *net.UDPConn) {
+	a, server = testAudioSession(t)
+
+	control, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.controlPort = control.LocalAddr().(*net.UDPAddr).Port
+
+	a.controlConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, server, control
+}
+
+func TestControlSync(t *testing.T) {
+	defer func(interval time.Duration) { syncInterval = interval }(syncInterval)
+	syncInterval = 20 * time.Millisecond
+
+	a, server, control := testControlSession(t)
+	defer server.Close()
+	defer control.Close()
+	defer a.controlConn.Close()
+
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	timestamp := s.Timestamp()
+
+	err = s.WriteFrame(make([]byte, FrameBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	sync := readTestPacket(t, control)
+	if len(sync) != 20 {
+		t.Fatalf("Unexpected sync length: %d", len(sync))
+	}
+	if sync[0] != 0x90 || sync[1] != 0xd4 || sync[3] != 0x07 {
+		t.Errorf("Expected a sync with the extension bit first, got %x", sync[:4])
+	}
+
+	playing := uint32(sync[4])<<24 | uint32(sync[5])<<16 | uint32(sync[6])<<8 | uint32(sync[7])
+	next := uint32(sync[16])<<24 | uint32(sync[17])<<16 | uint32(sync[18])<<8 | uint32(sync[19])
+	if next != timestamp {
+		t.Errorf("Expected next timestamp %d, got %d", timestamp, next)
+	}
+	if next-playing != syncLatency {
+		t.Errorf("Expected a latency of %d, got %d", syncLatency, next-playing)
+	}
+
+	////////
+	sync = readTestPacket(t, control)
+	if sync[0] != 0x80 || sync[1] != 0xd4 {
+		t.Errorf("Expected a periodic sync, got %x", sync[:4])
+	}
+}
+
+func TestControlResend(t *testing.T) {
+	a, server, control := testControlSession(t)
+	defer server.Close()
+	defer control.Close()
+	defer a.controlConn.Close()
+
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq := s.Seq()
+	for i := 0; i < 3; i++ {
+		err = s.WriteFrame(bytes.Repeat([]byte{byte(i)}, FrameBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sent [][]byte
+	for i := 0; i < 3; i++ {
+		sent = append(sent, readTestPacket(t, server))
+	}
+
+	////////
+	// Ask for the last two again, and one we never sent
+	request := []byte{0x80, 0x80 | controlResend, 0x00, 0x01, 0, 0, 0x00, 0x03}
+	request[4] = byte((seq + 1) >> 8)
+	request[5] = byte(seq + 1)
+	_, err = control.WriteToUDP(request, a.controlConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < 3; i++ {
+		for {
+			packet := readTestPacket(t, control)
+			if packet[1]&0x7F == controlSync {
+				continue
+			}
+
+			if packet[0] != 0x80 || packet[1] != 0xd6 {
+				t.Errorf("Unexpected retransmission header: %x", packet[:4])
+			}
+			if bytes.Equal(packet[4:], sent[i]) == false {
+				t.Errorf("Retransmission %d was not the packet we sent", i)
+			}
+			break
+		}
+	}
+
+	////////
+	s.Close()
+
+	_, err = control.WriteToUDP(request, a.controlConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	control.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buffer := make([]byte, 2048)
+	for {
+		read, _, err := control.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+		if buffer[1]&0x7F == controlRetransmit {
+			t.Errorf("Still answering resend requests after Close: %x", buffer[:read])
+			break
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package airplay
 
 import (
+	"encoding/binary"
 	"fmt"
 )
 
@@ -61,3 +62,71 @@ func DAAPPrint(tags map[string]interface{}, indent string) (out string) {
 
 	return
 }
+
+// A tag to encode with DAAPEncode. Value can be a string, []byte, a sized integer type, or []DAAPTag for a group
+type DAAPTag struct {
+	Tag   string
+	Value interface{}
+}
+
+// Encode tags, in order, as DAAP. Fails if a value isn't one of the types DAAPTag takes
+func DAAPEncode(tags []DAAPTag) (buffer []byte, err error) {
+	for _, tag := range tags {
+		var data []byte
+		switch v := tag.Value.(type) {
+		case []DAAPTag:
+			data, err = DAAPEncode(v)
+			if err != nil {
+				return nil, err
+			}
+			break
+		case string:
+			data = []byte(v)
+			break
+		case []byte:
+			data = v
+			break
+		case uint8:
+			data = []byte{v}
+			break
+		case int8:
+			data = []byte{byte(v)}
+			break
+		case uint16:
+			data = make([]byte, 2)
+			binary.BigEndian.PutUint16(data, v)
+			break
+		case int16:
+			data = make([]byte, 2)
+			binary.BigEndian.PutUint16(data, uint16(v))
+			break
+		case uint32:
+			data = make([]byte, 4)
+			binary.BigEndian.PutUint32(data, v)
+			break
+		case int32:
+			data = make([]byte, 4)
+			binary.BigEndian.PutUint32(data, uint32(v))
+			break
+		case uint64:
+			data = make([]byte, 8)
+			binary.BigEndian.PutUint64(data, v)
+			break
+		case int64:
+			data = make([]byte, 8)
+			binary.BigEndian.PutUint64(data, uint64(v))
+			break
+		default:
+			return nil, fmt.Errorf("Can't encode DAAP tag %s of type %T", tag.Tag, tag.Value)
+		}
+
+		header := make([]byte, 8)
+		copy(header, tag.Tag)
+		binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+
+		buffer = append(buffer, header...)
+		buffer = append(buffer, data...)
+	}
+
+	return buffer, nil
+}
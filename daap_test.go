@@ -30,3 +30,37 @@ func TestDAAPParse(t *testing.T) {
 
 	fmt.Println(DAAPPrint(tags, ""))
 }
+
+func TestDAAPEncode(t *testing.T) {
+	encoded, err := DAAPEncode([]DAAPTag{
+		{"cmpa", []DAAPTag{
+			{"cmpg", uint64(0x3ae031c80b6318c9)},
+			{"cmnm", "Mobile Computing Device"},
+			{"cmty", "iPhone"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "636d70610000003d636d7067000000083ae031c80b6318c9636d6e6d000000174d6f62696c6520436f6d707574696e6720446576696365636d7479000000066950686f6e65"
+	if hex.EncodeToString(encoded) != expected {
+		t.Errorf("Unexpected encoding: %x", encoded)
+	}
+
+	encoded, err = DAAPEncode([]DAAPTag{{"abcd", uint8(1)}, {"efgh", int16(-2)}, {"ijkl", uint32(3)}, {"mnop", []byte{4}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(encoded) != "616263640000000101"+"6566676800000002fffe"+"696a6b6c0000000400000003"+"6d6e6f700000000104" {
+		t.Errorf("Unexpected encoding of integers: %x", encoded)
+	}
+
+	// A plain int has no size on the wire, and neither does anything else we don't know about, even in a group
+	for _, value := range []interface{}{1, 1.5, true, nil, []DAAPTag{{"cmnm", "Name"}, {"cmpg", 2}}} {
+		_, err = DAAPEncode([]DAAPTag{{"abcd", value}})
+		if err == nil {
+			t.Errorf("Expected an error encoding %#v", value)
+		}
+	}
+}
@@ -14,13 +14,21 @@ package airplay
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	deviceList []AirplayDevice
+	deviceList     []AirplayDevice
+	deviceListLock sync.Mutex
+
+	// How long a device loaded from the cache can go without being re-confirmed
+	// on the network before it is dropped from the device list
+	DeviceCacheTimeout = 30 * time.Second
 )
 
 type AirplayDevice struct {
@@ -30,6 +38,12 @@ type AirplayDevice struct {
 	Port     uint16
 	Type     string
 	Flags    map[string]string
+	LastSeen time.Time        // The last time we heard from this device on the network
+	Stale    bool             // True if this device came from the cache and hasn't been re-confirmed yet
+	Asleep   bool             // True if the device's records are being answered by a Bonjour Sleep Proxy
+	WakeMAC  net.HardwareAddr // The MAC address to wake, from the sleep proxy
+
+	staleSince time.Time // When this device was marked stale, so we know when to purge it
 }
 
 //
@@ -54,20 +68,9 @@ func Discover(devices chan []AirplayDevice) {
 
 	// Bootstrap us by sending a query for any airplay-related entries
 	var msg DNSMessage
-
-	q := Question{
-		Name:  "_raop._tcp.local.",
-		Type:  12, // PTR
-		Class: 1,
+	for _, q := range airplayQuestions("local.") {
+		msg.AddQuestion(q)
 	}
-	msg.AddQuestion(q)
-
-	q = Question{
-		Name:  "_airplay._tcp.local.",
-		Type:  12, // PTR
-		Class: 1,
-	}
-	msg.AddQuestion(q)
 
 	buffer, err := msg.Pack()
 	if err != nil {
@@ -83,12 +86,30 @@ func Discover(devices chan []AirplayDevice) {
 		panic(err)
 	}
 
+	// If we were warm-started from the cache, let the caller know about those devices right away
+	if cached := snapshotDevices(); len(cached) > 0 {
+		devices <- cached
+	}
+
+	// Check for stale devices once a second
+	purgeTicker := time.NewTicker(time.Second)
+	defer purgeTicker.Stop()
+
 	// Wait for a message from the listen goroutine
 	for {
-		msg = <-msgs
+		select {
+		case msg = <-msgs:
+		case now := <-purgeTicker.C:
+			if purgeStaleDevices(now) {
+				devices <- snapshotDevices()
+			}
+			continue
+		}
 
 		//fmt.Println(msg.String())
 
+		deviceListLock.Lock()
+
 		// Look for new devices
 		for i := range msg.Answers {
 			rr := &msg.Answers[i]
@@ -99,15 +120,8 @@ func Discover(devices chan []AirplayDevice) {
 			}
 
 			// Figure out the name of this thing
-			nameParts := strings.Split(rr.Rdata.(PTRRecord).Name, ".")
-
-			deviceName := nameParts[0]
-			deviceType := ""
-			if nameParts[1] == "_raop" || nameParts[1] == "_airplay" {
-				deviceType = "airplay"
-			} else if nameParts[1] == "_touch-remote" {
-				deviceType = "remote"
-			} else {
+			deviceName, deviceType := parseInstanceName(rr.Rdata.(PTRRecord).Name)
+			if deviceType == "" {
 				continue
 			}
 
@@ -131,61 +145,249 @@ func Discover(devices chan []AirplayDevice) {
 			} else {
 				deviceList[index].Type = deviceType
 			}
+			deviceList[index].markSeen()
 		}
 
+		owner, proxied := msg.Owner()
 		for i := range deviceList {
-			deviceList[i].updateFromDNS(&msg)
+			if deviceList[i].updateFromDNS(&msg) {
+				deviceList[i].updateSleepState(owner, proxied)
+			}
 		}
 
+		deviceListLock.Unlock()
+
 		// TODO: Ask for info on devices we don't have all the information about
 		// TODO: Do this on a timer so we're not asking for things too often
 
 		// Push it down the channel
-		devices <- deviceList
+		devices <- snapshotDevices()
 	}
 }
 
+// Returns a copy of the device list that is safe to hand to other goroutines
+func snapshotDevices() []AirplayDevice {
+	deviceListLock.Lock()
+	defer deviceListLock.Unlock()
+
+	devices := make([]AirplayDevice, len(deviceList))
+	copy(devices, deviceList)
+
+	return devices
+}
+
+// Drops any stale devices that haven't been re-confirmed within DeviceCacheTimeout.
+// Returns true if the device list changed
+func purgeStaleDevices(now time.Time) (purged bool) {
+	deviceListLock.Lock()
+	defer deviceListLock.Unlock()
+
+	kept := deviceList[:0]
+	for _, device := range deviceList {
+		if device.Stale && now.Sub(device.staleSince) > DeviceCacheTimeout {
+			purged = true
+			continue
+		}
+		kept = append(kept, device)
+	}
+	deviceList = kept
+
+	return purged
+}
+
+// The PTR questions that find airplay devices in a browsing domain, like "local."
+func airplayQuestions(domain string) []Question {
+	return []Question{
+		{
+			Name:  "_raop._tcp." + domain,
+			Type:  12, // PTR
+			Class: 1,
+		},
+		{
+			Name:  "_airplay._tcp." + domain,
+			Type:  12, // PTR
+			Class: 1,
+		},
+	}
+}
+
+// Split a service instance name (from a PTR record) into the name of the device and the
+// type of device it is. The type is empty if this isn't a service we care about
+func parseInstanceName(instance string) (deviceName string, deviceType string) {
+	nameParts := strings.Split(instance, ".")
+	if len(nameParts) < 2 {
+		return "", ""
+	}
+
+	deviceName = nameParts[0]
+	if nameParts[1] == "_raop" || nameParts[1] == "_airplay" {
+		deviceType = "airplay"
+	} else if nameParts[1] == "_touch-remote" {
+		deviceType = "remote"
+	}
+
+	return deviceName, deviceType
+}
+
 // Listen on a socket for multicast records and parse them
 func listen(socket *net.UDPConn, msgs chan DNSMessage) {
-	var msg DNSMessage
+	truncated := newTruncatedMessages()
+
 	// Loop forever waiting for messages
 	for {
+		// If we're holding on to truncated messages, only wait until the first of them is due
+		deadline, waiting := truncated.nextDeadline()
+		if waiting {
+			socket.SetReadDeadline(deadline)
+		} else {
+			socket.SetReadDeadline(time.Time{})
+		}
+
 		// Buffer for the message
-		buffer := make([]byte, 4096)
+		buffer := getMessageBuffer()
 		// Block and wait for a message on the socket
-		read, _, err := socket.ReadFromUDP(buffer)
+		read, addr, err := socket.ReadFromUDP(*buffer)
 		if err != nil {
+			putMessageBuffer(buffer)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				// Nothing else is coming for these, so treat them as complete
+				for _, msg := range truncated.expire(time.Now()) {
+					forwardMessage(msg, msgs)
+				}
+				continue
+			}
 			panic(err)
 		}
 
 		// Parse the buffer (up to "read" bytes) into a message object
-		err = msg.Parse(buffer[:read])
+		var msg DNSMessage
+		err = msg.Parse((*buffer)[:read])
+		putMessageBuffer(buffer)
 		if err != nil {
 			panic(err)
 		}
 
-		// Does this have answers we are interested in? If so, return the whole message since the rest of it (Extras in particular)
-		// is probably relevant
-		for i := range msg.Answers {
-			rr := &msg.Answers[i]
+		now := time.Now()
+		for _, msg := range truncated.add(addr.String(), msg, now) {
+			forwardMessage(msg, msgs)
+		}
+		for _, msg := range truncated.expire(now) {
+			forwardMessage(msg, msgs)
+		}
+	}
+}
 
-			// PTRs only
-			if rr.Type != 12 {
-				continue
-			}
+// Does this have answers we are interested in? If so, pass on the whole message since the rest of it (Extras in particular)
+// is probably relevant
+func forwardMessage(msg DNSMessage, msgs chan DNSMessage) {
+	for i := range msg.Answers {
+		rr := &msg.Answers[i]
 
-			// Is this an airplay address
-			nameParts := strings.Split(rr.Name, ".")
-			if nameParts[0] == "_raop" || nameParts[0] == "_airplay" {
-				msgs <- msg
-			} else if nameParts[0] == "_touch-remote" {
-				msgs <- msg
-			}
+		// PTRs only
+		if rr.Type != 12 {
+			continue
+		}
+
+		// Is this an airplay address
+		nameParts := strings.Split(rr.Name, ".")
+		if nameParts[0] == "_raop" || nameParts[0] == "_airplay" || nameParts[0] == "_touch-remote" {
+			msgs <- msg
+			return
+		}
+	}
+}
+
+//
+// Handling of truncated messages (RFC 6762 section 7.2) starts here
+//
+
+// A message with the TC bit set, waiting for the rest of it to arrive
+type truncatedMessage struct {
+	msg      DNSMessage
+	deadline time.Time // When we give up waiting for more and treat it as complete
+}
+
+// Truncated messages being put back together, keyed by the address of the sender
+type truncatedMessages struct {
+	pending map[string]*truncatedMessage
+}
+
+func newTruncatedMessages() *truncatedMessages {
+	return &truncatedMessages{
+		pending: make(map[string]*truncatedMessage),
+	}
+}
+
+// How long to wait for the next packet of a truncated message. The RFC says 400-500ms, picked at random
+func truncatedWait() time.Duration {
+	return 400*time.Millisecond + time.Duration(rand.Int63n(int64(100*time.Millisecond)))
+}
+
+// Add a message that was received from source. Returns any messages that are now complete, which is
+// either msg itself, or everything from source merged together once a packet without the TC bit arrives
+func (t *truncatedMessages) add(source string, msg DNSMessage, now time.Time) (complete []DNSMessage) {
+	p, ok := t.pending[source]
+	if ok == false {
+		if msg.IsTruncated == false {
+			return []DNSMessage{msg}
+		}
+
+		t.pending[source] = &truncatedMessage{
+			msg:      msg,
+			deadline: now.Add(truncatedWait()),
 		}
+		return nil
 	}
+
+	mergeDNSMessages(&p.msg, &msg)
+	if msg.IsTruncated {
+		// Still more to come
+		p.deadline = now.Add(truncatedWait())
+		return nil
+	}
+
+	delete(t.pending, source)
+	return []DNSMessage{p.msg}
 }
 
-func (a *AirplayDevice) updateFromDNS(msg *DNSMessage) {
+// Returns the messages that we've stopped waiting on by now
+func (t *truncatedMessages) expire(now time.Time) (complete []DNSMessage) {
+	for source, p := range t.pending {
+		if now.Before(p.deadline) {
+			continue
+		}
+
+		p.msg.IsTruncated = false
+		complete = append(complete, p.msg)
+		delete(t.pending, source)
+	}
+
+	return complete
+}
+
+// The earliest time that a pending message is due, if there are any
+func (t *truncatedMessages) nextDeadline() (deadline time.Time, ok bool) {
+	for _, p := range t.pending {
+		if ok == false || p.deadline.Before(deadline) {
+			deadline = p.deadline
+			ok = true
+		}
+	}
+
+	return deadline, ok
+}
+
+// Append the records of src onto dst. The header of dst is kept, except for the TC bit which comes from src
+func mergeDNSMessages(dst *DNSMessage, src *DNSMessage) {
+	dst.IsTruncated = src.IsTruncated
+	dst.Questions = append(dst.Questions, src.Questions...)
+	dst.Answers = append(dst.Answers, src.Answers...)
+	dst.Nss = append(dst.Nss, src.Nss...)
+	dst.Extras = append(dst.Extras, src.Extras...)
+}
+
+// Update the device from any records in the message that are about it. Returns true if there were some
+func (a *AirplayDevice) updateFromDNS(msg *DNSMessage) (updated bool) {
 	//fmt.Println(msg)
 	loop := true
 	for loop {
@@ -200,6 +402,7 @@ func (a *AirplayDevice) updateFromDNS(msg *DNSMessage) {
 
 			if a.Name == deviceName || a.Hostname == rr.Name {
 				// Found it, now update it
+				updated = true
 				startOver := a.updateFromRR(rr)
 				if startOver == true {
 					loop = true
@@ -219,6 +422,7 @@ func (a *AirplayDevice) updateFromDNS(msg *DNSMessage) {
 			// Find our existing device
 			if a.Name == deviceName || a.Hostname == rr.Name {
 				// Found it, now update it
+				updated = true
 				startOver := a.updateFromRR(rr)
 				if startOver == true {
 					loop = true
@@ -226,10 +430,33 @@ func (a *AirplayDevice) updateFromDNS(msg *DNSMessage) {
 			}
 		}
 	}
+
+	return updated
+}
+
+// Records whether the device is asleep, based on whether the records about it came from a sleep proxy
+func (a *AirplayDevice) updateSleepState(owner EDNS0Owner, proxied bool) {
+	a.Asleep = proxied
+	if proxied == false {
+		return
+	}
+
+	if owner.WakeupMAC != nil {
+		a.WakeMAC = owner.WakeupMAC
+	} else {
+		a.WakeMAC = owner.PrimaryMAC
+	}
+}
+
+// Records that we just heard from this device, which also confirms it if it came from the cache
+func (a *AirplayDevice) markSeen() {
+	a.LastSeen = time.Now()
+	a.Stale = false
 }
 
 func (a *AirplayDevice) updateFromRR(rr *ResourceRecord) (startOver bool) {
 	startOver = false
+	a.markSeen()
 	switch rr.Type {
 	case 1: // A
 		if rr.Rdata.(ARecord).Address.IsGlobalUnicast() {
@@ -354,6 +581,13 @@ func (a *AirplayDevice) DeviceModel() string {
 func (a *AirplayDevice) String() (str string) {
 	str += fmt.Sprintf("%s (%s:%d)\n", a.Name, a.IP, a.Port)
 
+	if a.Stale {
+		str += fmt.Sprintf("Cached: last seen %s\n", a.LastSeen.Format(time.RFC1123))
+	}
+	if a.Asleep {
+		str += fmt.Sprintf("Asleep: answered by a sleep proxy, wake %s\n", a.WakeMAC)
+	}
+
 	if a.Type == "airplay" {
 		str += fmt.Sprintf("Device: %s v%s\n", a.DeviceModel(), a.ServerVersion())
 		str += fmt.Sprintf("Audio Channels: %d, Sample: %dHz (%d-bit)\n", a.AudioChannels(), a.AudioSampleRate(), a.AudioSampleSize())
@@ -0,0 +1,89 @@
+package airplay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTruncatedMessages(t *testing.T) {
+	truncated := newTruncatedMessages()
+	now := time.Now()
+
+	first := DNSMessage{
+		IsResponse:  true,
+		IsTruncated: true,
+		Answers: []ResourceRecord{
+			{Name: "_raop._tcp.local.", Type: 12, Class: 1, Rdata: PTRRecord{Name: "Kitchen._raop._tcp.local."}},
+		},
+	}
+	second := DNSMessage{
+		IsResponse: true,
+		Extras: []ResourceRecord{
+			{Name: "Kitchen._raop._tcp.local.", Type: 16, Class: 1, Rdata: TXTRecord{CStrings: []string{"cn=0,1"}}},
+		},
+	}
+
+	////////
+	// Untruncated messages go straight through
+	complete := truncated.add("192.168.1.10:5353", second, now)
+	if len(complete) != 1 {
+		t.Errorf("Expected 1 complete message, got %d", len(complete))
+	}
+
+	////////
+	complete = truncated.add("192.168.1.10:5353", first, now)
+	if len(complete) != 0 {
+		t.Errorf("Expected truncated message to be held, got %d", len(complete))
+	}
+
+	deadline, ok := truncated.nextDeadline()
+	if ok == false {
+		t.Fatal("No deadline for truncated message")
+	}
+	if wait := deadline.Sub(now); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Expected to wait 400-500ms, waiting %s", wait)
+	}
+
+	// A packet from somewhere else doesn't get merged
+	complete = truncated.add("192.168.1.11:5353", second, now)
+	if len(complete) != 1 || len(complete[0].Answers) != 0 {
+		t.Error("Merged messages from different sources")
+	}
+
+	complete = truncated.add("192.168.1.10:5353", second, now.Add(100*time.Millisecond))
+	if len(complete) != 1 {
+		t.Fatalf("Expected 1 complete message, got %d", len(complete))
+	}
+
+	msg := complete[0]
+	if msg.IsTruncated {
+		t.Error("Merged message is still truncated")
+	}
+	if len(msg.Answers) != 1 || len(msg.Extras) != 1 {
+		t.Errorf("Expected 1 answer and 1 extra, got %d and %d", len(msg.Answers), len(msg.Extras))
+	}
+
+	if _, ok := truncated.nextDeadline(); ok {
+		t.Error("Still waiting on a complete message")
+	}
+}
+
+func TestTruncatedMessagesExpire(t *testing.T) {
+	truncated := newTruncatedMessages()
+	now := time.Now()
+
+	msg := DNSMessage{IsResponse: true, IsTruncated: true}
+	truncated.add("192.168.1.10:5353", msg, now)
+
+	if complete := truncated.expire(now.Add(300 * time.Millisecond)); len(complete) != 0 {
+		t.Errorf("Expired a truncated message too early")
+	}
+
+	complete := truncated.expire(now.Add(500 * time.Millisecond))
+	if len(complete) != 1 {
+		t.Fatalf("Expected 1 expired message, got %d", len(complete))
+	}
+	if complete[0].IsTruncated {
+		t.Error("Expired message is still truncated")
+	}
+}
@@ -9,15 +9,18 @@
 // http://www.ietf.org/rfc/rfc1035.txt - DNS
 // http://www.ietf.org/rfc/rfc2782.txt - DNS SRV RR
 // http://www.ietf.org/rfc/rfc3596.txt - DNS Extensions to Support IP Version 6
+// http://www.ietf.org/rfc/rfc6891.txt - Extension Mechanisms for DNS (EDNS(0))
+// http://tools.ietf.org/html/draft-cheshire-edns0-owner-option - EDNS0 Owner Option
 //
 
 package airplay
 
 import (
-	//"encoding/hex"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 )
 
 //
@@ -82,6 +85,25 @@ type SRVRecord struct {
 	Target   string // The domain name of the target
 }
 
+// The pseudo-record that carries EDNS0 options. Its Class is the sender's UDP payload size
+type OPTRecord struct {
+	Options []EDNS0Option
+}
+
+type EDNS0Option struct {
+	Code uint16 // What kind of option this is, like 4 for Owner
+	Data []byte // The raw option data
+}
+
+// The EDNS0 Owner option, which a Bonjour Sleep Proxy attaches to the records it is answering
+// for on behalf of a device that has gone to sleep
+type EDNS0Owner struct {
+	Version    uint8
+	Sequence   uint8            // Incremented every time the owner wakes up
+	PrimaryMAC net.HardwareAddr // The MAC address of the sleeping device's primary interface
+	WakeupMAC  net.HardwareAddr // The MAC address to send the wake packet to, if different from PrimaryMAC
+}
+
 // Parse a bytestream into a DNSMessage struct
 func (msg *DNSMessage) Parse(buffer []byte) (err error) {
 	//fmt.Println(hex.EncodeToString(buffer))
@@ -134,15 +156,24 @@ func (msg *DNSMessage) Parse(buffer []byte) (err error) {
 	}
 
 	for i := 0; i < len(msg.Answers); i++ {
-		offset, _ = msg.Answers[i].Parse(buffer, offset)
+		offset, err = msg.Answers[i].Parse(buffer, offset)
+		if err != nil {
+			return err
+		}
 	}
 
 	for i := 0; i < len(msg.Nss); i++ {
-		offset, _ = msg.Nss[i].Parse(buffer, offset)
+		offset, err = msg.Nss[i].Parse(buffer, offset)
+		if err != nil {
+			return err
+		}
 	}
 
 	for i := 0; i < len(msg.Extras); i++ {
-		offset, _ = msg.Extras[i].Parse(buffer, offset)
+		offset, err = msg.Extras[i].Parse(buffer, offset)
+		if err != nil {
+			return err
+		}
 	}
 
 	if length != offset {
@@ -156,30 +187,80 @@ func (msg *DNSMessage) Parse(buffer []byte) (err error) {
 // to previously in the message. Takes an offset for where to start reading in the buffer.
 // Returns string domain name and new offset
 func parseDomainName(buffer []byte, offset int) (name string, new_offset int) {
-	new_offset = offset
-	for {
-		// Pointer to somewhere else in the message?
-		if buffer[new_offset]&0xC0 == 0xC0 {
-			ptr := int(buffer[new_offset]^0xC0)<<8 | int(buffer[new_offset+1])
-			ptrName, _ := parseDomainName(buffer, ptr)
-			name += ptrName
-			new_offset += 2
-			break
+	// Build the name up in here so that we only allocate once for the whole thing, if at all
+	var scratch [256]byte
+	nameBytes := scratch[:0]
 
-		} else {
-			// Nope, raw domain name
-			labelLength := uint16(buffer[new_offset])
-			new_offset += 1
-			if labelLength == 0 {
-				break
+	new_offset = -1
+	ptr := offset
+	for jumps := 0; jumps < maxDomainNamePointers; {
+		// Pointer to somewhere else in the message?
+		if buffer[ptr]&0xC0 == 0xC0 {
+			// The name ends at the first pointer, as far as our caller is concerned
+			if new_offset == -1 {
+				new_offset = ptr + 2
 			}
+			ptr = int(buffer[ptr]^0xC0)<<8 | int(buffer[ptr+1])
+			jumps++
+			continue
+		}
 
-			name += string(buffer[new_offset:new_offset+int(labelLength)]) + "."
-			new_offset += int(labelLength)
+		// Nope, raw domain name
+		labelLength := int(buffer[ptr])
+		ptr += 1
+		if labelLength == 0 {
+			break
 		}
+
+		nameBytes = append(nameBytes, buffer[ptr:ptr+labelLength]...)
+		nameBytes = append(nameBytes, '.')
+		ptr += labelLength
+	}
+
+	if new_offset == -1 {
+		new_offset = ptr
 	}
 
-	return name, new_offset
+	return internDomainName(nameBytes), new_offset
+}
+
+// How many compression pointers we'll follow in one name before deciding it's a loop
+const maxDomainNamePointers = 64
+
+// Names that turn up in almost every packet on a network full of Apple devices. Parsing one of these
+// hands back the same string every time instead of allocating a new one.
+var commonDomainNames = map[string]string{}
+
+func init() {
+	for _, name := range []string{
+		"local.",
+		"_tcp.local.",
+		"_udp.local.",
+		"_raop._tcp.local.",
+		"_airplay._tcp.local.",
+		"_airport._tcp.local.",
+		"_touch-remote._tcp.local.",
+		"_touch-able._tcp.local.",
+		"_device-info._tcp.local.",
+		"_apple-mobdev._tcp.local.",
+		"_apple-mobdev2._tcp.local.",
+		"_homekit._tcp.local.",
+		"_companion-link._tcp.local.",
+		"_sleep-proxy._udp.local.",
+		"_dns-sd._udp.local.",
+		"_services._dns-sd._udp.local.",
+	} {
+		commonDomainNames[name] = name
+	}
+}
+
+// Turn the bytes of a domain name into a string, without allocating if it's a common one
+func internDomainName(name []byte) string {
+	if interned, ok := commonDomainNames[string(name)]; ok {
+		return interned
+	}
+
+	return string(name)
 }
 
 func parseCharacterString(buffer []byte, offset int) (cs string, new_offset int) {
@@ -239,6 +320,13 @@ func (rr *ResourceRecord) Parse(buffer []byte, offset int) (new_offset int, err
 		var record TXTRecord
 		consumed := 0
 
+		// Count the strings first so we only allocate the slice once
+		count := 0
+		for i := new_offset; i < new_offset+dataLength; i += int(buffer[i]) + 1 {
+			count++
+		}
+		record.CStrings = make([]string, 0, count)
+
 		for consumed < dataLength {
 			cs, new_offset1 := parseCharacterString(buffer, new_offset)
 			record.CStrings = append(record.CStrings, cs)
@@ -272,6 +360,34 @@ func (rr *ResourceRecord) Parse(buffer []byte, offset int) (new_offset int, err
 		new_offset += int(dataLength)
 		break
 
+	case 41: // OPT
+		var record OPTRecord
+		end := new_offset + dataLength
+		if end > len(buffer) {
+			return offset, fmt.Errorf("OPT record runs past the end of the message")
+		}
+
+		for new_offset+4 <= end {
+			var option EDNS0Option
+			option.Code = uint16(buffer[new_offset])<<8 | uint16(buffer[new_offset+1])
+			optionLength := int(uint16(buffer[new_offset+2])<<8 | uint16(buffer[new_offset+3]))
+			new_offset += 4
+			if new_offset+optionLength > end {
+				return offset, fmt.Errorf("EDNS0 option %d runs past the end of the OPT record", option.Code)
+			}
+
+			// Copy, since the buffer may be reused once we're done parsing
+			option.Data = make([]byte, optionLength)
+			copy(option.Data, buffer[new_offset:new_offset+optionLength])
+			new_offset += optionLength
+
+			record.Options = append(record.Options, option)
+		}
+
+		rr.Rdata = record
+		new_offset = end
+		break
+
 	default:
 		new_offset += int(dataLength)
 		break
@@ -280,6 +396,52 @@ func (rr *ResourceRecord) Parse(buffer []byte, offset int) (new_offset int, err
 	return new_offset, nil
 }
 
+// Find the EDNS0 Owner option in the message, if there is one. Only a sleep proxy (or a device registering
+// with one) should send this
+func (msg *DNSMessage) Owner() (owner EDNS0Owner, ok bool) {
+	for i := range msg.Extras {
+		rr := &msg.Extras[i]
+		if rr.Type != 41 {
+			continue
+		}
+
+		for _, option := range rr.Rdata.(OPTRecord).Options {
+			// Owner is option 4, and needs at least the version, sequence and primary MAC
+			if option.Code != 4 || len(option.Data) < 8 {
+				continue
+			}
+
+			owner.Version = option.Data[0]
+			owner.Sequence = option.Data[1]
+			owner.PrimaryMAC = net.HardwareAddr(option.Data[2:8])
+			if len(option.Data) >= 14 {
+				owner.WakeupMAC = net.HardwareAddr(option.Data[8:14])
+			}
+
+			return owner, true
+		}
+	}
+
+	return owner, false
+}
+
+// Buffers for reading DNS messages off the network, so that we don't allocate a new one for every packet.
+// Nothing parsed out of a buffer refers back to it, so it can be put back as soon as Parse returns
+var messageBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 4096)
+		return &buffer
+	},
+}
+
+func getMessageBuffer() *[]byte {
+	return messageBufferPool.Get().(*[]byte)
+}
+
+func putMessageBuffer(buffer *[]byte) {
+	messageBufferPool.Put(buffer)
+}
+
 //
 // Methods for creating a DNS record start here
 //
@@ -292,6 +454,10 @@ func (msg *DNSMessage) AddAnswer(rr ResourceRecord) {
 	msg.Answers = append(msg.Answers, rr)
 }
 
+func (msg *DNSMessage) AddExtra(rr ResourceRecord) {
+	msg.Extras = append(msg.Extras, rr)
+}
+
 func (msg *DNSMessage) Pack() (buffer []byte, e error) {
 	buffer = make([]byte, 4096)
 	offset := 0
@@ -352,21 +518,7 @@ func (msg *DNSMessage) Pack() (buffer []byte, e error) {
 
 	// Questions
 	for i := 0; i < questionCount; i++ {
-		bs := []byte(msg.Questions[i].Name)
-		length := 0
-		for j := 0; j < len(bs); j++ {
-			if bs[j] == 0x2e {
-				buffer[offset] = byte(length)
-				offset += length + 1
-				length = 0
-				continue
-			}
-
-			buffer[offset+length+1] = bs[j]
-			length++
-		}
-		buffer[offset] = 0x00
-		offset++
+		offset = packDomainName(buffer, offset, msg.Questions[i].Name)
 
 		buffer[offset] = byte(msg.Questions[i].Type >> 8)
 		buffer[offset+1] = byte(msg.Questions[i].Type)
@@ -378,11 +530,137 @@ func (msg *DNSMessage) Pack() (buffer []byte, e error) {
 	}
 
 	// Various RRs
-	// TODO
+	for i := 0; i < answerCount; i++ {
+		offset, e = msg.Answers[i].Pack(buffer, offset)
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	for i := 0; i < nssCount; i++ {
+		offset, e = msg.Nss[i].Pack(buffer, offset)
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	for i := 0; i < extraCount; i++ {
+		offset, e = msg.Extras[i].Pack(buffer, offset)
+		if e != nil {
+			return nil, e
+		}
+	}
 
 	return buffer[0:offset], nil
 }
 
+// Write a domain name into the message buffer at offset, uncompressed.
+// Returns the new offset
+func packDomainName(buffer []byte, offset int, name string) (new_offset int) {
+	bs := []byte(name)
+	length := 0
+	for j := 0; j < len(bs); j++ {
+		if bs[j] == 0x2e {
+			buffer[offset] = byte(length)
+			offset += length + 1
+			length = 0
+			continue
+		}
+
+		buffer[offset+length+1] = bs[j]
+		length++
+	}
+	buffer[offset] = 0x00
+	offset++
+
+	return offset
+}
+
+// Write a ResourceRecord into the message buffer at offset. Only the record types we know how to parse can be packed.
+// Returns the new offset
+func (rr *ResourceRecord) Pack(buffer []byte, offset int) (new_offset int, err error) {
+	new_offset = packDomainName(buffer, offset, rr.Name)
+
+	buffer[new_offset] = byte(rr.Type >> 8)
+	buffer[new_offset+1] = byte(rr.Type)
+	new_offset += 2
+
+	buffer[new_offset] = byte(rr.Class >> 8)
+	if rr.CacheClear {
+		buffer[new_offset] |= 0x80
+	}
+	buffer[new_offset+1] = byte(rr.Class)
+	new_offset += 2
+
+	buffer[new_offset] = byte(rr.TTL >> 24)
+	buffer[new_offset+1] = byte(rr.TTL >> 16)
+	buffer[new_offset+2] = byte(rr.TTL >> 8)
+	buffer[new_offset+3] = byte(rr.TTL)
+	new_offset += 4
+
+	// Leave room for the data length, and fill it in once we know it
+	lengthOffset := new_offset
+	new_offset += 2
+
+	switch rr.Type {
+	case 1: // A
+		copy(buffer[new_offset:], rr.Rdata.(ARecord).Address.To4())
+		new_offset += 4
+		break
+
+	case 12: // PTR
+		new_offset = packDomainName(buffer, new_offset, rr.Rdata.(PTRRecord).Name)
+		break
+
+	case 16: // TXT
+		for _, cs := range rr.Rdata.(TXTRecord).CStrings {
+			buffer[new_offset] = byte(len(cs))
+			copy(buffer[new_offset+1:], cs)
+			new_offset += len(cs) + 1
+		}
+		break
+
+	case 28: // AAAA
+		copy(buffer[new_offset:], rr.Rdata.(AAAARecord).Address.To16())
+		new_offset += 16
+		break
+
+	case 33: // SRV
+		record := rr.Rdata.(SRVRecord)
+		buffer[new_offset] = byte(record.Priority >> 8)
+		buffer[new_offset+1] = byte(record.Priority)
+		buffer[new_offset+2] = byte(record.Weight >> 8)
+		buffer[new_offset+3] = byte(record.Weight)
+		buffer[new_offset+4] = byte(record.Port >> 8)
+		buffer[new_offset+5] = byte(record.Port)
+		new_offset = packDomainName(buffer, new_offset+6, record.Target)
+		break
+
+	case 41: // OPT
+		for _, option := range rr.Rdata.(OPTRecord).Options {
+			buffer[new_offset] = byte(option.Code >> 8)
+			buffer[new_offset+1] = byte(option.Code)
+			buffer[new_offset+2] = byte(len(option.Data) >> 8)
+			buffer[new_offset+3] = byte(len(option.Data))
+			copy(buffer[new_offset+4:], option.Data)
+			new_offset += len(option.Data) + 4
+		}
+		break
+
+	default:
+		if rr.Rdata != nil {
+			return offset, fmt.Errorf("Can't pack resource records of type %d", rr.Type)
+		}
+		break
+	}
+
+	dataLength := new_offset - lengthOffset - 2
+	buffer[lengthOffset] = byte(dataLength >> 8)
+	buffer[lengthOffset+1] = byte(dataLength)
+
+	return new_offset, nil
+}
+
 //
 // Formatting of messages to strings starts here
 //
@@ -436,6 +714,7 @@ var TypeToString = map[uint16]string{
 	28: "AAAA",
 	33: "SRV",
 
+	41: "OPT",
 	47: "NSEC",
 
 	252: "AXFR",
@@ -595,6 +874,12 @@ func (rr *ResourceRecord) String() string {
 			strconv.Itoa(int(record.Weight)) + " " +
 			strconv.Itoa(int(record.Port)) + " " + record.Target
 		break
+
+	case 41: // OPT
+		for _, option := range rr.Rdata.(OPTRecord).Options {
+			s += "\t" + strconv.Itoa(int(option.Code)) + ":" + hex.EncodeToString(option.Data)
+		}
+		break
 	}
 	return s
 }
@@ -0,0 +1,85 @@
+//
+// RSA/AES audio encryption (et=1), as AirPort Express-style receivers expect.
+//
+// For each session we make up a random AES-128 key and IV, encrypt the key
+// with the receiver's well-known RSA public key (OAEP, SHA-1), and ANNOUNCE
+// both as rsaaeskey and aesiv. Every audio payload is then AES-CBC encrypted
+// from that IV, starting over for each packet. Any trailing partial block is
+// sent in the clear.
+//
+// http://nto.github.io/AirPlay.html#audio-rtsp
+// https://github.com/abrasive/shairport - where the public key comes from
+//
+
+package airplay
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"math/big"
+)
+
+// Audio encryption types, numbered the same as the et TXT flag (see AirplayDevice.EncryptionTypes)
+const (
+	EncryptionNone = 0
+	EncryptionRSA  = 1
+)
+
+var (
+	// The public half of the RSA key that AirPort Express-style receivers decrypt the AES key with
+	RAOPPublicKey = &rsa.PublicKey{
+		N: new(big.Int).SetBytes(mustDecodeBase64("59dE8qLieItsH1WgjrcFRKj6eUWqi+bGLOX1HL3U3GhC/j0Qg90u3sG/1CUtwC5vOYvfDmFI6oSFXi5ELabWJmT2dKHzBJKa3k9ok+8t9ucRqMd6DZHJ2YCCLlDRKSKv6kDqnw4UwPdpOMXziC/AMj3Z/lUVX1G7WSHCAWKf1zNS1eLvqr+boEjXuBOitnZ/bDzPHrTOZz0Dew0uowxf/+sG+NCK3eQJVxqcaJ/vEHKIVd2M+5qL71yJQ+87X6oV3eaYvt3zWZYD6z5vYTcrtij2VZ9Zmni/UAaHqn9JdsBWLUEpVviYnhimNVvYFZeCXg/IdTQ+x4IRdiXNv5hEew==")),
+		E: 65537,
+	}
+)
+
+func mustDecodeBase64(s string) []byte {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+// Make up a new AES key and IV for the session, and encrypt the key for the receiver
+func (a *Airplay) newSessionKey() (encryptedKey []byte, err error) {
+	key := make([]byte, aes.BlockSize)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, RAOPPublicKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	a.aesKey = key
+	a.aesIV = iv
+
+	return encryptedKey, nil
+}
+
+// Encrypt an audio payload in place with the session key, leaving any partial block at the end alone
+func encryptPayload(payload, key, iv []byte) (err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	whole := len(payload) / aes.BlockSize * aes.BlockSize
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload[:whole], payload[:whole])
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package airplay
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"github.com/grantmd/go-airplay/sdp"
+	"net"
+	"testing"
+)
+
+func TestRAOPPublicKey(t *testing.T) {
+	if RAOPPublicKey.N.BitLen() != 2048 {
+		t.Errorf("Expected a 2048 bit key, got %d bits", RAOPPublicKey.N.BitLen())
+	}
+}
+
+func TestEncryptPayload(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, aes.BlockSize)
+	iv := bytes.Repeat([]byte{0x02}, aes.BlockSize)
+
+	plain := make([]byte, 2*aes.BlockSize+4)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+
+	payload := append([]byte{}, plain...)
+	err := encryptPayload(payload, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(payload[len(payload)-4:], plain[len(plain)-4:]) == false {
+		t.Error("Trailing partial block was encrypted")
+	}
+
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(payload[:2*aes.BlockSize], payload[:2*aes.BlockSize])
+	if bytes.Equal(payload, plain) == false {
+		t.Errorf("Payload didn't decrypt: %x", payload)
+	}
+}
+
+func TestDeviceEncryption(t *testing.T) {
+	tests := map[string]int{
+		"":      EncryptionNone,
+		"0,1":   EncryptionNone,
+		"1":     EncryptionRSA,
+		"1,3,5": EncryptionRSA,
+		"3":     EncryptionNone,
+	}
+
+	for et, expected := range tests {
+		device := AirplayDevice{Flags: map[string]string{"et": et}}
+		if deviceEncryption(device) != expected {
+			t.Errorf("Expected encryption %d for et=%s, got %d", expected, et, deviceEncryption(device))
+		}
+	}
+}
+
+// Play the part of an AirPort Express: decrypt the session key from the ANNOUNCE, then the audio with it
+func TestEncryptedSession(t *testing.T) {
+	// Swap in a key we have the private half of
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(key *rsa.PublicKey) { RAOPPublicKey = key }(RAOPPublicKey)
+	RAOPPublicKey = &private.PublicKey
+
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Codec = CodecPCM
+	a.Encryption = EncryptionRSA
+
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	var description sdp.Session
+	err = sdp.Unmarshal(receiver.Requests("ANNOUNCE")[0].Body, &description)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedKey, err := description.Media[0].RSAAESKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.DecryptOAEP(sha1.New(), nil, private, encryptedKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv, err := description.Media[0].AESIV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != aes.BlockSize || len(iv) != aes.BlockSize {
+		t.Fatalf("Unexpected key and IV lengths: %d, %d", len(key), len(iv))
+	}
+
+	////////
+	// Send the audio to a local socket instead of going through SETUP
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	a.serverPort = server.LocalAddr().(*net.UDPAddr).Port
+
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pcm := make([]byte, FrameBytes)
+	for i := 0; i < len(pcm); i += 2 {
+		pcm[i] = byte(i / 2)
+		pcm[i+1] = 0x01
+	}
+
+	err = s.WriteFrame(pcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := readTestPacket(t, server)[rtpHeaderLength:]
+	if payload[0] == 0x01 && payload[1] == 0x00 {
+		t.Error("Audio was sent in the clear")
+	}
+
+	block, _ := aes.NewCipher(key)
+	whole := len(payload) / aes.BlockSize * aes.BlockSize
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(payload[:whole], payload[:whole])
+
+	for i := 0; i < len(pcm); i += 2 {
+		if payload[i] != pcm[i+1] || payload[i+1] != pcm[i] {
+			t.Fatalf("Decrypted audio doesn't match at byte %d: %x", i, payload[i:i+2])
+		}
+	}
+}
@@ -0,0 +1,199 @@
+//
+// Playback events from the receiver. AirPlay video and photo receivers tell
+// us when playback changes, including when someone uses the TV's own
+// remote. We open a second connection and ask to turn it around:
+//
+//	POST /reverse HTTP/1.1
+//	Upgrade: PTTH/1.0
+//	Connection: Upgrade
+//	X-Apple-Purpose: event
+//
+// Once the receiver answers 101 Switching Protocols, it's the one making
+// requests on that connection. It sends a POST /event with a plist each time
+// the state changes, which we answer with an empty 200, and asks for the
+// next image of a slideshow, see photo.go:
+//
+//	<dict>
+//		<key>category</key>
+//		<string>video</string>
+//		<key>state</key>
+//		<string>paused</string>
+//	</dict>
+//
+// http://nto.github.io/AirPlay.html#video-events
+//
+
+package airplay
+
+import (
+	"context"
+	"fmt"
+	"github.com/grantmd/go-airplay/plist"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Playback states in a PlaybackEvent. Receivers may send others, which come through as they are
+const (
+	StatePlaying = "playing"
+	StatePaused  = "paused"
+	StateLoading = "loading"
+	StateStopped = "stopped"
+)
+
+// A change in playback on the receiver
+type PlaybackEvent struct {
+	Category string                 `plist:"category"` // What's playing: "video", "photo" or "slideshow"
+	State    string                 `plist:"state"`    // StatePlaying, StatePaused, StateLoading or StateStopped
+	Params   map[string]interface{} `plist:"-"`        // The whole event, as the receiver sent it
+}
+
+// Open the reverse connection, and send what the receiver tells us to PlaybackEvents until StopEvents or Close.
+// Only AirPlay video and photo receivers do this, RAOP speakers will refuse
+func (a *Airplay) StartEvents() (err error) {
+	return a.StartEventsContext(context.Background())
+}
+
+// StartEvents, giving up if ctx is done before the receiver agrees
+func (a *Airplay) StartEventsContext(ctx context.Context) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	return a.openReverse(ctx)
+}
+
+// Close the reverse connection. PlaybackEvents gets nothing more after this returns
+func (a *Airplay) StopEvents() {
+	a.lockSession()
+	defer a.unlockSession()
+
+	a.closeReverse()
+}
+
+// Dial the reverse connection and start listening on it, replacing any we already had. Call with the lock held
+func (a *Airplay) openReverse(ctx context.Context) (err error) {
+	a.closeReverse()
+
+	dialer := net.Dialer{Timeout: DialTimeout}
+	a.reverseNetConn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(a.ip.String(), strconv.Itoa(int(a.port))))
+	if err != nil {
+		return err
+	}
+	a.reverseConn = textproto.NewConn(a.reverseNetConn)
+	a.reverseDone = make(chan struct{})
+
+	err = a.makeReverseRequest(ctx)
+	if err != nil {
+		close(a.reverseDone)
+		a.closeReverse()
+		return err
+	}
+
+	// Any slideshow carries on over the new connection
+	if a.slideshow == nil {
+		a.slideshow = new(slideshow)
+	}
+
+	go a.serveEvents(a.reverseConn, a.reverseDone, a.slideshow)
+
+	return nil
+}
+
+// Hang up the reverse connection and wait for serveEvents to notice. Call with the lock held
+func (a *Airplay) closeReverse() {
+	if a.reverseConn == nil {
+		return
+	}
+
+	a.reverseConn.Close()
+	<-a.reverseDone
+
+	a.reverseConn = nil
+	a.reverseNetConn = nil
+	a.reverseDone = nil
+}
+
+// Answer the receiver's requests on the reverse connection until it's closed: events, and images for show.
+// Doesn't need the lock, nothing else uses conn once it's been turned around
+func (a *Airplay) serveEvents(conn *textproto.Conn, done chan struct{}, show *slideshow) {
+	defer close(done)
+
+	for {
+		req, err := http.ReadRequest(conn.R)
+		if err != nil {
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return
+		}
+
+		if req.Method == "GET" && strings.HasPrefix(req.URL.Path, "/slideshows/1/assets/") {
+			err = show.answerAsset(conn)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		err = writeReverseResponse(conn, "200 OK", "", nil)
+		if err != nil {
+			return
+		}
+
+		if req.Method != "POST" || req.URL.Path != "/event" {
+			continue
+		}
+
+		e, err := parsePlaybackEvent(body)
+		if err != nil {
+			// Not something we understand, but no reason to hang up
+			continue
+		}
+
+		a.sendPlaybackEvent(e)
+	}
+}
+
+// Answer one of the receiver's requests on the reverse connection
+func writeReverseResponse(conn *textproto.Conn, status string, contentType string, body []byte) (err error) {
+	fmt.Fprintf(conn.W, "HTTP/1.1 %s\r\n", status)
+	if contentType != "" {
+		fmt.Fprintf(conn.W, "Content-Type: %s\r\n", contentType)
+	}
+	fmt.Fprintf(conn.W, "Content-Length: %d\r\n\r\n", len(body))
+	conn.W.Write(body)
+
+	return conn.W.Flush()
+}
+
+// Read an event from the plist the receiver sent
+func parsePlaybackEvent(body []byte) (e PlaybackEvent, err error) {
+	err = plist.Unmarshal(body, &e)
+	if err != nil {
+		return e, err
+	}
+
+	err = plist.Unmarshal(body, &e.Params)
+	return e, err
+}
+
+// Tell whoever's listening. Drops the event if they aren't keeping up
+func (a *Airplay) sendPlaybackEvent(e PlaybackEvent) {
+	if a.PlaybackEvents == nil {
+		return
+	}
+
+	select {
+	case a.PlaybackEvents <- e:
+		break
+	default:
+		break
+	}
+}
@@ -0,0 +1,194 @@
+package airplay
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testEventPlist(state string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>category</key>
+	<string>video</string>
+	<key>sessionID</key>
+	<integer>13</integer>
+	<key>state</key>
+	<string>` + state + `</string>
+</dict>
+</plist>`
+}
+
+// A stand-in video receiver that agrees to reverse the connection, then sends each request in
+// requests and reports the status it gets back on answered
+type testReverseReceiver struct {
+	listener net.Listener
+	requests chan string
+	answered chan int
+	reverse  chan *http.Request // The POST /reverse, once it arrives
+	closed   chan struct{}      // Closed when we hang up on it
+}
+
+func startReverseReceiver(t *testing.T) *testReverseReceiver {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &testReverseReceiver{
+		listener: listener,
+		requests: make(chan string, 10),
+		answered: make(chan int, 10),
+		reverse:  make(chan *http.Request, 1),
+		closed:   make(chan struct{}),
+	}
+	go r.serve()
+
+	return r
+}
+
+func (r *testReverseReceiver) serve() {
+	conn, err := r.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	r.reverse <- req
+
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nDate: Thu, 23 Feb 2012 17:33:41 GMT\r\nUpgrade: PTTH/1.0\r\nConnection: Upgrade\r\nCSeq: "+req.Header.Get("CSeq")+"\r\n\r\n")
+
+	go func() {
+		// Notice when the client hangs up
+		for {
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				close(r.closed)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			r.answered <- resp.StatusCode
+		}
+	}()
+
+	for request := range r.requests {
+		_, err = io.WriteString(conn, request)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *testReverseReceiver) Close() {
+	r.listener.Close()
+	close(r.requests)
+}
+
+func testEventRequest(method string, path string, body string) string {
+	return method + " " + path + " HTTP/1.1\r\nContent-Type: text/x-apple-plist+xml\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\nX-Apple-Session-ID: 00000000-0000-0000-0000-000000000000\r\n\r\n" + body
+}
+
+////////
+
+func TestEvents(t *testing.T) {
+	receiver := startReverseReceiver(t)
+	defer receiver.Close()
+
+	addr := receiver.listener.Addr().(*net.TCPAddr)
+	events := make(chan PlaybackEvent, 10)
+	a := &Airplay{ip: addr.IP, port: uint16(addr.Port), lock: new(sync.Mutex), sessionID: "1BBCA8E8-E24D-4AF2-9E6B-2D0A6E2CFE3C", PlaybackEvents: events}
+	defer a.Close()
+
+	err := a.StartEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-receiver.reverse
+	if req.Method != "POST" || req.URL.Path != "/reverse" || req.Header.Get("Upgrade") != "PTTH/1.0" || req.Header.Get("Connection") != "Upgrade" {
+		t.Errorf("Unexpected reverse request: %s %s %v", req.Method, req.URL, req.Header)
+	}
+	if req.Header.Get("X-Apple-Session-ID") != a.sessionID {
+		t.Errorf("Expected the session ID, got %s", req.Header.Get("X-Apple-Session-ID"))
+	}
+
+	////////
+	receiver.requests <- testEventRequest("POST", "/event", testEventPlist("loading"))
+	receiver.requests <- testEventRequest("POST", "/event", "not a plist")
+	receiver.requests <- testEventRequest("GET", "/something-else", "")
+	receiver.requests <- testEventRequest("POST", "/event", testEventPlist("playing"))
+
+	for i := 0; i < 4; i++ {
+		select {
+		case status := <-receiver.answered:
+			if status != 200 {
+				t.Errorf("Expected 200, got %d", status)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for an answer")
+		}
+	}
+
+	for _, state := range []string{StateLoading, StatePlaying} {
+		select {
+		case e := <-events:
+			if e.Category != "video" || e.State != state || e.Params["sessionID"] != int64(13) {
+				t.Errorf("Expected %s, got %v", state, e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %s", state)
+		}
+	}
+
+	////////
+	a.StopEvents()
+	select {
+	case <-receiver.closed:
+		break
+	case <-time.After(2 * time.Second):
+		t.Error("Expected StopEvents to hang up")
+	}
+	if a.reverseConn != nil {
+		t.Error("Expected the reverse connection to be gone")
+	}
+}
+
+func TestEventsRefused(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// RAOP speakers don't do events
+	err = a.StartEvents()
+	if err == nil || strings.Contains(err.Error(), "refused the reverse connection") == false {
+		t.Errorf("Expected the reverse connection to be refused, got %v", err)
+	}
+	if a.reverseConn != nil {
+		t.Error("Expected no reverse connection")
+	}
+
+	// The main connection carries on
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,6 +10,12 @@ var (
 )
 
 func main() {
+	// Start with whatever we knew about last time, if anything
+	err := airplay.LoadDeviceCache("devices.json")
+	if err != nil {
+		fmt.Println("No device cache:", err)
+	}
+
 	// Discover some devices
 	fmt.Println("Looking for devices...")
 
@@ -25,6 +31,11 @@ func main() {
 		}
 		fmt.Println()
 
+		err = airplay.SaveDeviceCache("devices.json")
+		if err != nil {
+			panic(err)
+		}
+
 		/*
 			// Connect to the first one
 			// TODO: Validate the TXT record properties first?
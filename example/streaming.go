@@ -3,12 +3,16 @@ package main
 import (
 	"fmt"
 	"github.com/grantmd/go-airplay"
+	"os"
 )
 
 var (
 	deviceList []airplay.AirplayDevice
 )
 
+// Plays raw 44.1kHz 16-bit little-endian stereo PCM from stdin, like:
+//
+//	sox song.mp3 -t raw -r 44100 -b 16 -e signed -c 2 - | go run streaming.go
 func main() {
 	// Discover some devices
 	fmt.Println("Looking for devices...")
@@ -29,7 +33,7 @@ func main() {
 			fmt.Println(deviceList[i].String())
 			// TODO: Validate the TXT record properties first?
 			var err error
-			device, err = airplay.Dial(deviceList[i].IP, deviceList[i].Port, "")
+			device, err = airplay.DialDevice(deviceList[i], "")
 			if err != nil {
 				panic(err)
 			}
@@ -42,4 +46,36 @@ func main() {
 			break
 		}
 	}
+
+	err := device.Announce()
+	if err != nil {
+		panic(err)
+	}
+
+	err = device.Setup()
+	if err != nil {
+		panic(err)
+	}
+
+	sender, err := device.NewAudioSender()
+	if err != nil {
+		panic(err)
+	}
+	defer sender.Close()
+
+	err = device.Record(sender.Seq(), sender.Timestamp())
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Streaming")
+	err = sender.Stream(os.Stdin)
+	if err != nil {
+		panic(err)
+	}
+
+	err = device.Teardown()
+	if err != nil {
+		panic(err)
+	}
 }
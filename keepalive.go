@@ -0,0 +1,313 @@
+//
+// Keeping the connection to a receiver alive, and getting it back when it
+// drops. Receivers hang up on RTSP connections that go quiet, so we send
+// OPTIONS every so often. If that fails the connection is gone (the
+// receiver restarted, or we roamed to another access point), and we dial
+// again, authenticate again, and put the session back the way it was:
+//
+// ANNOUNCE - the same SDP as before, so the audio key doesn't change
+// SETUP    - with our same control and timing ports
+// RECORD   - from wherever the audio sender has got to
+//
+// The audio sender keeps its pace while we reconnect, dropping frames, so
+// the stream picks up where it would have been. Each attempt is reported
+// on Airplay.Events.
+//
+
+package airplay
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Kinds of Event
+const (
+	EventConnectionLost  = iota // The keepalive failed, Err says why
+	EventReconnecting           // Starting reconnect attempt number Attempt
+	EventReconnectFailed        // Attempt didn't work, Err says why
+	EventReconnected            // Attempt worked, and the session is back if there was one
+	EventDisconnected           // We gave up after ReconnectAttempts, Err says why
+)
+
+var (
+	// How many times to try reconnecting before giving up
+	ReconnectAttempts = 5
+
+	// How long to wait after the first failed attempt. It doubles after each one
+	ReconnectDelay = time.Second
+)
+
+// Something that happened to the connection
+type Event struct {
+	Type    int
+	Attempt int   // Which reconnect attempt, from 1
+	Err     error // What went wrong, for EventConnectionLost, EventReconnectFailed and EventDisconnected
+}
+
+// A running keepalive, see StartKeepalive
+type keepalive struct {
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the keepalive goroutine has returned
+}
+
+// Send OPTIONS every interval to keep the connection up, and reconnect if it goes down. Runs until
+// StopKeepalive or Close, which like this shouldn't be called at the same time as each other
+func (a *Airplay) StartKeepalive(interval time.Duration) {
+	a.StopKeepalive()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k := &keepalive{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	a.keepalive = k
+	go a.keepaliveLoop(ctx, k, interval)
+}
+
+// Stop sending keepalives. Waits for any reconnect in progress to give up
+func (a *Airplay) StopKeepalive() {
+	k := a.keepalive
+	a.keepalive = nil
+
+	if k != nil {
+		k.cancel()
+		<-k.done
+	}
+}
+
+func (a *Airplay) keepaliveLoop(ctx context.Context, k *keepalive, interval time.Duration) {
+	defer close(k.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			break
+		}
+
+		a.lockSession()
+		err := a.ping(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.sendEvent(Event{Type: EventConnectionLost, Err: err})
+			err = a.reconnect(ctx)
+		}
+		a.unlockSession()
+
+		if err != nil {
+			// Either we're being stopped, or we've given up
+			return
+		}
+	}
+}
+
+// Send a keepalive. Anything but a lost connection counts as alive. Call with the lock held
+func (a *Airplay) ping(ctx context.Context) (err error) {
+	if a.conn == nil {
+		return ErrNotConnected
+	}
+
+	_, err = a.makeRTSPRequest(ctx, "OPTIONS", "*", nil, nil)
+	if connectionLost(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Whether an error means the connection is gone
+func connectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrNotConnected {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Dial again and set the session back up, trying up to ReconnectAttempts times. Call with the lock held
+func (a *Airplay) reconnect(ctx context.Context) (err error) {
+	if a.sender != nil {
+		a.sender.suspend()
+	}
+
+	delay := ReconnectDelay
+	for attempt := 1; attempt <= ReconnectAttempts; attempt++ {
+		if attempt > 1 {
+			// Let everyone else have the lock while we wait. They'll get ErrNotConnected
+			a.unlockSession()
+			select {
+			case <-ctx.Done():
+				break
+			case <-time.After(delay):
+				break
+			}
+			a.lockSession()
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			delay *= 2
+		}
+
+		a.sendEvent(Event{Type: EventReconnecting, Attempt: attempt})
+
+		err = a.redial(ctx)
+		if err == nil && a.url != "" {
+			err = a.resumeSession(ctx)
+		}
+		if err == nil && a.reverseConn != nil {
+			// The receiver has forgotten about our events too
+			err = a.openReverse(ctx)
+		}
+		if err == nil {
+			a.sendEvent(Event{Type: EventReconnected, Attempt: attempt})
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		a.sendEvent(Event{Type: EventReconnectFailed, Attempt: attempt, Err: err})
+	}
+
+	if a.sender != nil {
+		a.sender.fail(err)
+	}
+	a.sendEvent(Event{Type: EventDisconnected, Err: err})
+
+	return err
+}
+
+// Hang up and dial again. The receiver will want us to authenticate afresh. Call with the lock held
+func (a *Airplay) redial(ctx context.Context) (err error) {
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+		a.netConn = nil
+	}
+	a.auth = nil
+
+	return a.connect(ctx)
+}
+
+// Put the session back on a new connection, and point the audio sender at the receiver's new ports.
+// Call with the lock held
+func (a *Airplay) resumeSession(ctx context.Context) (err error) {
+	wasRecording := a.recording
+
+	a.session = ""
+	err = a.announce(ctx)
+	if err != nil {
+		return err
+	}
+
+	if a.controlConn == nil || a.timing == nil {
+		// We never got as far as SETUP
+		return nil
+	}
+
+	err = a.setup(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The sender kept its pace while we were away, so play from where it's got to
+	seq, rtptime := a.recordSeq, a.recordTime
+	if a.sender != nil {
+		seq, rtptime = a.sender.Seq(), a.sender.Timestamp()
+	}
+
+	if wasRecording {
+		err = a.record(ctx, seq, rtptime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.sender != nil {
+		return a.sender.resume(a.serverPort, a.controlPort, seq, rtptime)
+	}
+
+	return nil
+}
+
+// Tell whoever's listening what happened. Drops the event if they aren't keeping up
+func (a *Airplay) sendEvent(e Event) {
+	if a.Events == nil {
+		return
+	}
+
+	select {
+	case a.Events <- e:
+		break
+	default:
+		break
+	}
+}
+
+// Stop sending frames until resume, because the connection is down
+func (s *AudioSender) suspend() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.suspended = true
+}
+
+// Start sending again, to the receiver's new ports. The receiver has forgotten everything, so the next
+// packet starts a fresh stream from seq and timestamp, where RECORD said it would. Frames dropped since
+// we looked don't count
+func (s *AudioSender) resume(serverPort int, controlPort int, seq uint16, timestamp uint32) (err error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(s.airplay.ip.String(), strconv.Itoa(serverPort)))
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-s.done:
+		// Closed while we were reconnecting
+		conn.Close()
+		return nil
+	default:
+		break
+	}
+
+	s.conn.Close()
+	s.conn = conn.(*net.UDPConn)
+	if s.controlAddr != nil {
+		s.controlAddr = &net.UDPAddr{
+			IP:   s.airplay.ip,
+			Port: controlPort,
+		}
+	}
+	s.seq = seq
+	s.timestamp = timestamp
+	s.marker = true
+	s.needSync = true
+	s.suspended = false
+
+	return nil
+}
+
+// Give up on sending, because we couldn't reconnect. WriteFrame returns err from now on
+func (s *AudioSender) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lost = err
+}
@@ -0,0 +1,261 @@
+package airplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+
+	return Event{}
+}
+
+////////
+
+func TestKeepalive(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	a.StartKeepalive(10 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	// Requests still work alongside it
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Let any keepalive we cut short arrive
+	a.StopKeepalive()
+	time.Sleep(20 * time.Millisecond)
+
+	sent := len(receiver.Requests("OPTIONS"))
+	if sent < 4 {
+		t.Errorf("Expected several keepalives, got %d OPTIONS", sent)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(receiver.Requests("OPTIONS")) != sent {
+		t.Error("Keepalives kept coming after StopKeepalive")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	// Where the receiver wants audio, and where it listens for sync packets
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	control, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+
+	h := &testAuth{t: t, password: "secret"}
+	receiver := startTestReceiver(t, func(req *testRequest) *testResponse {
+		if resp := h.handle(req); resp != nil {
+			return resp
+		}
+
+		if req.Method == "SETUP" {
+			return &testResponse{
+				StatusCode: 200,
+				Header: map[string]string{
+					"Session": "DEADBEEF",
+					"Transport": fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;server_port=%d;control_port=%d;timing_port=50607",
+						server.LocalAddr().(*net.UDPAddr).Port, control.LocalAddr().(*net.UDPAddr).Port),
+				},
+			}
+		}
+		return nil
+	})
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	events := make(chan Event, 10)
+	a.Events = events
+
+	if err = a.Announce(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = a.Record(s.Seq(), s.Timestamp()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = s.WriteFrame(make([]byte, FrameBytes)); err != nil {
+			t.Fatal(err)
+		}
+		readTestPacket(t, server)
+	}
+
+	// Pause, and carry on, so the sender is ahead of where we last flushed
+	flushSeq, flushTime := s.Seq(), s.Timestamp()
+	if err = a.Flush(flushSeq, flushTime); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = s.WriteFrame(make([]byte, FrameBytes)); err != nil {
+			t.Fatal(err)
+		}
+		readTestPacket(t, server)
+	}
+
+	////////
+	// Pull the plug
+	conn := a.netConn
+	a.StartKeepalive(10 * time.Millisecond)
+	conn.Close()
+
+	if e := nextEvent(t, events); e.Type != EventConnectionLost || e.Err == nil {
+		t.Errorf("Expected EventConnectionLost, got %v", e)
+	}
+	if e := nextEvent(t, events); e.Type != EventReconnecting || e.Attempt != 1 {
+		t.Errorf("Expected EventReconnecting, got %v", e)
+	}
+	if e := nextEvent(t, events); e.Type != EventReconnected || e.Attempt != 1 {
+		t.Errorf("Expected EventReconnected, got %v", e)
+	}
+	a.StopKeepalive()
+
+	// We had to authenticate again on the new connection
+	unauthorized := 0
+	for _, req := range receiver.Requests("OPTIONS") {
+		if req.Header.Get("Authorization") == "" {
+			unauthorized++
+		}
+	}
+	if unauthorized != 2 {
+		t.Errorf("Expected to be challenged on each connection, got %d OPTIONS without Authorization", unauthorized)
+	}
+
+	// The same stream is set up again with the same ports
+	announces := receiver.Requests("ANNOUNCE")
+	setups := receiver.Requests("SETUP")
+	records := receiver.Requests("RECORD")
+	if len(announces) != 2 || len(setups) != 2 || len(records) != 2 {
+		t.Fatalf("Expected 2 of each, got %d ANNOUNCE, %d SETUP, %d RECORD", len(announces), len(setups), len(records))
+	}
+	if string(announces[0].Body) != string(announces[1].Body) || announces[1].URI != announces[0].URI {
+		t.Error("Expected the same ANNOUNCE again")
+	}
+	if announces[1].Header.Get("Session") != "" {
+		t.Error("The new ANNOUNCE shouldn't be part of the old session")
+	}
+	if setups[0].Header.Get("Transport") != setups[1].Header.Get("Transport") {
+		t.Errorf("Expected the same ports, got %s and %s", setups[0].Header.Get("Transport"), setups[1].Header.Get("Transport"))
+	}
+
+	// And playback resumes from the first packet the sender sends on the new connection
+	err = s.WriteFrame(make([]byte, FrameBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := readTestPacket(t, server)
+	if packet[1]&0x80 == 0 {
+		t.Errorf("Expected a fresh stream, got %x", packet[:4])
+	}
+	expected := fmt.Sprintf("seq=%d;rtptime=%d", binary.BigEndian.Uint16(packet[2:4]), binary.BigEndian.Uint32(packet[4:8]))
+	if records[1].Header.Get("RTP-Info") != expected {
+		t.Errorf("Expected RECORD from %s, got %s", expected, records[1].Header.Get("RTP-Info"))
+	}
+
+	sync := readTestPacket(t, control)
+	if sync[0]&0x10 == 0 || sync[1]&0x7F != controlSync {
+		t.Errorf("Expected a sync with the extension bit, got %x", sync[:2])
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	attempts, delay := ReconnectAttempts, ReconnectDelay
+	defer func() {
+		ReconnectAttempts, ReconnectDelay = attempts, delay
+	}()
+	ReconnectAttempts = 2
+	ReconnectDelay = 10 * time.Millisecond
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	receiver := startTestReceiver(t, nil)
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	events := make(chan Event, 10)
+	a.Events = events
+
+	a.serverPort = server.LocalAddr().(*net.UDPAddr).Port
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	////////
+	// The receiver goes away for good
+	receiver.Close()
+	conn := a.netConn
+	a.StartKeepalive(10 * time.Millisecond)
+	conn.Close()
+
+	expected := []Event{
+		{Type: EventConnectionLost},
+		{Type: EventReconnecting, Attempt: 1},
+		{Type: EventReconnectFailed, Attempt: 1},
+		{Type: EventReconnecting, Attempt: 2},
+		{Type: EventReconnectFailed, Attempt: 2},
+		{Type: EventDisconnected},
+	}
+	for _, want := range expected {
+		e := nextEvent(t, events)
+		if e.Type != want.Type || e.Attempt != want.Attempt {
+			t.Errorf("Expected %v, got %v", want, e)
+		}
+	}
+
+	err = s.WriteFrame(make([]byte, FrameBytes))
+	if err == nil || strings.Contains(err.Error(), "refused") == false {
+		t.Errorf("Expected the sender to give up with the reconnect error, got %v", err)
+	}
+	if a.IsConnected() {
+		t.Error("Expected to be disconnected")
+	}
+}
@@ -0,0 +1,138 @@
+//
+// Now playing information for receivers with a screen, sent with
+// SET_PARAMETER while a session is up. Devices list what they'll show in the
+// md TXT flag (see AirplayDevice.MetadataTypes):
+//
+// 0 - text: title, artist and album, as a DAAP listing item (mlit)
+// 1 - artwork: a JPEG or PNG
+// 2 - progress: "progress: start/current/end" in RTP timestamps
+//
+// Each comes with an RTP-Info header giving the RTP timestamp it goes with,
+// so the receiver can show it when that audio plays:
+//
+//	RTP-Info: rtptime=1146549156
+//
+// http://nto.github.io/AirPlay.html#audio-metadata
+//
+
+package airplay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Kinds of metadata, numbered the same as the md TXT flag
+const (
+	MetadataText     = 0
+	MetadataArtwork  = 1
+	MetadataProgress = 2
+)
+
+var (
+	ErrMetadataUnsupported = errors.New("Airplay device does not show this kind of metadata")
+	ErrUnsupportedImage    = errors.New("Artwork must be a JPEG or PNG")
+)
+
+// What's playing
+type Track struct {
+	Title  string
+	Artist string
+	Album  string
+}
+
+// Show what's playing
+func (a *Airplay) SetMetadata(track Track) (err error) {
+	return a.SetMetadataContext(context.Background(), track)
+}
+
+// Like SetMetadata, but gives up if ctx is done first
+func (a *Airplay) SetMetadataContext(ctx context.Context, track Track) (err error) {
+	item := []DAAPTag{
+		{"mlit", []DAAPTag{
+			{"minm", track.Title},
+			{"asar", track.Artist},
+			{"asal", track.Album},
+		}},
+	}
+
+	encoded, err := DAAPEncode(item)
+	if err != nil {
+		return err
+	}
+
+	return a.setParameter(ctx, MetadataText, "application/x-dmap-tagged", string(encoded))
+}
+
+// Show cover art. image is a JPEG or PNG, or nil to clear it
+func (a *Airplay) SetArtwork(image []byte) (err error) {
+	return a.SetArtworkContext(context.Background(), image)
+}
+
+// Like SetArtwork, but gives up if ctx is done first
+func (a *Airplay) SetArtworkContext(ctx context.Context, image []byte) (err error) {
+	contentType := "image/none"
+	if len(image) > 0 {
+		contentType = http.DetectContentType(image)
+		if contentType != "image/jpeg" && contentType != "image/png" {
+			return ErrUnsupportedImage
+		}
+	}
+
+	return a.setParameter(ctx, MetadataArtwork, contentType, string(image))
+}
+
+// Show how far through the track we are. All three are RTP timestamps: where the track started, where it
+// is now (see AudioSender.Timestamp), and where it will end
+func (a *Airplay) SetProgress(start, current, end uint32) (err error) {
+	return a.SetProgressContext(context.Background(), start, current, end)
+}
+
+// Like SetProgress, but gives up if ctx is done first
+func (a *Airplay) SetProgressContext(ctx context.Context, start, current, end uint32) (err error) {
+	return a.setParameter(ctx, MetadataProgress, "text/parameters", fmt.Sprintf("progress: %d/%d/%d\r\n", start, current, end))
+}
+
+// Send a kind of metadata with SET_PARAMETER, if the device shows it, at the stream's current RTP timestamp
+func (a *Airplay) setParameter(ctx context.Context, kind int, contentType string, body string) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.url == "" {
+		return ErrNoSession
+	}
+
+	if a.acceptsMetadata(kind) == false {
+		return ErrMetadataUnsupported
+	}
+
+	// Where in the stream it goes with: where the sender has got to, or where we started playing
+	rtptime := a.recordTime
+	if a.sender != nil {
+		rtptime = a.sender.Timestamp()
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", contentType)
+	headers.Set("RTP-Info", fmt.Sprintf("rtptime=%d", rtptime))
+
+	_, err = a.sessionRequest(ctx, "SET_PARAMETER", headers, body)
+	return err
+}
+
+// Whether the device said it shows this kind of metadata. If we don't know what the device is, we just try
+func (a *Airplay) acceptsMetadata(kind int) bool {
+	if a.metadataTypes == nil {
+		return true
+	}
+
+	for _, t := range a.metadataTypes {
+		if t == kind {
+			return true
+		}
+	}
+
+	return false
+}
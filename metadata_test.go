@@ -0,0 +1,152 @@
+package airplay
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSetMetadata(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if a.SetMetadata(Track{}) != ErrNoSession {
+		t.Error("Expected ErrNoSession before ANNOUNCE")
+	}
+
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.NewAudioSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = a.Record(s.Seq(), s.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	err = a.SetMetadata(Track{Title: "Hey Jude", Artist: "The Beatles", Album: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rtpInfo := fmt.Sprintf("rtptime=%d", s.Timestamp())
+	req := receiver.Requests("SET_PARAMETER")[0]
+	if req.Header.Get("Content-Type") != "application/x-dmap-tagged" {
+		t.Errorf("Unexpected content type: %s", req.Header.Get("Content-Type"))
+	}
+	if req.Header.Get("RTP-Info") != rtpInfo {
+		t.Errorf("Expected %s, got %s", rtpInfo, req.Header.Get("RTP-Info"))
+	}
+
+	item, ok := DAAPParse(req.Body)["mlit"].(map[string]interface{})
+	if ok == false {
+		t.Fatal("mlit tag not found")
+	}
+	if item["minm"] != "Hey Jude" || item["asar"] != "The Beatles" || item["asal"] != "1" {
+		t.Errorf("Unexpected track: %v", item)
+	}
+
+	////////
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	artwork := []struct {
+		image       []byte
+		contentType string
+	}{
+		{png, "image/png"},
+		{jpeg, "image/jpeg"},
+		{nil, "image/none"},
+	}
+
+	for i, art := range artwork {
+		err = a.SetArtwork(art.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = receiver.Requests("SET_PARAMETER")[1+i]
+		if req.Header.Get("Content-Type") != art.contentType {
+			t.Errorf("Expected %s, got %s", art.contentType, req.Header.Get("Content-Type"))
+		}
+		if string(req.Body) != string(art.image) {
+			t.Errorf("Artwork %d didn't arrive intact", i)
+		}
+		if req.Header.Get("RTP-Info") != rtpInfo {
+			t.Errorf("Expected %s, got %s", rtpInfo, req.Header.Get("RTP-Info"))
+		}
+	}
+
+	if a.SetArtwork([]byte("GIF89a")) != ErrUnsupportedImage {
+		t.Error("Expected ErrUnsupportedImage for a GIF")
+	}
+
+	////////
+	err = a.SetProgress(1000, 45100, 1000+44100*180)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = receiver.Requests("SET_PARAMETER")[4]
+	if string(req.Body) != "progress: 1000/45100/7939000\r\n" || req.Header.Get("Content-Type") != "text/parameters" {
+		t.Errorf("Unexpected progress: %s %q", req.Header.Get("Content-Type"), req.Body)
+	}
+	if req.Header.Get("RTP-Info") != rtpInfo {
+		t.Errorf("Expected %s, got %s", rtpInfo, req.Header.Get("RTP-Info"))
+	}
+}
+
+func TestMetadataTypes(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	device := AirplayDevice{
+		IP:    receiver.IP(),
+		Port:  receiver.Port(),
+		Flags: map[string]string{"md": "0,2"},
+	}
+	a, err := DialDevice(device, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	if err = a.SetMetadata(Track{Title: "Hey Jude"}); err != nil {
+		t.Errorf("Expected text to be accepted, got %v", err)
+	}
+	if err = a.SetProgress(0, 0, 0); err != nil {
+		t.Errorf("Expected progress to be accepted, got %v", err)
+	}
+	if err = a.SetArtwork(nil); err != ErrMetadataUnsupported {
+		t.Errorf("Expected ErrMetadataUnsupported for artwork, got %v", err)
+	}
+
+	if len(receiver.Requests("SET_PARAMETER")) != 2 {
+		t.Errorf("Expected 2 SET_PARAMETERs, got %d", len(receiver.Requests("SET_PARAMETER")))
+	}
+
+	// A device without md shows nothing
+	a.metadataTypes = (&AirplayDevice{}).MetadataTypes()
+	if err = a.SetMetadata(Track{}); err != ErrMetadataUnsupported {
+		t.Errorf("Expected ErrMetadataUnsupported without md, got %v", err)
+	}
+}
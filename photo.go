@@ -0,0 +1,300 @@
+//
+// AirPlay photos and slideshows. A photo is PUT as a JPEG, with a key the
+// receiver can remember it by and how to move to it from what's on screen:
+//
+//	PUT /photo HTTP/1.1
+//	X-Apple-AssetKey: F92F9B91-954E-4D63-BB9A-EEC771ADE6E8
+//	X-Apple-Transition: Dissolve
+//
+// With X-Apple-AssetAction: cacheOnly the receiver keeps the photo without
+// showing it, and with displayCached (and no body) it shows one it kept.
+//
+// A slideshow is started with a plist of settings. The receiver then asks
+// for each image over the reverse connection, see events.go:
+//
+//	PUT /slideshows/1 HTTP/1.1
+//	Content-Type: text/x-apple-plist+xml
+//
+//	<dict>
+//		<key>settings</key>
+//		<dict>
+//			<key>slideDuration</key>
+//			<integer>3</integer>
+//			<key>theme</key>
+//			<string>Classic</string>
+//		</dict>
+//		<key>state</key>
+//		<string>playing</string>
+//	</dict>
+//
+//	GET /slideshows/1/assets/1 HTTP/1.1
+//
+// which we answer with a binary plist of the image and its number.
+//
+// http://nto.github.io/AirPlay.html#photos
+// http://nto.github.io/AirPlay.html#slideshows
+//
+
+package airplay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/grantmd/go-airplay/plist"
+	"github.com/nu7hatch/gouuid"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"sync"
+)
+
+// Transitions for ShowPhoto
+const (
+	TransitionNone       = "None"
+	TransitionDissolve   = "Dissolve"
+	TransitionSlideLeft  = "SlideLeft"
+	TransitionSlideRight = "SlideRight"
+)
+
+var (
+	ErrPhotoNotCached = errors.New("Airplay server doesn't have that photo cached")
+)
+
+// What to send plists as. Receivers ask for slideshow images as binary plists
+const (
+	plistContentType       = "text/x-apple-plist+xml"
+	binaryPlistContentType = "application/x-apple-binary-plist"
+)
+
+// A look for slideshows, from SlideshowFeatures
+type SlideshowTheme struct {
+	Key  string `plist:"key"`  // What to pass to StartSlideshow, like "Classic"
+	Name string `plist:"name"` // What to show people
+}
+
+// Show a JPEG on the receiver, moving to it with transition
+func (a *Airplay) ShowPhoto(r io.Reader, transition string) (err error) {
+	return a.ShowPhotoContext(context.Background(), r, transition)
+}
+
+// Like ShowPhoto, but gives up if ctx is done first
+func (a *Airplay) ShowPhotoContext(ctx context.Context, r io.Reader, transition string) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	key, err := newAssetKey()
+	if err != nil {
+		return err
+	}
+
+	return a.putPhoto(ctx, key, "", transition, r)
+}
+
+// Send a JPEG to the receiver without showing it, so ShowCachedPhoto can show it straight away later. Returns
+// the key to show it by
+func (a *Airplay) CachePhoto(r io.Reader) (key string, err error) {
+	return a.CachePhotoContext(context.Background(), r)
+}
+
+// Like CachePhoto, but gives up if ctx is done first
+func (a *Airplay) CachePhotoContext(ctx context.Context, r io.Reader) (key string, err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	key, err = newAssetKey()
+	if err != nil {
+		return key, err
+	}
+
+	return key, a.putPhoto(ctx, key, "cacheOnly", "", r)
+}
+
+// Show a photo sent earlier with CachePhoto. Returns ErrPhotoNotCached if the receiver has forgotten it
+func (a *Airplay) ShowCachedPhoto(key string, transition string) (err error) {
+	return a.ShowCachedPhotoContext(context.Background(), key, transition)
+}
+
+// Like ShowCachedPhoto, but gives up if ctx is done first
+func (a *Airplay) ShowCachedPhotoContext(ctx context.Context, key string, transition string) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	return a.putPhoto(ctx, key, "displayCached", transition, nil)
+}
+
+// PUT /photo. action and transition are left out if they're empty. Call with the lock held
+func (a *Airplay) putPhoto(ctx context.Context, key string, action string, transition string, r io.Reader) (err error) {
+	headers := make(http.Header)
+	headers.Set("X-Apple-AssetKey", key)
+	if action != "" {
+		headers.Set("X-Apple-AssetAction", action)
+	}
+	if transition != "" {
+		headers.Set("X-Apple-Transition", transition)
+	}
+
+	_, err = a.airplayRequest(ctx, "PUT", "/photo", headers, r)
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusPreconditionFailed {
+		return ErrPhotoNotCached
+	}
+
+	return err
+}
+
+func newAssetKey() (key string, err error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return key, err
+	}
+
+	return u.String(), nil
+}
+
+// Ask the receiver which slideshow themes it has
+func (a *Airplay) SlideshowFeatures() (themes []SlideshowTheme, err error) {
+	return a.SlideshowFeaturesContext(context.Background())
+}
+
+// Like SlideshowFeatures, but gives up if ctx is done first
+func (a *Airplay) SlideshowFeaturesContext(ctx context.Context) (themes []SlideshowTheme, err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	resp, err := a.airplayRequest(ctx, "GET", "/slideshow-features", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var features struct {
+		Themes []SlideshowTheme `plist:"themes"`
+	}
+	err = plist.Unmarshal(body, &features)
+	if err != nil {
+		return nil, err
+	}
+
+	return features.Themes, nil
+}
+
+// Start a slideshow in theme, showing each image for slideDuration seconds. The receiver asks for images as
+// it needs them, and next is called for each one from the reverse connection's goroutine. If next returns an
+// error, the receiver is told there are no more. Opens the reverse connection if StartEvents hasn't
+func (a *Airplay) StartSlideshow(theme string, slideDuration int, next func() (image []byte, err error)) (err error) {
+	return a.StartSlideshowContext(context.Background(), theme, slideDuration, next)
+}
+
+// Like StartSlideshow, but gives up if ctx is done first
+func (a *Airplay) StartSlideshowContext(ctx context.Context, theme string, slideDuration int, next func() (image []byte, err error)) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.reverseConn == nil {
+		err = a.openReverse(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.slideshow.start(next)
+
+	err = a.putSlideshow(ctx, map[string]interface{}{
+		"settings": map[string]interface{}{
+			"slideDuration": slideDuration,
+			"theme":         theme,
+		},
+		"state": "playing",
+	})
+	if err != nil {
+		a.slideshow.start(nil)
+	}
+
+	return err
+}
+
+// Stop the slideshow
+func (a *Airplay) StopSlideshow() (err error) {
+	return a.StopSlideshowContext(context.Background())
+}
+
+// Like StopSlideshow, but gives up if ctx is done first
+func (a *Airplay) StopSlideshowContext(ctx context.Context) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.slideshow != nil {
+		a.slideshow.start(nil)
+	}
+
+	return a.putSlideshow(ctx, map[string]interface{}{
+		"state": "stopped",
+	})
+}
+
+// PUT /slideshows/1 with a plist of params. Call with the lock held
+func (a *Airplay) putSlideshow(ctx context.Context, params map[string]interface{}) (err error) {
+	body, err := plist.Marshal(params, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", plistContentType)
+
+	_, err = a.airplayRequest(ctx, "PUT", "/slideshows/1", headers, bytes.NewReader(body))
+	return err
+}
+
+// Where a running slideshow's images come from. It outlives each reverse connection, so a slideshow carries on
+// after reconnecting
+type slideshow struct {
+	lock   sync.Mutex
+	next   func() (image []byte, err error) // nil when there's no slideshow
+	assets int                              // How many images we've handed out
+}
+
+// Take images from next from now on, or stop if it's nil
+func (s *slideshow) start(next func() (image []byte, err error)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.next = next
+	s.assets = 0
+}
+
+// Answer the receiver's request for the next image
+func (s *slideshow) answerAsset(conn *textproto.Conn) (err error) {
+	s.lock.Lock()
+	next := s.next
+	s.assets++
+	id := s.assets
+	s.lock.Unlock()
+
+	if next == nil {
+		return writeReverseResponse(conn, "404 Not Found", "", nil)
+	}
+
+	image, err := next()
+	if err != nil {
+		return writeReverseResponse(conn, "404 Not Found", "", nil)
+	}
+
+	body, err := plist.Marshal(map[string]interface{}{
+		"data": image,
+		"info": map[string]interface{}{
+			"id":  id,
+			"key": id,
+		},
+	}, plist.BinaryFormat)
+	if err != nil {
+		return err
+	}
+
+	return writeReverseResponse(conn, "200 OK", binaryPlistContentType, body)
+}
@@ -0,0 +1,276 @@
+package airplay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/grantmd/go-airplay/plist"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShowPhoto(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.ShowPhoto(strings.NewReader("not really a jpeg"), TransitionDissolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ShowPhoto(strings.NewReader("another"), TransitionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	puts := receiver.Requests("PUT")
+	if len(puts) != 2 {
+		t.Fatalf("Expected 2 PUTs, got %d", len(puts))
+	}
+
+	req := puts[0]
+	if req.URI != "/photo" || req.Proto != "HTTP/1.1" || string(req.Body) != "not really a jpeg" {
+		t.Errorf("Unexpected request: %s %s %q", req.URI, req.Proto, req.Body)
+	}
+	if req.Header.Get("X-Apple-Transition") != "Dissolve" || req.Header.Get("X-Apple-AssetAction") != "" {
+		t.Errorf("Unexpected headers: %v", req.Header)
+	}
+	if len(req.Header.Get("X-Apple-AssetKey")) != 36 || req.Header.Get("X-Apple-AssetKey") == puts[1].Header.Get("X-Apple-AssetKey") {
+		t.Errorf("Expected a new asset key for each photo, got %s and %s", req.Header.Get("X-Apple-AssetKey"), puts[1].Header.Get("X-Apple-AssetKey"))
+	}
+}
+
+func TestCachedPhoto(t *testing.T) {
+	var lock sync.Mutex
+	cached := make(map[string]string)
+
+	receiver := startTestReceiver(t, func(req *testRequest) *testResponse {
+		lock.Lock()
+		defer lock.Unlock()
+
+		key := req.Header.Get("X-Apple-AssetKey")
+		switch req.Header.Get("X-Apple-AssetAction") {
+		case "cacheOnly":
+			cached[key] = string(req.Body)
+			break
+		case "displayCached":
+			if _, ok := cached[key]; ok == false {
+				return &testResponse{StatusCode: 412, Status: "412 Precondition Failed"}
+			}
+			break
+		}
+
+		return nil
+	})
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	key, err := a.CachePhoto(strings.NewReader("for later"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if cached[key] != "for later" {
+		t.Errorf("Expected the photo to be cached as %s, got %v", key, cached)
+	}
+	lock.Unlock()
+
+	err = a.ShowCachedPhoto(key, TransitionSlideLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	puts := receiver.Requests("PUT")
+	show := puts[len(puts)-1]
+	if show.Header.Get("X-Apple-AssetKey") != key || show.Header.Get("X-Apple-Transition") != "SlideLeft" || len(show.Body) != 0 {
+		t.Errorf("Unexpected request: %v %q", show.Header, show.Body)
+	}
+
+	err = a.ShowCachedPhoto("F92F9B91-954E-4D63-BB9A-EEC771ADE6E8", TransitionNone)
+	if err != ErrPhotoNotCached {
+		t.Errorf("Expected ErrPhotoNotCached, got %v", err)
+	}
+}
+
+func TestSlideshowFeatures(t *testing.T) {
+	receiver := startTestReceiver(t, func(req *testRequest) *testResponse {
+		if req.URI != "/slideshow-features" {
+			return nil
+		}
+
+		return &testResponse{
+			StatusCode: 200,
+			Body: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>themes</key>
+	<array>
+		<dict>
+			<key>key</key>
+			<string>Reflections</string>
+			<key>name</key>
+			<string>Reflections</string>
+		</dict>
+		<dict>
+			<key>key</key>
+			<string>KenBurns</string>
+			<key>name</key>
+			<string>Ken Burns</string>
+		</dict>
+	</array>
+</dict>
+</plist>`),
+		}
+	})
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	themes, err := a.SlideshowFeatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(themes) != 2 || themes[1] != (SlideshowTheme{Key: "KenBurns", Name: "Ken Burns"}) {
+		t.Errorf("Unexpected themes: %v", themes)
+	}
+}
+
+// What we answered the receiver's request for an image with
+type testAsset struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+func TestSlideshow(t *testing.T) {
+	started := make(chan struct{})
+	assets := make(chan testAsset, 10)
+
+	receiver := startReversingTestReceiver(t, func(req *testRequest) *testResponse {
+		if req.URI == "/reverse" {
+			return &testResponse{StatusCode: 101, Status: "101 Switching Protocols", Header: map[string]string{"Upgrade": "PTTH/1.0", "Connection": "Upgrade"}}
+		}
+		if req.URI == "/slideshows/1" && strings.Contains(string(req.Body), "playing") {
+			close(started)
+		}
+		return nil
+	}, func(conn net.Conn, reader *bufio.Reader) {
+		// Once the slideshow has started, ask for images until there aren't any more
+		<-started
+		for i := 1; i <= 3; i++ {
+			_, err := io.WriteString(conn, testEventRequest("GET", "/slideshows/1/assets/"+strconv.Itoa(i), ""))
+			if err != nil {
+				return
+			}
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			assets <- testAsset{resp.StatusCode, resp.Header.Get("Content-Type"), body}
+		}
+	})
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	images := []string{"first", "second"}
+	err = a.StartSlideshow("Classic", 3, func() (image []byte, err error) {
+		if len(images) == 0 {
+			return nil, errors.New("No more")
+		}
+		image = []byte(images[0])
+		images = images[1:]
+		return image, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := receiver.Requests("PUT")[0]
+	if put.Header.Get("Content-Type") != "text/x-apple-plist+xml" {
+		t.Errorf("Unexpected content type: %s", put.Header.Get("Content-Type"))
+	}
+	var params map[string]interface{}
+	err = plist.Unmarshal(put.Body, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, _ := params["settings"].(map[string]interface{})
+	if settings["slideDuration"] != int64(3) || settings["theme"] != "Classic" {
+		t.Errorf("Unexpected settings: %s", put.Body)
+	}
+
+	////////
+	for i, expected := range []string{"first", "second"} {
+		var asset testAsset
+		select {
+		case asset = <-assets:
+			break
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for an image")
+		}
+
+		if asset.StatusCode != 200 {
+			t.Fatalf("Expected 200, got %d", asset.StatusCode)
+		}
+		if asset.ContentType != "application/x-apple-binary-plist" || bytes.HasPrefix(asset.Body, []byte("bplist00")) == false {
+			t.Errorf("Expected a binary plist, got %s %q", asset.ContentType, asset.Body)
+		}
+		var dict map[string]interface{}
+		err = plist.Unmarshal(asset.Body, &dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := dict["info"].(map[string]interface{})
+		if data, _ := dict["data"].([]byte); string(data) != expected || info["id"] != int64(i+1) || info["key"] != int64(i+1) {
+			t.Errorf("Expected %s as number %d, got %s", expected, i+1, asset.Body)
+		}
+	}
+
+	select {
+	case asset := <-assets:
+		if asset.StatusCode != 404 {
+			t.Errorf("Expected 404 once we ran out, got %d", asset.StatusCode)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an answer")
+	}
+
+	////////
+	err = a.StopSlideshow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	puts := receiver.Requests("PUT")
+	if len(puts) != 2 || strings.Contains(string(puts[1].Body), "<string>stopped</string>") == false {
+		t.Errorf("Expected the slideshow to be stopped, got %d PUTs", len(puts))
+	}
+}
@@ -0,0 +1,571 @@
+//
+// Binary property lists. After the "bplist00" magic come the objects, each
+// starting with a marker byte: the high four bits say what it is, and the
+// low four how long it is, or 15 if the length is an integer object that
+// follows. Then an offset table saying where each object starts, and a
+// 32 byte trailer:
+//
+//	0x08, 0x09    - false, true
+//	0x1n          - integer of 2^n bytes, big endian
+//	0x2n          - real of 2^n bytes
+//	0x33          - date, as a real number of seconds since 2001
+//	0x4n          - n bytes of data
+//	0x5n          - ASCII string of n characters
+//	0x6n          - UTF-16 string of n characters
+//	0x8n          - UID of n+1 bytes, which we treat as an integer
+//	0xAn          - array of n objects, by reference
+//	0xDn          - dict of n keys then n values, by reference
+//
+// References are indexes into the offset table. The trailer has the size
+// of offsets and references, how many objects there are, which is the top
+// one, and where the offset table starts.
+//
+
+package plist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	binaryMagic   = "bplist00"
+	trailerLength = 32
+
+	// Objects can be referenced from more than one place, and we decode them again each time. Writers share
+	// keys and small values that way, but arrays that all point at the next one double with each step, so
+	// we stop once we've decoded this many times more objects than the plist has
+	maxSharing = 32
+)
+
+// Where dates count from
+var binaryEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+////////
+// Decoding
+
+type binaryDecoder struct {
+	data     []byte
+	limit    uint64   // Where the offset table starts. Objects have to end before it
+	offsets  []uint64 // Where each object starts
+	refSize  uint64
+	visiting map[uint64]bool // The arrays and dicts we're inside, so one that contains itself can't loop forever
+	decoded  uint64          // How many objects we've decoded so far, counting shared ones each time
+	max      uint64          // How many we'll decode before giving up, see maxSharing
+}
+
+func decodeBinary(data []byte) (v interface{}, err error) {
+	if len(data) < len(binaryMagic)+trailerLength || bytes.HasPrefix(data, []byte(binaryMagic)) == false {
+		return nil, ErrInvalid
+	}
+
+	trailer := data[len(data)-trailerLength:]
+	offsetSize := uint64(trailer[6])
+	refSize := uint64(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:16])
+	top := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+
+	tableEnd := uint64(len(data) - trailerLength)
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 {
+		return nil, ErrInvalid
+	}
+	if numObjects == 0 || top >= numObjects || tableOffset < uint64(len(binaryMagic)) || tableOffset > tableEnd {
+		return nil, ErrInvalid
+	}
+	if numObjects > (tableEnd-tableOffset)/offsetSize {
+		return nil, ErrInvalid
+	}
+
+	d := &binaryDecoder{
+		data:     data,
+		limit:    tableOffset,
+		offsets:  make([]uint64, numObjects),
+		refSize:  refSize,
+		visiting: make(map[uint64]bool),
+		max:      numObjects * maxSharing,
+	}
+
+	for i := range d.offsets {
+		start := tableOffset + uint64(i)*offsetSize
+		d.offsets[i] = readUint(data[start : start+offsetSize])
+		if d.offsets[i] < uint64(len(binaryMagic)) || d.offsets[i] >= tableOffset {
+			return nil, ErrInvalid
+		}
+	}
+
+	return d.object(top)
+}
+
+// Read a big endian unsigned integer of up to 8 bytes
+func readUint(b []byte) (n uint64) {
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+
+	return n
+}
+
+// The n bytes at off, if they're all before the offset table
+func (d *binaryDecoder) bytes(off uint64, n uint64) ([]byte, error) {
+	if off > d.limit || n > d.limit-off {
+		return nil, ErrInvalid
+	}
+
+	return d.data[off : off+n], nil
+}
+
+// Decode the object with reference ref
+func (d *binaryDecoder) object(ref uint64) (v interface{}, err error) {
+	if ref >= uint64(len(d.offsets)) || d.visiting[ref] {
+		return nil, ErrInvalid
+	}
+
+	d.decoded++
+	if d.decoded > d.max {
+		return nil, ErrInvalid
+	}
+
+	off := d.offsets[ref]
+	marker := d.data[off]
+	info := marker & 0x0F
+
+	switch marker >> 4 {
+	case 0x0:
+		if marker == 0x08 {
+			return false, nil
+		} else if marker == 0x09 {
+			return true, nil
+		}
+		break
+
+	case 0x1:
+		if info > 4 {
+			break
+		}
+		b, err := d.bytes(off+1, 1<<info)
+		if err != nil {
+			return nil, err
+		}
+		return binaryInt(b), nil
+
+	case 0x2:
+		if info == 2 {
+			b, err := d.bytes(off+1, 4)
+			if err != nil {
+				return nil, err
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		} else if info == 3 {
+			b, err := d.bytes(off+1, 8)
+			if err != nil {
+				return nil, err
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+		break
+
+	case 0x3:
+		if info != 3 {
+			break
+		}
+		b, err := d.bytes(off+1, 8)
+		if err != nil {
+			return nil, err
+		}
+		return binaryDate(math.Float64frombits(binary.BigEndian.Uint64(b)))
+
+	case 0x4:
+		n, start, err := d.length(off, info)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.bytes(start, n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+
+	case 0x5:
+		n, start, err := d.length(off, info)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.bytes(start, n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+
+	case 0x6:
+		n, start, err := d.length(off, info)
+		if err != nil {
+			return nil, err
+		}
+		if n > d.limit/2 {
+			return nil, ErrInvalid
+		}
+		b, err := d.bytes(start, n*2)
+		if err != nil {
+			return nil, err
+		}
+		units := make([]uint16, n)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(b[i*2:])
+		}
+		return string(utf16.Decode(units)), nil
+
+	case 0x8:
+		b, err := d.bytes(off+1, uint64(info)+1)
+		if err != nil || len(b) > 8 {
+			return nil, ErrInvalid
+		}
+		return int64(readUint(b)), nil
+
+	case 0xA:
+		refs, err := d.refs(off, info, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		d.visiting[ref] = true
+		defer delete(d.visiting, ref)
+
+		array := make([]interface{}, len(refs))
+		for i, r := range refs {
+			array[i], err = d.object(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+
+	case 0xD:
+		refs, err := d.refs(off, info, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		d.visiting[ref] = true
+		defer delete(d.visiting, ref)
+
+		n := len(refs) / 2
+		dict := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			key, err := d.object(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if ok == false {
+				return nil, ErrInvalid
+			}
+
+			dict[name], err = d.object(refs[n+i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	}
+
+	return nil, ErrInvalid
+}
+
+// An integer object's value. 8 byte integers are signed, smaller ones aren't, and 16 byte ones are
+// for unsigned values too big for 8
+func binaryInt(b []byte) interface{} {
+	if len(b) == 16 {
+		n := readUint(b[8:])
+		if n > math.MaxInt64 {
+			return n
+		}
+		return int64(n)
+	}
+
+	return int64(readUint(b))
+}
+
+func binaryDate(seconds float64) (t time.Time, err error) {
+	// Far enough either way for anyone, and not so far that it overflows
+	if math.IsNaN(seconds) || math.Abs(seconds) > 1e15 {
+		return t, ErrInvalid
+	}
+
+	whole := math.Floor(seconds)
+	return time.Unix(binaryEpoch.Unix()+int64(whole), int64((seconds-whole)*1e9)).UTC(), nil
+}
+
+// How long a data, string, array or dict object is, and where what's in it starts
+func (d *binaryDecoder) length(off uint64, info byte) (n uint64, start uint64, err error) {
+	if info != 0x0F {
+		return uint64(info), off + 1, nil
+	}
+
+	b, err := d.bytes(off+1, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if b[0]>>4 != 0x1 || b[0]&0x0F > 3 {
+		return 0, 0, ErrInvalid
+	}
+
+	size := uint64(1) << (b[0] & 0x0F)
+	b, err = d.bytes(off+2, size)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return readUint(b), off + 2 + size, nil
+}
+
+// The references in an array (per 1) or dict (per 2, keys then values)
+func (d *binaryDecoder) refs(off uint64, info byte, per uint64) (refs []uint64, err error) {
+	n, start, err := d.length(off, info)
+	if err != nil {
+		return nil, err
+	}
+	if n > d.limit/d.refSize/per {
+		return nil, ErrInvalid
+	}
+
+	b, err := d.bytes(start, n*per*d.refSize)
+	if err != nil {
+		return nil, err
+	}
+
+	refs = make([]uint64, n*per)
+	for i := range refs {
+		refs[i] = readUint(b[uint64(i)*d.refSize : uint64(i+1)*d.refSize])
+	}
+
+	return refs, nil
+}
+
+////////
+// Encoding
+
+// An object to write. Arrays and dicts refer to the objects in them by index
+type binaryObject struct {
+	value  interface{} // Everything but arrays and dicts
+	marker byte        // 0xA for an array, 0xD for a dict
+	refs   []int       // What's in the array, or the dict's keys then its values
+}
+
+func encodeBinary(v interface{}) (data []byte, err error) {
+	var objects []binaryObject
+	_, err = flattenBinary(&objects, v)
+	if err != nil {
+		return nil, err
+	}
+
+	refSize := intSize(uint64(len(objects)))
+
+	var buffer bytes.Buffer
+	buffer.WriteString(binaryMagic)
+
+	offsets := make([]uint64, len(objects))
+	for i, object := range objects {
+		offsets[i] = uint64(buffer.Len())
+
+		if object.marker != 0 {
+			n := len(object.refs)
+			if object.marker == 0xD {
+				n /= 2
+			}
+			writeLength(&buffer, object.marker, n)
+			for _, ref := range object.refs {
+				writeSized(&buffer, uint64(ref), refSize)
+			}
+			continue
+		}
+
+		writeBinaryValue(&buffer, object.value)
+	}
+
+	tableOffset := uint64(buffer.Len())
+	offsetSize := intSize(tableOffset)
+	for _, offset := range offsets {
+		writeSized(&buffer, offset, offsetSize)
+	}
+
+	trailer := make([]byte, trailerLength)
+	trailer[6] = byte(offsetSize)
+	trailer[7] = byte(refSize)
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(objects)))
+	binary.BigEndian.PutUint64(trailer[16:], 0) // The top object is always the first
+	binary.BigEndian.PutUint64(trailer[24:], tableOffset)
+	buffer.Write(trailer)
+
+	return buffer.Bytes(), nil
+}
+
+// Add v and everything in it to objects, returning v's index
+func flattenBinary(objects *[]binaryObject, v interface{}) (ref int, err error) {
+	ref = len(*objects)
+	*objects = append(*objects, binaryObject{value: v})
+
+	switch value := v.(type) {
+	case []interface{}:
+		refs := make([]int, len(value))
+		for i, item := range value {
+			refs[i], err = flattenBinary(objects, item)
+			if err != nil {
+				return ref, err
+			}
+		}
+		(*objects)[ref] = binaryObject{marker: 0xA, refs: refs}
+		break
+
+	case map[string]interface{}:
+		keys := sortedKeys(value)
+		refs := make([]int, len(keys)*2)
+		for i, key := range keys {
+			refs[i], err = flattenBinary(objects, key)
+			if err != nil {
+				return ref, err
+			}
+		}
+		for i, key := range keys {
+			refs[len(keys)+i], err = flattenBinary(objects, value[key])
+			if err != nil {
+				return ref, err
+			}
+		}
+		(*objects)[ref] = binaryObject{marker: 0xD, refs: refs}
+		break
+
+	case string, int64, uint64, float64, bool, time.Time, []byte:
+		break
+
+	default:
+		return ref, ErrUnsupportedType
+	}
+
+	return ref, nil
+}
+
+func writeBinaryValue(buffer *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case bool:
+		if value {
+			buffer.WriteByte(0x09)
+		} else {
+			buffer.WriteByte(0x08)
+		}
+		break
+
+	case int64:
+		if value < 0 {
+			// Negative numbers are always 8 bytes
+			buffer.WriteByte(0x13)
+			writeSized(buffer, uint64(value), 8)
+		} else {
+			writeUint(buffer, uint64(value))
+		}
+		break
+
+	case uint64:
+		writeUint(buffer, value)
+		break
+
+	case float64:
+		buffer.WriteByte(0x23)
+		writeSized(buffer, math.Float64bits(value), 8)
+		break
+
+	case time.Time:
+		seconds := float64(value.Unix()-binaryEpoch.Unix()) + float64(value.Nanosecond())/1e9
+		buffer.WriteByte(0x33)
+		writeSized(buffer, math.Float64bits(seconds), 8)
+		break
+
+	case []byte:
+		writeLength(buffer, 0x4, len(value))
+		buffer.Write(value)
+		break
+
+	case string:
+		ascii := true
+		for i := 0; i < len(value); i++ {
+			if value[i] >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+
+		if ascii {
+			writeLength(buffer, 0x5, len(value))
+			buffer.WriteString(value)
+		} else {
+			units := utf16.Encode([]rune(value))
+			writeLength(buffer, 0x6, len(units))
+			for _, unit := range units {
+				writeSized(buffer, uint64(unit), 2)
+			}
+		}
+		break
+	}
+}
+
+// Write a marker with a length, putting the length in an integer object after it if it doesn't fit
+func writeLength(buffer *bytes.Buffer, kind byte, n int) {
+	if n < 15 {
+		buffer.WriteByte(kind<<4 | byte(n))
+		return
+	}
+
+	buffer.WriteByte(kind<<4 | 0x0F)
+	writeUint(buffer, uint64(n))
+}
+
+// Write a non-negative integer object, in as few bytes as it fits in
+func writeUint(buffer *bytes.Buffer, n uint64) {
+	if n > math.MaxInt64 {
+		// 8 byte integers are signed, so this needs 16
+		buffer.WriteByte(0x14)
+		writeSized(buffer, 0, 8)
+		writeSized(buffer, n, 8)
+		return
+	}
+
+	size := intSize(n)
+	switch size {
+	case 1:
+		buffer.WriteByte(0x10)
+		break
+	case 2:
+		buffer.WriteByte(0x11)
+		break
+	case 4:
+		buffer.WriteByte(0x12)
+		break
+	case 8:
+		buffer.WriteByte(0x13)
+		break
+	}
+	writeSized(buffer, n, size)
+}
+
+// How many bytes n fits in: 1, 2, 4 or 8
+func intSize(n uint64) int {
+	if n <= math.MaxUint8 {
+		return 1
+	} else if n <= math.MaxUint16 {
+		return 2
+	} else if n <= math.MaxUint32 {
+		return 4
+	}
+
+	return 8
+}
+
+// Write the low size bytes of n, big endian
+func writeSized(buffer *bytes.Buffer, n uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		buffer.WriteByte(byte(n >> (uint(i) * 8)))
+	}
+}
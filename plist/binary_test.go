@@ -0,0 +1,219 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+)
+
+// Made by Python's plistlib, which does it the way CoreFoundation does
+const binaryFixture = "62706c6973743030db0102030405060708090a0b0c0d0e0f15161718191a1b536269675863617465676f727954646174615f10106c6f6164656454696d6552616e676573546e616d65586e656761746976655f1013706c61796261636b427566666572456d70747954726174655b7265616479546f506c61795973657373696f6e49445775706461746564120001117055766964656f4568656c6c6fa110d211121314586475726174696f6e557374617274234049c543c2d1bb0d2340321e6447a8353e6f103600430061006600e9002026150020002d002000610020006e0061006d00650020006c006f006e006700200065006e006f00750067006800200074006f0020006e00650065006400200061006e00200065007800740065006e0064006500640020006c0065006e00670074006813fffffffffffffffe08233fe000000000000009100d3341b8750ea50000000008001f0023002c00310044004900520068006d00790083008b00900096009c009e00a300ac00b200bb00c40133013c013d0146014701490000000000000201000000000000001c00000000000000000000000000000152"
+
+func TestDecodeBinary(t *testing.T) {
+	data, err := hex.DecodeString(binaryFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := decodeBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dict, ok := v.(map[string]interface{})
+	if ok == false {
+		t.Fatalf("Expected a dict, got %T", v)
+	}
+
+	if dict["category"] != "video" || dict["sessionID"] != int64(13) || dict["rate"] != 0.5 {
+		t.Errorf("Unexpected values: %v", dict)
+	}
+	if dict["negative"] != int64(-2) || dict["big"] != int64(70000) {
+		t.Errorf("Unexpected integers: %v %v", dict["negative"], dict["big"])
+	}
+	if dict["readyToPlay"] != true || dict["playbackBufferEmpty"] != false {
+		t.Errorf("Unexpected booleans: %v", dict)
+	}
+	if dict["name"] != "Café ☕ - a name long enough to need an extended length" {
+		t.Errorf("Unexpected string: %q", dict["name"])
+	}
+	if updated, _ := dict["updated"].(time.Time); updated.Equal(time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)) == false {
+		t.Errorf("Unexpected date: %v", dict["updated"])
+	}
+	if data, _ := dict["data"].([]byte); bytes.Equal(data, []byte("hello")) == false {
+		t.Errorf("Unexpected data: %v", dict["data"])
+	}
+
+	ranges, _ := dict["loadedTimeRanges"].([]interface{})
+	if len(ranges) != 1 {
+		t.Fatalf("Expected 1 time range, got %v", dict["loadedTimeRanges"])
+	}
+	if r, _ := ranges[0].(map[string]interface{}); r["duration"] != 51.541130402 || r["start"] != 18.11871765 {
+		t.Errorf("Unexpected time range: %v", ranges[0])
+	}
+}
+
+func TestEncodeBinary(t *testing.T) {
+	long := bytes.Repeat([]byte{0xAB}, 300)
+	values := []interface{}{
+		"short",
+		"Café ☕",
+		string(bytes.Repeat([]byte("x"), 20)),
+		int64(0),
+		int64(255),
+		int64(256),
+		int64(70000),
+		int64(math.MaxUint32) + 1,
+		int64(-1),
+		int64(math.MinInt64),
+		uint64(math.MaxUint64),
+		0.25,
+		math.Inf(-1),
+		true,
+		false,
+		time.Date(1999, 12, 31, 23, 59, 59, 500000000, time.UTC),
+		long,
+		[]interface{}{},
+		map[string]interface{}{},
+	}
+
+	for _, value := range values {
+		data, err := encodeBinary([]interface{}{value})
+		if err != nil {
+			t.Fatalf("Encoding %v: %v", value, err)
+		}
+
+		v, err := decodeBinary(data)
+		if err != nil {
+			t.Fatalf("Decoding %v: %v", value, err)
+		}
+
+		array, _ := v.([]interface{})
+		if len(array) != 1 {
+			t.Fatalf("Expected %v back, got %v", value, v)
+		}
+		switch expected := value.(type) {
+		case []byte:
+			if bytes.Equal(array[0].([]byte), expected) == false {
+				t.Errorf("Expected %v back, got %v", value, array[0])
+			}
+		case time.Time:
+			if array[0].(time.Time).Equal(expected) == false {
+				t.Errorf("Expected %v back, got %v", value, array[0])
+			}
+		case []interface{}:
+			if got, ok := array[0].([]interface{}); ok == false || len(got) != 0 {
+				t.Errorf("Expected an empty array back, got %v", array[0])
+			}
+		case map[string]interface{}:
+			if got, ok := array[0].(map[string]interface{}); ok == false || len(got) != 0 {
+				t.Errorf("Expected an empty dict back, got %v", array[0])
+			}
+		default:
+			if array[0] != value {
+				t.Errorf("Expected %v (%T) back, got %v (%T)", value, value, array[0], array[0])
+			}
+		}
+	}
+
+	// Enough objects that references need 2 bytes
+	many := make([]interface{}, 300)
+	for i := range many {
+		many[i] = int64(i)
+	}
+	data, err := encodeBinary(many)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[len(data)-trailerLength+7] != 2 {
+		t.Errorf("Expected 2 byte references, got %d", data[len(data)-trailerLength+7])
+	}
+	v, err := decodeBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if array := v.([]interface{}); len(array) != 300 || array[299] != int64(299) {
+		t.Errorf("Unexpected array back: %d items", len(array))
+	}
+}
+
+func TestDecodeInvalidBinary(t *testing.T) {
+	fixture, _ := hex.DecodeString(binaryFixture)
+
+	// A dict that contains itself: d1 00 00, then the trailer
+	loop, _ := hex.DecodeString("62706c6973743030d10000" + "08" +
+		"000000000000" + "0101" + "0000000000000001" + "0000000000000000" + "000000000000000b")
+
+	// An array that claims more than there is
+	short, _ := hex.DecodeString("62706c6973743030af12ffffffff" + "08" +
+		"000000000000" + "0101" + "0000000000000001" + "0000000000000000" + "000000000000000e")
+
+	// The top object is past the end of the offset table
+	top := append([]byte(nil), fixture...)
+	top[len(top)-9] = 0x7F
+
+	// An offset that points into the trailer
+	offset := append([]byte(nil), fixture...)
+	offset[len(offset)-trailerLength-1] = 0xFF
+
+	invalid := [][]byte{
+		[]byte("bplist00"),
+		fixture[:len(fixture)-1],
+		loop,
+		short,
+		top,
+		offset,
+		sharedArrays(40),
+	}
+
+	for _, data := range invalid {
+		_, err := decodeBinary(data)
+		if err != ErrInvalid {
+			t.Errorf("Expected ErrInvalid for %x, got %v", data, err)
+		}
+	}
+}
+
+// n arrays that each hold the next one twice, then false. Only n+1 objects, but 2^(n+1)-1 of them to decode
+func sharedArrays(n int) []byte {
+	data := []byte(binaryMagic)
+	offsets := make([]byte, 0, n+1)
+	for i := 0; i < n; i++ {
+		offsets = append(offsets, byte(len(data)))
+		data = append(data, 0xA2, byte(i+1), byte(i+1))
+	}
+	offsets = append(offsets, byte(len(data)))
+	data = append(data, 0x08)
+
+	tableOffset := len(data)
+	data = append(data, offsets...)
+
+	trailer := make([]byte, trailerLength)
+	trailer[6] = 1 // Offset size
+	trailer[7] = 1 // Reference size
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(n+1))
+	binary.BigEndian.PutUint64(trailer[24:32], uint64(tableOffset))
+
+	return append(data, trailer...)
+}
+
+func TestDecodeSharedBinary(t *testing.T) {
+	// A little sharing is fine, like writers do with keys and values
+	v, err := decodeBinary(sharedArrays(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if array, _ := v.([]interface{}); len(array) != 2 {
+		t.Errorf("Expected 2 items, got %v", v)
+	}
+
+	// But not a trillion times over
+	var big interface{}
+	err = Unmarshal(sharedArrays(40), &big)
+	if err != ErrInvalid {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+}
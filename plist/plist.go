@@ -0,0 +1,435 @@
+//
+// Apple property lists, which AirPlay uses for server info, playback info,
+// events and slideshows. Both kinds are supported: XML, and the binary
+// "bplist00" format.
+//
+// Values are dicts, arrays, strings, integers, reals, booleans, dates and
+// data. They go to and from Go values like encoding/json does it:
+//
+//	dict    - a struct, or a map with string keys
+//	array   - a slice
+//	string  - a string
+//	integer - any int or uint type, or a float type
+//	real    - a float type
+//	true    - a bool
+//	date    - a time.Time
+//	data    - a []byte
+//
+// Struct fields are matched by name, or by the name in a plist tag:
+//
+//	ReadyToPlay bool   `plist:"readyToPlay"`
+//	Theme       string `plist:"theme,omitempty"`
+//	Internal    int    `plist:"-"`
+//
+// Unmarshalling into an interface{} gives map[string]interface{},
+// []interface{}, string, int64 (or uint64 if it's too big), float64, bool,
+// time.Time or []byte.
+//
+// https://developer.apple.com/library/archive/documentation/Cocoa/Conceptual/PropertyLists/
+// https://opensource.apple.com/source/CF/CF-1153.18/CFBinaryPList.c
+//
+
+package plist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Formats for Marshal
+const (
+	XMLFormat = iota
+	BinaryFormat
+)
+
+var (
+	ErrInvalid         = errors.New("Invalid property list")
+	ErrUnsupportedType = errors.New("Value can't go in a property list")
+	ErrNotPointer      = errors.New("Can only unmarshal a property list into a non-nil pointer")
+)
+
+// Returned when a value in a property list doesn't fit where Unmarshal was going to put it
+type UnmarshalTypeError struct {
+	Value string       // What the plist had, like "string"
+	Type  reflect.Type // What we wanted to put it in
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("Can't unmarshal a plist %s into a Go value of type %s", e.Value, e.Type)
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	byteType = reflect.TypeOf([]byte(nil))
+)
+
+// Encode v as a property list in format, XMLFormat or BinaryFormat
+func Marshal(v interface{}, format int) (data []byte, err error) {
+	value, err := toPlist(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		// There's no such thing as an empty plist
+		return nil, ErrUnsupportedType
+	}
+
+	switch format {
+	case XMLFormat:
+		return encodeXML(value)
+	case BinaryFormat:
+		return encodeBinary(value)
+	}
+
+	return nil, fmt.Errorf("Unknown property list format %d", format)
+}
+
+// Decode a property list, XML or binary, into what v points to
+func Unmarshal(data []byte, v interface{}) (err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrNotPointer
+	}
+
+	var value interface{}
+	if bytes.HasPrefix(data, []byte(binaryMagic)) {
+		value, err = decodeBinary(data)
+	} else {
+		value, err = decodeXML(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return fromPlist(value, rv.Elem())
+}
+
+////////
+// Go values to plist values. nil means leave it out
+
+func toPlist(rv reflect.Value) (value interface{}, err error) {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.IsValid() == false {
+		return nil, nil
+	}
+
+	if rv.Type() == timeType {
+		return rv.Interface().(time.Time), nil
+	}
+	if rv.Type() == byteType {
+		return rv.Bytes(), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := rv.Uint()
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return rv.String(), nil
+
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, nil
+		}
+
+		array := make([]interface{}, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			item, err := toPlist(rv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			if item == nil {
+				// Arrays can't have holes
+				return nil, ErrUnsupportedType
+			}
+			array = append(array, item)
+		}
+		return array, nil
+
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, ErrUnsupportedType
+		}
+		if rv.IsNil() {
+			return nil, nil
+		}
+
+		dict := make(map[string]interface{}, rv.Len())
+		for _, key := range rv.MapKeys() {
+			item, err := toPlist(rv.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			if item != nil {
+				dict[key.String()] = item
+			}
+		}
+		return dict, nil
+
+	case reflect.Struct:
+		dict := make(map[string]interface{})
+		for _, f := range structFields(rv.Type()) {
+			field := rv.FieldByIndex(f.index)
+			if f.omitEmpty && isEmpty(field) {
+				continue
+			}
+
+			item, err := toPlist(field)
+			if err != nil {
+				return nil, err
+			}
+			if item != nil {
+				dict[f.name] = item
+			}
+		}
+		return dict, nil
+	}
+
+	return nil, ErrUnsupportedType
+}
+
+func isEmpty(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return rv.Bool() == false
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	}
+
+	if rv.Type() == timeType {
+		return rv.Interface().(time.Time).IsZero()
+	}
+
+	return false
+}
+
+// A struct field that goes in a dict
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// The fields of t that go in a dict, by their plist names
+func structFields(t reflect.Type) (fields []field) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && f.Anonymous == false {
+			// Unexported
+			continue
+		}
+
+		tag := f.Tag.Get("plist")
+		if tag == "-" {
+			continue
+		}
+
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			// Embedded structs' fields are part of this one
+			for _, embedded := range structFields(f.Type) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: options == "omitempty",
+		})
+	}
+
+	return fields
+}
+
+////////
+// Plist values to Go values
+
+func fromPlist(value interface{}, rv reflect.Value) (err error) {
+	// Fill in pointers as we go
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() == reflect.Interface && rv.NumMethod() == 0 {
+		rv.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return fromDict(v, rv)
+
+	case []interface{}:
+		if rv.Kind() != reflect.Slice || rv.Type() == byteType {
+			return &UnmarshalTypeError{"array", rv.Type()}
+		}
+
+		slice := reflect.MakeSlice(rv.Type(), len(v), len(v))
+		for i, item := range v {
+			err = fromPlist(item, slice.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+		return nil
+
+	case string:
+		if rv.Kind() == reflect.String {
+			rv.SetString(v)
+			return nil
+		}
+		return &UnmarshalTypeError{"string", rv.Type()}
+
+	case int64:
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if rv.OverflowInt(v) {
+				return &UnmarshalTypeError{"integer " + fmt.Sprint(v), rv.Type()}
+			}
+			rv.SetInt(v)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if v < 0 || rv.OverflowUint(uint64(v)) {
+				return &UnmarshalTypeError{"integer " + fmt.Sprint(v), rv.Type()}
+			}
+			rv.SetUint(uint64(v))
+			return nil
+		case reflect.Float32, reflect.Float64:
+			rv.SetFloat(float64(v))
+			return nil
+		}
+		return &UnmarshalTypeError{"integer", rv.Type()}
+
+	case uint64:
+		switch rv.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if rv.OverflowUint(v) {
+				return &UnmarshalTypeError{"integer " + fmt.Sprint(v), rv.Type()}
+			}
+			rv.SetUint(v)
+			return nil
+		case reflect.Float32, reflect.Float64:
+			rv.SetFloat(float64(v))
+			return nil
+		}
+		return &UnmarshalTypeError{"integer " + fmt.Sprint(v), rv.Type()}
+
+	case float64:
+		if rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64 {
+			rv.SetFloat(v)
+			return nil
+		}
+		return &UnmarshalTypeError{"real", rv.Type()}
+
+	case bool:
+		if rv.Kind() == reflect.Bool {
+			rv.SetBool(v)
+			return nil
+		}
+		return &UnmarshalTypeError{"boolean", rv.Type()}
+
+	case time.Time:
+		if rv.Type() == timeType {
+			rv.Set(reflect.ValueOf(v))
+			return nil
+		}
+		return &UnmarshalTypeError{"date", rv.Type()}
+
+	case []byte:
+		if rv.Type() == byteType {
+			rv.SetBytes(v)
+			return nil
+		}
+		return &UnmarshalTypeError{"data", rv.Type()}
+	}
+
+	return ErrInvalid
+}
+
+func fromDict(dict map[string]interface{}, rv reflect.Value) (err error) {
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return &UnmarshalTypeError{"dict", rv.Type()}
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+
+		// In order, so any error is always the same one
+		for _, key := range sortedKeys(dict) {
+			item := reflect.New(rv.Type().Elem()).Elem()
+			err = fromPlist(dict[key], item)
+			if err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), item)
+		}
+		return nil
+
+	case reflect.Struct:
+		if rv.Type() == timeType {
+			break
+		}
+
+		for _, f := range structFields(rv.Type()) {
+			item, ok := dict[f.name]
+			if ok == false {
+				continue
+			}
+
+			err = fromPlist(item, rv.FieldByIndex(f.index))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return &UnmarshalTypeError{"dict", rv.Type()}
+}
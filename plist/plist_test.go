@@ -0,0 +1,224 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testTimeRange struct {
+	Start    float64 `plist:"start"`
+	Duration float64 `plist:"duration"`
+}
+
+type testCommon struct {
+	Category string `plist:"category"`
+}
+
+type testEvent struct {
+	testCommon
+	SessionID   int             `plist:"sessionID"`
+	Rate        float32         `plist:"rate"`
+	ReadyToPlay bool            `plist:"readyToPlay"`
+	Loaded      []testTimeRange `plist:"loadedTimeRanges"`
+	Updated     time.Time       `plist:"updated"`
+	Data        []byte          `plist:"data"`
+	Big         *uint32         `plist:"big"`
+	Name        string          `plist:"name,omitempty"`
+	Missing     string          `plist:"missing,omitempty"`
+	Ignored     string          `plist:"-"`
+	Untagged    string
+	unexported  string
+}
+
+func TestUnmarshal(t *testing.T) {
+	binary, _ := hex.DecodeString(binaryFixture)
+	xml := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>big</key><integer>70000</integer>
+	<key>category</key><string>video</string>
+	<key>data</key><data>aGVsbG8=</data>
+	<key>loadedTimeRanges</key>
+	<array>
+		<dict>
+			<key>duration</key><real>51.541130402</real>
+			<key>start</key><real>18.11871765</real>
+		</dict>
+	</array>
+	<key>name</key><string>Café ☕ - a name long enough to need an extended length</string>
+	<key>rate</key><real>0.5</real>
+	<key>readyToPlay</key><true/>
+	<key>sessionID</key><integer>13</integer>
+	<key>updated</key><date>2014-01-02T03:04:05Z</date>
+	<key>Ignored</key><string>not this</string>
+</dict>
+</plist>`)
+
+	for _, data := range [][]byte{binary, xml} {
+		var e testEvent
+		err := Unmarshal(data, &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Category != "video" || e.SessionID != 13 || e.Rate != 0.5 || e.ReadyToPlay == false || e.Ignored != "" {
+			t.Errorf("Unexpected event: %+v", e)
+		}
+		if len(e.Loaded) != 1 || e.Loaded[0] != (testTimeRange{Start: 18.11871765, Duration: 51.541130402}) {
+			t.Errorf("Unexpected time ranges: %v", e.Loaded)
+		}
+		if e.Updated.Equal(time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)) == false || string(e.Data) != "hello" {
+			t.Errorf("Unexpected date or data: %v %q", e.Updated, e.Data)
+		}
+		if e.Big == nil || *e.Big != 70000 {
+			t.Errorf("Unexpected pointer: %v", e.Big)
+		}
+		if strings.HasPrefix(e.Name, "Café ☕") == false {
+			t.Errorf("Unexpected name: %q", e.Name)
+		}
+	}
+
+	// Into a map, and an interface{}
+	var m map[string]interface{}
+	err := Unmarshal(binary, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["sessionID"] != int64(13) || len(m) != 11 {
+		t.Errorf("Unexpected map: %v", m)
+	}
+
+	var v interface{}
+	err = Unmarshal(xml, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.(map[string]interface{})["category"] != "video" {
+		t.Errorf("Unexpected value: %v", v)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	big := uint32(70000)
+	e := testEvent{
+		testCommon:  testCommon{Category: "video"},
+		SessionID:   13,
+		Rate:        0.5,
+		ReadyToPlay: true,
+		Loaded:      []testTimeRange{{Start: 1, Duration: 2.5}},
+		Updated:     time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		Data:        []byte("hello"),
+		Big:         &big,
+		Ignored:     "not this",
+		Untagged:    "this",
+		unexported:  "not this either",
+	}
+
+	for _, format := range []int{XMLFormat, BinaryFormat} {
+		data, err := Marshal(e, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var m map[string]interface{}
+		err = Unmarshal(data, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"big", "category", "data", "loadedTimeRanges", "rate", "readyToPlay", "sessionID", "updated", "Untagged"}
+		if len(m) != len(expected) {
+			t.Errorf("Expected %v, got %v", expected, m)
+		}
+		for _, key := range expected {
+			if _, ok := m[key]; ok == false {
+				t.Errorf("Expected %s in %v", key, m)
+			}
+		}
+
+		var back testEvent
+		err = Unmarshal(data, &back)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back.Ignored, back.unexported = e.Ignored, e.unexported
+		if reflect.DeepEqual(back, e) == false {
+			t.Errorf("Expected %+v back, got %+v", e, back)
+		}
+	}
+
+	// Binary comes out as binary
+	data, err := Marshal(map[string]int{"one": 1}, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasPrefix(data, []byte("bplist00")) == false {
+		t.Errorf("Expected a binary plist, got %q", data)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	unsupported := []interface{}{
+		nil,
+		make(chan int),
+		map[int]string{1: "one"},
+		[]interface{}{"a", nil},
+		struct{ F func() }{func() {}},
+	}
+
+	for _, v := range unsupported {
+		_, err := Marshal(v, XMLFormat)
+		if err != ErrUnsupportedType {
+			t.Errorf("Expected ErrUnsupportedType for %#v, got %v", v, err)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	data, err := Marshal(map[string]interface{}{"n": -1, "s": "string", "list": []string{"a"}}, BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notPointer map[string]interface{}
+	if Unmarshal(data, notPointer) != ErrNotPointer {
+		t.Error("Expected ErrNotPointer")
+	}
+
+	var negative struct {
+		N uint `plist:"n"`
+	}
+	err = Unmarshal(data, &negative)
+	if typeErr, ok := err.(*UnmarshalTypeError); ok == false || typeErr.Type.Kind().String() != "uint" {
+		t.Errorf("Expected an UnmarshalTypeError, got %v", err)
+	}
+
+	var wrong struct {
+		S int `plist:"s"`
+	}
+	err = Unmarshal(data, &wrong)
+	if err == nil || err.Error() != "Can't unmarshal a plist string into a Go value of type int" {
+		t.Errorf("Expected an UnmarshalTypeError, got %v", err)
+	}
+
+	var list []string
+	if _, ok := Unmarshal(data, &list).(*UnmarshalTypeError); ok == false {
+		t.Error("Expected an UnmarshalTypeError for a dict into a slice")
+	}
+
+	var small struct {
+		N int8 `plist:"n"`
+	}
+	big, _ := Marshal(map[string]int{"n": 300}, XMLFormat)
+	if _, ok := Unmarshal(big, &small).(*UnmarshalTypeError); ok == false {
+		t.Error("Expected an UnmarshalTypeError for an overflow")
+	}
+
+	if Unmarshal([]byte("not a plist"), &list) != ErrInvalid {
+		t.Error("Expected ErrInvalid")
+	}
+}
@@ -0,0 +1,246 @@
+//
+// XML property lists:
+//
+//	<?xml version="1.0" encoding="UTF-8"?>
+//	<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+//	<plist version="1.0">
+//	<dict>
+//		<key>state</key>
+//		<string>playing</string>
+//	</dict>
+//	</plist>
+//
+
+package plist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+func decodeXML(data []byte) (v interface{}, err error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+
+	start, ok, err := nextElement(d)
+	if err != nil || ok == false || start.Name.Local != "plist" {
+		return nil, ErrInvalid
+	}
+
+	start, ok, err = nextElement(d)
+	if err != nil || ok == false {
+		return nil, ErrInvalid
+	}
+
+	return decodeXMLValue(d, start)
+}
+
+// Skip to the next element. ok is false if we got to the end of the enclosing one first
+func nextElement(d *xml.Decoder) (start xml.StartElement, ok bool, err error) {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return start, false, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t, true, nil
+		case xml.EndElement:
+			return start, false, nil
+		}
+	}
+}
+
+// Decode the value that starts with start
+func decodeXMLValue(d *xml.Decoder, start xml.StartElement) (v interface{}, err error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+		for {
+			key, ok, err := nextElement(d)
+			if err != nil {
+				return nil, ErrInvalid
+			}
+			if ok == false {
+				return dict, nil
+			}
+			if key.Name.Local != "key" {
+				return nil, ErrInvalid
+			}
+
+			var name string
+			err = d.DecodeElement(&name, &key)
+			if err != nil {
+				return nil, ErrInvalid
+			}
+
+			value, ok, err := nextElement(d)
+			if err != nil || ok == false {
+				return nil, ErrInvalid
+			}
+
+			dict[name], err = decodeXMLValue(d, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case "array":
+		array := []interface{}{}
+		for {
+			value, ok, err := nextElement(d)
+			if err != nil {
+				return nil, ErrInvalid
+			}
+			if ok == false {
+				return array, nil
+			}
+
+			v, err := decodeXMLValue(d, value)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+
+	case "true", "false":
+		err = d.Skip()
+		if err != nil {
+			return nil, ErrInvalid
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	// Everything else is text
+	var text string
+	err = d.DecodeElement(&text, &start)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	switch start.Name.Local {
+	case "string":
+		v = text
+		break
+	case "integer":
+		text = strings.TrimSpace(text)
+		v, err = strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			// Too big for an int64
+			v, err = strconv.ParseUint(text, 10, 64)
+		}
+		break
+	case "real":
+		v, err = strconv.ParseFloat(strings.TrimSpace(text), 64)
+		break
+	case "date":
+		v, err = time.Parse(time.RFC3339, strings.TrimSpace(text))
+		break
+	case "data":
+		v, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		break
+	default:
+		err = ErrInvalid
+		break
+	}
+
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	return v, nil
+}
+
+func encodeXML(v interface{}) (data []byte, err error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(xmlHeader)
+
+	err = encodeXMLValue(&buffer, v)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer.WriteString("\n</plist>\n")
+	return buffer.Bytes(), nil
+}
+
+func encodeXMLValue(buffer *bytes.Buffer, v interface{}) (err error) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		buffer.WriteString("<dict>")
+		for _, key := range sortedKeys(value) {
+			buffer.WriteString("<key>")
+			xml.EscapeText(buffer, []byte(key))
+			buffer.WriteString("</key>")
+
+			err = encodeXMLValue(buffer, value[key])
+			if err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("</dict>")
+		break
+	case []interface{}:
+		buffer.WriteString("<array>")
+		for _, item := range value {
+			err = encodeXMLValue(buffer, item)
+			if err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("</array>")
+		break
+	case string:
+		buffer.WriteString("<string>")
+		xml.EscapeText(buffer, []byte(value))
+		buffer.WriteString("</string>")
+		break
+	case int64:
+		buffer.WriteString("<integer>" + strconv.FormatInt(value, 10) + "</integer>")
+		break
+	case uint64:
+		buffer.WriteString("<integer>" + strconv.FormatUint(value, 10) + "</integer>")
+		break
+	case float64:
+		buffer.WriteString("<real>" + strconv.FormatFloat(value, 'g', -1, 64) + "</real>")
+		break
+	case bool:
+		if value {
+			buffer.WriteString("<true/>")
+		} else {
+			buffer.WriteString("<false/>")
+		}
+		break
+	case time.Time:
+		buffer.WriteString("<date>" + value.UTC().Format(time.RFC3339) + "</date>")
+		break
+	case []byte:
+		buffer.WriteString("<data>" + base64.StdEncoding.EncodeToString(value) + "</data>")
+		break
+	default:
+		return ErrUnsupportedType
+	}
+
+	return nil
+}
+
+// A dict's keys in order, so the same dict always comes out the same
+func sortedKeys(dict map[string]interface{}) (keys []string) {
+	keys = make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
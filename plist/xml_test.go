@@ -0,0 +1,153 @@
+package plist
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDecodeXML(t *testing.T) {
+	v, err := decodeXML([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>category</key>
+	<string>video</string>
+	<key>sessionID</key>
+	<integer>13</integer>
+	<key>rate</key>
+	<real>0.5</real>
+	<key>readyToPlay</key>
+	<true/>
+	<key>playbackBufferEmpty</key>
+	<false/>
+	<key>loadedTimeRanges</key>
+	<array>
+		<dict>
+			<key>duration</key>
+			<real>16.5</real>
+		</dict>
+	</array>
+	<key>updated</key>
+	<date>2014-01-02T03:04:05Z</date>
+	<key>data</key>
+	<data>
+	aGVs
+	bG8=
+	</data>
+	<key>empty</key>
+	<string/>
+</dict>
+</plist>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dict, ok := v.(map[string]interface{})
+	if ok == false {
+		t.Fatalf("Expected a dict, got %T", v)
+	}
+
+	if dict["category"] != "video" || dict["sessionID"] != int64(13) || dict["rate"] != 0.5 {
+		t.Errorf("Unexpected values: %v", dict)
+	}
+	if dict["readyToPlay"] != true || dict["playbackBufferEmpty"] != false || dict["empty"] != "" {
+		t.Errorf("Unexpected values: %v", dict)
+	}
+	if updated, _ := dict["updated"].(time.Time); updated.Equal(time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)) == false {
+		t.Errorf("Unexpected date: %v", dict["updated"])
+	}
+	if data, _ := dict["data"].([]byte); bytes.Equal(data, []byte("hello")) == false {
+		t.Errorf("Unexpected data: %v", dict["data"])
+	}
+
+	ranges, _ := dict["loadedTimeRanges"].([]interface{})
+	if len(ranges) != 1 {
+		t.Fatalf("Expected 1 time range, got %v", dict["loadedTimeRanges"])
+	}
+	if r, _ := ranges[0].(map[string]interface{}); r["duration"] != 16.5 {
+		t.Errorf("Unexpected time range: %v", ranges[0])
+	}
+}
+
+func TestDecodeInvalidXML(t *testing.T) {
+	plists := []string{
+		``,
+		`<dict></dict>`,
+		`<plist version="1.0"></plist>`,
+		`<plist><dict><string>no key</string></dict></plist>`,
+		`<plist><dict><key>no value</key></dict></plist>`,
+		`<plist><integer>one</integer></plist>`,
+		`<plist><unknown/></plist>`,
+		`<plist><array><string>unterminated</string>`,
+	}
+
+	for _, plist := range plists {
+		_, err := decodeXML([]byte(plist))
+		if err != ErrInvalid {
+			t.Errorf("Expected ErrInvalid for %q, got %v", plist, err)
+		}
+	}
+}
+
+func TestEncodeXML(t *testing.T) {
+	data, err := encodeXML(map[string]interface{}{
+		"state": "playing",
+		"settings": map[string]interface{}{
+			"slideDuration": int64(3),
+			"theme":         "Tom & Jerry's <Classic>",
+		},
+		"rate":    0.5,
+		"id":      int64(7),
+		"huge":    uint64(math.MaxUint64),
+		"ready":   true,
+		"paused":  false,
+		"when":    time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		"data":    []byte("hello"),
+		"ranges":  []interface{}{int64(1), "two"},
+		"nothing": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.HasPrefix(data, []byte(`<?xml version="1.0" encoding="UTF-8"?>`)) == false {
+		t.Errorf("Expected an XML declaration, got %s", data)
+	}
+	if bytes.Contains(data, []byte("<key>data</key><data>aGVsbG8=</data><key>huge</key><integer>18446744073709551615</integer><key>id</key>")) == false {
+		t.Errorf("Expected keys in order, got %s", data)
+	}
+
+	// And back again
+	v, err := decodeXML(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dict := v.(map[string]interface{})
+	settings, _ := dict["settings"].(map[string]interface{})
+	if settings["theme"] != "Tom & Jerry's <Classic>" || settings["slideDuration"] != int64(3) {
+		t.Errorf("Unexpected settings: %v", settings)
+	}
+	if dict["rate"] != 0.5 || dict["ready"] != true || dict["paused"] != false || dict["state"] != "playing" {
+		t.Errorf("Unexpected values: %v", dict)
+	}
+	if when, _ := dict["when"].(time.Time); when.Equal(time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)) == false {
+		t.Errorf("Unexpected date: %v", dict["when"])
+	}
+	if ranges, _ := dict["ranges"].([]interface{}); len(ranges) != 2 || ranges[0] != int64(1) || ranges[1] != "two" {
+		t.Errorf("Unexpected array: %v", dict["ranges"])
+	}
+	if dict["huge"] != uint64(math.MaxUint64) {
+		t.Errorf("Unexpected big integer: %v", dict["huge"])
+	}
+	if nothing, ok := dict["nothing"].(map[string]interface{}); ok == false || len(nothing) != 0 {
+		t.Errorf("Unexpected empty dict: %v", dict["nothing"])
+	}
+
+	_, err = encodeXML(map[string]interface{}{"bad": struct{}{}})
+	if err != ErrUnsupportedType {
+		t.Errorf("Expected ErrUnsupportedType, got %v", err)
+	}
+}
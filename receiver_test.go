@@ -0,0 +1,190 @@
+package airplay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A request as seen by the stand-in receiver
+type testRequest struct {
+	Method string
+	URI    string
+	Proto  string
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+// What the stand-in receiver sends back
+type testResponse struct {
+	StatusCode int
+	Status     string
+	Header     map[string]string
+	Body       []byte
+}
+
+// A stand-in RAOP/AirPlay receiver. It records every request and answers with handler,
+// or with a minimal working response if handler is nil or returns nil
+type testReceiver struct {
+	listener net.Listener
+	handler  func(req *testRequest) *testResponse
+	reverse  func(conn net.Conn, reader *bufio.Reader) // Takes over a connection once handler answers 101
+
+	lock     sync.Mutex
+	requests []*testRequest
+}
+
+func startTestReceiver(t *testing.T, handler func(req *testRequest) *testResponse) *testReceiver {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &testReceiver{listener: listener, handler: handler}
+	go r.serve()
+
+	return r
+}
+
+// A stand-in receiver that hands a connection to reverse once handler has agreed to turn it around
+func startReversingTestReceiver(t *testing.T, handler func(req *testRequest) *testResponse, reverse func(conn net.Conn, reader *bufio.Reader)) *testReceiver {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &testReceiver{listener: listener, handler: handler, reverse: reverse}
+	go r.serve()
+
+	return r
+}
+
+func (r *testReceiver) IP() net.IP {
+	return r.listener.Addr().(*net.TCPAddr).IP
+}
+
+func (r *testReceiver) Port() uint16 {
+	return uint16(r.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (r *testReceiver) Close() {
+	r.listener.Close()
+}
+
+// Every request received so far with the given method
+func (r *testReceiver) Requests(method string) (requests []*testRequest) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, req := range r.requests {
+		if req.Method == method {
+			requests = append(requests, req)
+		}
+	}
+
+	return requests
+}
+
+func (r *testReceiver) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go r.serveConn(conn)
+	}
+}
+
+func (r *testReceiver) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	tp := textproto.NewReader(reader)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		f := strings.SplitN(line, " ", 3)
+		if len(f) != 3 {
+			return
+		}
+
+		req := &testRequest{Method: f[0], URI: f[1], Proto: f[2]}
+		req.Header, err = tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+
+		length, _ := strconv.Atoi(req.Header.Get("Content-Length"))
+		req.Body = make([]byte, length)
+		_, err = io.ReadFull(reader, req.Body)
+		if err != nil {
+			return
+		}
+
+		r.lock.Lock()
+		r.requests = append(r.requests, req)
+		r.lock.Unlock()
+
+		var resp *testResponse
+		if r.handler != nil {
+			resp = r.handler(req)
+		}
+		if resp == nil {
+			resp = defaultTestResponse(req)
+		}
+
+		if resp.Status == "" {
+			resp.Status = strconv.Itoa(resp.StatusCode) + " OK"
+		}
+
+		out := fmt.Sprintf("%s %s\r\n", req.Proto, resp.Status)
+		out += fmt.Sprintf("CSeq: %s\r\n", req.Header.Get("CSeq"))
+		for key, value := range resp.Header {
+			out += fmt.Sprintf("%s: %s\r\n", key, value)
+		}
+		out += fmt.Sprintf("Content-Length: %d\r\n\r\n", len(resp.Body))
+
+		_, err = conn.Write(append([]byte(out), resp.Body...))
+		if err != nil {
+			return
+		}
+
+		if resp.StatusCode == 101 && r.reverse != nil {
+			r.reverse(conn, reader)
+			return
+		}
+	}
+}
+
+func defaultTestResponse(req *testRequest) *testResponse {
+	switch req.Method {
+	case "OPTIONS":
+		return &testResponse{
+			StatusCode: 200,
+			Header: map[string]string{
+				"Public": "ANNOUNCE, SETUP, RECORD, PAUSE, FLUSH, TEARDOWN, OPTIONS, GET_PARAMETER, SET_PARAMETER",
+			},
+		}
+
+	case "SETUP":
+		return &testResponse{
+			StatusCode: 200,
+			Header: map[string]string{
+				"Session":   "DEADBEEF",
+				"Transport": "RTP/AVP/UDP;unicast;mode=record;server_port=53561;control_port=63379;timing_port=50607",
+			},
+		}
+	}
+
+	return &testResponse{StatusCode: 200}
+}
@@ -0,0 +1,319 @@
+//
+// Requests to the receiver. RTSP and HTTP look the same on the wire, so one
+// engine makes both:
+//
+//	METHOD path PROTO
+//	Content-Length: n
+//	CSeq: n
+//	...headers...
+//
+//	body
+//
+// Responses are read in full, with bodies sized by Content-Length or sent
+// chunked, so the next response starts where it should. An RTSP receiver
+// echoes the CSeq of the request it's answering, which lets us skip any
+// response to an earlier request we gave up on.
+//
+// Every request is bounded by its context, or by Airplay.Timeout if the
+// context has no deadline, so a receiver that stops answering can't hang us.
+//
+// http://www.ietf.org/rfc/rfc2326.txt - RTSP
+// http://www.ietf.org/rfc/rfc2616.txt - HTTP/1.1
+//
+
+package airplay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedResponse = errors.New("Airplay server sent a malformed response")
+	ErrUnexpectedCSeq    = errors.New("Airplay server answered a request we didn't make")
+	ErrResponseTooLarge  = errors.New("Airplay server sent a response body over MaxResponseSize")
+
+	// The biggest response body we'll read. Receivers only send parameters and plists, so anything
+	// bigger is a broken or hostile receiver
+	MaxResponseSize int64 = 16 << 20
+)
+
+// Make an RTSP request. Requests with a body should say what it is with a Content-Type in header
+func (a *Airplay) makeRTSPRequest(ctx context.Context, method string, path string, header http.Header, body io.Reader) (resp http.Response, err error) {
+	return a.makeRequest(ctx, a.netConn, a.conn, "RTSP/1.0", method, path, header, body)
+}
+
+// Make an HTTP request on the same connection, as AirPlay video and photo receivers expect
+func (a *Airplay) makeHTTPRequest(ctx context.Context, method string, path string, header http.Header, body io.Reader) (resp http.Response, err error) {
+	return a.makeRequest(ctx, a.netConn, a.conn, "HTTP/1.1", method, path, header, body)
+}
+
+// Sets up the reverse HTTP connection, which the receiver then sends us events over
+func (a *Airplay) makeReverseRequest(ctx context.Context) (err error) {
+	header := http.Header{}
+	header.Set("Upgrade", "PTTH/1.0")
+	header.Set("Connection", "Upgrade")
+	header.Set("X-Apple-Purpose", "Event")
+
+	resp, err := a.makeRequest(ctx, a.reverseNetConn, a.reverseConn, "HTTP/1.1", "POST", "/reverse", header, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("Airplay server refused the reverse connection: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Send a request on conn, which is netConn underneath, and read its response, answering a password challenge
+// if we get one. Gives up with ctx.Err() if ctx is done first
+func (a *Airplay) makeRequest(ctx context.Context, netConn net.Conn, conn *textproto.Conn, proto string, method string, path string, header http.Header, body io.Reader) (resp http.Response, err error) {
+	if conn == nil {
+		return resp, ErrNotConnected
+	}
+
+	// Read the body up front, so we know how long it is and can send it again after a 401
+	var data []byte
+	if body != nil {
+		data, err = ioutil.ReadAll(body)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline == false {
+		deadline = time.Now().Add(a.timeout())
+	}
+	netConn.SetDeadline(deadline)
+	defer netConn.SetDeadline(time.Time{})
+
+	// Cut the request short if ctx is cancelled. The next request sets its own deadline, so it doesn't
+	// matter if this fires just as we finish
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				netConn.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	// Once with new credentials, and once more if the receiver then says the nonce went stale. A receiver
+	// that still won't take them isn't going to
+	retries := 0
+	for {
+		resp, err = a.roundTrip(conn, proto, method, path, header, data)
+		if err != nil && ctx.Err() != nil {
+			return resp, ctx.Err()
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && hasDeadline {
+			// Our deadline was ctx's, which can pass a moment before ctx notices
+			return resp, context.DeadlineExceeded
+		}
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		if retries == 2 {
+			return resp, ErrPasswordInvalid
+		}
+
+		err = a.handleUnauthorized(textproto.MIMEHeader(resp.Header))
+		if err != nil {
+			return resp, err
+		}
+		retries++
+
+		// Make another request with the new auth information
+	}
+}
+
+// How long a request may take if its context doesn't say
+func (a *Airplay) timeout() time.Duration {
+	if a.Timeout > 0 {
+		return a.Timeout
+	}
+
+	return RequestTimeout
+}
+
+// Send one request and read its response
+func (a *Airplay) roundTrip(conn *textproto.Conn, proto string, method string, path string, header http.Header, body []byte) (resp http.Response, err error) {
+	a.cseq++
+	cseq := a.cseq
+
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "%s %s %s\r\n", method, path, proto)
+	fmt.Fprintf(&request, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(&request, "User-Agent: go-airplay/1.0\r\n")
+	fmt.Fprintf(&request, "X-Apple-Session-ID: %s\r\n", a.sessionID)
+	fmt.Fprintf(&request, "CSeq: %d\r\n", cseq)
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&request, "%s: %s\r\n", key, value)
+		}
+	}
+
+	/*
+		Client-Instance: 56B29BB6CB904862
+		DACP-ID: 56B29BB6CB904862
+		Active-Remote: 1986535575
+	*/
+
+	// Add auth headers, if necessary
+	if auth := a.authorization(method, path); auth != "" {
+		fmt.Fprintf(&request, "Authorization: %s\r\n", auth)
+	}
+
+	request.WriteString("\r\n")
+	request.Write(body)
+
+	// Submit request
+	_, err = conn.W.Write(request.Bytes())
+	if err != nil {
+		return resp, err
+	}
+	err = conn.W.Flush()
+	if err != nil {
+		return resp, err
+	}
+
+	// Read responses until we get the one to this request
+	for {
+		resp, err = readResponse(conn)
+		if err != nil {
+			return resp, err
+		}
+
+		if resp.Header.Get("CSeq") == "" {
+			// HTTP receivers don't always echo it
+			return resp, nil
+		}
+
+		n, err := strconv.Atoi(resp.Header.Get("CSeq"))
+		if err != nil {
+			return resp, ErrMalformedResponse
+		}
+
+		if n == cseq {
+			return resp, nil
+		} else if n > cseq {
+			return resp, ErrUnexpectedCSeq
+		}
+
+		// An answer to something we sent earlier, which is no use now
+	}
+}
+
+// Read a response and its whole body
+func readResponse(conn *textproto.Conn) (resp http.Response, err error) {
+	line, err := conn.ReadLine()
+	if err != nil {
+		return resp, err
+	}
+
+	f := strings.SplitN(line, " ", 3) // Proto, Code, Status
+	if len(f) < 2 {
+		return resp, ErrMalformedResponse
+	}
+	reasonPhrase := ""
+	if len(f) > 2 {
+		reasonPhrase = f[2]
+	}
+	resp.Status = f[1] + " " + reasonPhrase
+	resp.StatusCode, err = strconv.Atoi(f[1])
+	if err != nil {
+		return resp, ErrMalformedResponse
+	}
+
+	resp.Proto = f[0]
+	resp.ProtoMajor, resp.ProtoMinor, _ = http.ParseHTTPVersion(strings.Replace(resp.Proto, "RTSP", "HTTP", 1))
+
+	headers, err := conn.ReadMIMEHeader()
+	if err != nil {
+		return resp, err
+	}
+
+	resp.Header = http.Header(headers)
+
+	// Read the body
+	var body []byte
+	if strings.EqualFold(headers.Get("Transfer-Encoding"), "chunked") {
+		body, err = readLimited(httputil.NewChunkedReader(conn.R))
+		if err != nil {
+			return resp, err
+		}
+
+		// Then any trailers
+		_, err = conn.ReadMIMEHeader()
+		if err != nil {
+			return resp, err
+		}
+	} else if headers.Get("Content-Length") != "" {
+		length, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return resp, ErrMalformedResponse
+		}
+		if length > MaxResponseSize {
+			return resp, ErrResponseTooLarge
+		}
+
+		body = make([]byte, length)
+		_, err = io.ReadFull(conn.R, body)
+		if err != nil {
+			return resp, err
+		}
+	} else if strings.HasPrefix(resp.Proto, "HTTP/") && strings.EqualFold(headers.Get("Connection"), "close") {
+		// The body is whatever comes before the receiver hangs up
+		body, err = readLimited(conn.R)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+// Read r to the end, as long as that's no more than MaxResponseSize
+func readLimited(r io.Reader) (body []byte, err error) {
+	body, err = ioutil.ReadAll(io.LimitReader(r, MaxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > MaxResponseSize {
+		return nil, ErrResponseTooLarge
+	}
+
+	return body, nil
+}
@@ -0,0 +1,346 @@
+package airplay
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// Connect to a receiver that answers the nth request with responses[n]. {cseq} in a response is the
+// CSeq of the request it's answering
+func dialScriptedReceiver(t *testing.T, responses []string) (a *Airplay, listener net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		tp := textproto.NewReader(reader)
+		for _, response := range responses {
+			_, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			header, err := tp.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			length, _ := strconv.Atoi(header.Get("Content-Length"))
+			io.CopyN(ioutil.Discard, reader, int64(length))
+
+			io.WriteString(conn, strings.Replace(response, "{cseq}", header.Get("CSeq"), -1))
+		}
+	}()
+
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Airplay{conn: textproto.NewConn(netConn), netConn: netConn}, listener
+}
+
+func readBody(t *testing.T, r io.Reader) string {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+////////
+
+func TestRequestBody(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// A reader we can't ask the length of
+	_, err = a.makeRTSPRequest(context.Background(), "SET_PARAMETER", "*", nil, iotest.OneByteReader(strings.NewReader("volume: -20.000000\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := receiver.Requests("SET_PARAMETER")[0]
+	if string(req.Body) != "volume: -20.000000\r\n" || req.Header.Get("Content-Length") != "20" {
+		t.Errorf("Unexpected body: %s %q", req.Header.Get("Content-Length"), req.Body)
+	}
+}
+
+func TestResponseBody(t *testing.T) {
+	a, listener := dialScriptedReceiver(t, []string{
+		"RTSP/1.0 200 OK\r\nCSeq: {cseq}\r\nContent-Type: text/parameters\r\nContent-Length: 13\r\n\r\nvolume: -20\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: yes\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+		"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nthe end",
+	})
+	defer listener.Close()
+	defer a.Close()
+
+	resp, err := a.makeRTSPRequest(context.Background(), "GET_PARAMETER", "*", nil, strings.NewReader("volume\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp.Body); body != "volume: -20\r\n" || resp.ContentLength != 13 {
+		t.Errorf("Unexpected body: %q", body)
+	}
+
+	resp, err = a.makeHTTPRequest(context.Background(), "GET", "/server-info", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp.Body); body != "hello world" {
+		t.Errorf("Unexpected chunked body: %q", body)
+	}
+
+	// Everything before should have been read, trailers included
+	resp, err = a.makeHTTPRequest(context.Background(), "GET", "/playback-info", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp.Body); body != "ok" || resp.ProtoMajor != 1 || resp.ProtoMinor != 1 {
+		t.Errorf("Unexpected body: %q", body)
+	}
+
+	resp, err = a.makeHTTPRequest(context.Background(), "GET", "/playback-info", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp.Body); body != "the end" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+}
+
+func TestResponseCSeq(t *testing.T) {
+	a, listener := dialScriptedReceiver(t, []string{
+		// A late answer to an earlier request, then the real one
+		"RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: 4\r\n\r\nlate" +
+			"RTSP/1.0 453 Not Enough Bandwidth\r\nCSeq: {cseq}\r\n\r\n",
+		"RTSP/1.0 200 OK\r\nCSeq: 100\r\n\r\n",
+	})
+	defer listener.Close()
+	defer a.Close()
+
+	a.cseq = 4
+	resp, err := a.makeRTSPRequest(context.Background(), "OPTIONS", "*", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 453 || resp.Header.Get("CSeq") != "5" {
+		t.Errorf("Expected the answer to CSeq 5, got %s %s", resp.Status, resp.Header.Get("CSeq"))
+	}
+
+	_, err = a.makeRTSPRequest(context.Background(), "OPTIONS", "*", nil, nil)
+	if err != ErrUnexpectedCSeq {
+		t.Errorf("Expected ErrUnexpectedCSeq, got %v", err)
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	responses := []string{
+		"RTSP/1.0\r\n\r\n",
+		"RTSP/1.0 OK\r\n\r\n",
+		"RTSP/1.0 200 OK\r\nCSeq: {cseq}\r\nContent-Length: -1\r\n\r\n",
+		"RTSP/1.0 200 OK\r\nCSeq: one\r\n\r\n",
+	}
+
+	for _, response := range responses {
+		a, listener := dialScriptedReceiver(t, []string{response})
+
+		_, err := a.makeRTSPRequest(context.Background(), "OPTIONS", "*", nil, nil)
+		if err != ErrMalformedResponse {
+			t.Errorf("Expected ErrMalformedResponse for %q, got %v", response, err)
+		}
+
+		a.Close()
+		listener.Close()
+	}
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	defer func(max int64) { MaxResponseSize = max }(MaxResponseSize)
+	MaxResponseSize = 10
+
+	responses := []string{
+		"RTSP/1.0 200 OK\r\nCSeq: {cseq}\r\nContent-Length: 9223372036854775807\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n6\r\nworld!\r\n0\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world!",
+	}
+
+	for _, response := range responses {
+		a, listener := dialScriptedReceiver(t, []string{response})
+
+		_, err := a.makeRequest(context.Background(), a.netConn, a.conn, response[:strings.Index(response, " ")], "GET", "/server-info", nil, nil)
+		if err != ErrResponseTooLarge {
+			t.Errorf("Expected ErrResponseTooLarge for %q, got %v", response, err)
+		}
+
+		a.Close()
+		listener.Close()
+	}
+
+	// Right up to the limit is fine
+	a, listener := dialScriptedReceiver(t, []string{"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello worl"})
+	defer listener.Close()
+	defer a.Close()
+
+	resp, err := a.makeHTTPRequest(context.Background(), "GET", "/server-info", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp.Body); body != "hello worl" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+}
+
+// A receiver that accepts connections and reads requests, but never answers
+func startSilentReceiver(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestRequestTimeout(t *testing.T) {
+	listener := startSilentReceiver(t)
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+
+	// Dial gives up when ctx does
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := DialContext(ctx, addr.IP, uint16(addr.Port), "")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("DialContext took %v", time.Since(start))
+	}
+
+	////////
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Airplay{conn: textproto.NewConn(netConn), netConn: netConn, Timeout: 50 * time.Millisecond}
+	defer a.Close()
+
+	// Without a deadline in ctx, Timeout applies
+	_, err = a.makeRTSPRequest(context.Background(), "OPTIONS", "*", nil, nil)
+	if netErr, ok := err.(net.Error); ok == false || netErr.Timeout() == false {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	// Cancelling ctx cuts the request short
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	a.Timeout = time.Minute
+
+	start = time.Now()
+	_, err = a.makeRTSPRequest(ctx, "OPTIONS", "*", nil, nil)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Cancelled request took %v", time.Since(start))
+	}
+
+	// And the next request gets its full time, not the deadline left over from cancelling
+	a.Timeout = 100 * time.Millisecond
+	start = time.Now()
+	_, err = a.makeRTSPRequest(context.Background(), "OPTIONS", "*", nil, nil)
+	if netErr, ok := err.(net.Error); ok == false || netErr.Timeout() == false {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if time.Since(start) < 90*time.Millisecond {
+		t.Errorf("Request timed out after only %v", time.Since(start))
+	}
+}
+
+func TestDialHangsUp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	responses := []string{
+		"RTSP/1.0 404 Not Found\r\nCSeq: 1\r\n\r\n",
+		"RTSP/1.0 200 OK\r\nCSeq: 1\r\nPublic: OPTIONS, SETUP\r\n\r\n",
+		"", // Never answers, so ctx runs out
+	}
+
+	for _, response := range responses {
+		hungUp := make(chan error, 1)
+		go func(response string) {
+			conn, err := listener.Accept()
+			if err != nil {
+				hungUp <- err
+				return
+			}
+			defer conn.Close()
+
+			reader := textproto.NewReader(bufio.NewReader(conn))
+			reader.ReadLine()
+			reader.ReadMIMEHeader()
+			io.WriteString(conn, response)
+
+			// We should see the client hang up well before this
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = reader.R.ReadByte()
+			hungUp <- err
+		}(response)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := DialContext(ctx, addr.IP, uint16(addr.Port), "")
+		cancel()
+		if err == nil {
+			t.Fatalf("Expected an error for %q", response)
+		}
+
+		if err := <-hungUp; err != io.EOF {
+			t.Errorf("Expected the connection closed for %q, got %v", response, err)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+//
+// Just enough of the Session Description Protocol to describe and understand
+// RAOP streams, which is what goes in the body of an ANNOUNCE.
+//
+// Relevant RFCs:
+// http://www.ietf.org/rfc/rfc4566.txt - SDP
+//
+// https://xmms2.org/wiki/Technical_note_that_describes_the_Remote_Audio_Access_Protocol_(RAOP)_used_in_AirTunes
+//
+
+package sdp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoAttribute = errors.New("SDP attribute not found")
+	ErrInvalidFmtp = errors.New("Invalid ALAC fmtp attribute")
+)
+
+// A whole session description
+type Session struct {
+	Version    int        // v=, always 0
+	Origin     Origin     // o=
+	Name       string     // s=
+	Info       string     // i=, optional
+	Connection Connection // c=, optional at the session level if every media has one
+	Start      uint64     // t=, 0 for a session that isn't bounded in time
+	Stop       uint64
+	Attributes []Attribute // Session-level a= lines
+	Media      []Media     // Each m= line and everything after it
+}
+
+// Who created the session, and where from
+type Origin struct {
+	Username       string // "iTunes", or "-"
+	SessionID      string
+	SessionVersion string
+	NetType        string // Always "IN"
+	AddrType       string // "IP4" or "IP6"
+	Address        string
+}
+
+type Connection struct {
+	NetType  string // Always "IN"
+	AddrType string // "IP4" or "IP6"
+	Address  string
+}
+
+// A media description, like "m=audio 0 RTP/AVP 96"
+type Media struct {
+	Type       string   // "audio"
+	Port       int      // 0 for RAOP, since ports are negotiated in SETUP
+	Proto      string   // "RTP/AVP"
+	Formats    []string // RTP payload types, like "96"
+	Connection Connection
+	Attributes []Attribute
+}
+
+// An a= line. Flag attributes like "a=recvonly" have no value
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// Encode a session description, with the CRLF line endings iTunes uses
+func Marshal(s *Session) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	fmt.Fprintf(&buffer, "v=%d\r\n", s.Version)
+	fmt.Fprintf(&buffer, "o=%s %s %s %s %s %s\r\n", s.Origin.Username, s.Origin.SessionID, s.Origin.SessionVersion,
+		s.Origin.NetType, s.Origin.AddrType, s.Origin.Address)
+	fmt.Fprintf(&buffer, "s=%s\r\n", s.Name)
+	if s.Info != "" {
+		fmt.Fprintf(&buffer, "i=%s\r\n", s.Info)
+	}
+	if s.Connection.Address != "" {
+		fmt.Fprintf(&buffer, "c=%s\r\n", s.Connection.String())
+	}
+	fmt.Fprintf(&buffer, "t=%d %d\r\n", s.Start, s.Stop)
+	marshalAttributes(&buffer, s.Attributes)
+
+	for i := range s.Media {
+		m := &s.Media[i]
+		fmt.Fprintf(&buffer, "m=%s %d %s %s\r\n", m.Type, m.Port, m.Proto, strings.Join(m.Formats, " "))
+		if m.Connection.Address != "" {
+			fmt.Fprintf(&buffer, "c=%s\r\n", m.Connection.String())
+		}
+		marshalAttributes(&buffer, m.Attributes)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func marshalAttributes(buffer *bytes.Buffer, attributes []Attribute) {
+	for _, attr := range attributes {
+		if attr.Value == "" {
+			fmt.Fprintf(buffer, "a=%s\r\n", attr.Key)
+		} else {
+			fmt.Fprintf(buffer, "a=%s:%s\r\n", attr.Key, attr.Value)
+		}
+	}
+}
+
+// Decode a session description. Lines can end in CRLF or just LF, and line types we don't know about are skipped
+func Unmarshal(data []byte, s *Session) (err error) {
+	*s = Session{}
+	var media *Media
+
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		if len(line) < 2 || line[1] != '=' {
+			return fmt.Errorf("Invalid SDP line %d: %q", n+1, line)
+		}
+		value := line[2:]
+
+		switch line[0] {
+		case 'v':
+			s.Version, err = strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("Invalid SDP version on line %d: %q", n+1, line)
+			}
+
+		case 'o':
+			f := strings.Fields(value)
+			if len(f) != 6 {
+				return fmt.Errorf("Invalid SDP origin on line %d: %q", n+1, line)
+			}
+			s.Origin = Origin{f[0], f[1], f[2], f[3], f[4], f[5]}
+
+		case 's':
+			s.Name = value
+
+		case 'i':
+			if media == nil {
+				s.Info = value
+			}
+
+		case 'c':
+			f := strings.Fields(value)
+			if len(f) != 3 {
+				return fmt.Errorf("Invalid SDP connection on line %d: %q", n+1, line)
+			}
+			if media != nil {
+				media.Connection = Connection{f[0], f[1], f[2]}
+			} else {
+				s.Connection = Connection{f[0], f[1], f[2]}
+			}
+
+		case 't':
+			f := strings.Fields(value)
+			if len(f) != 2 {
+				return fmt.Errorf("Invalid SDP timing on line %d: %q", n+1, line)
+			}
+			s.Start, err = strconv.ParseUint(f[0], 10, 64)
+			if err == nil {
+				s.Stop, err = strconv.ParseUint(f[1], 10, 64)
+			}
+			if err != nil {
+				return fmt.Errorf("Invalid SDP timing on line %d: %q", n+1, line)
+			}
+
+		case 'm':
+			f := strings.Fields(value)
+			if len(f) < 3 {
+				return fmt.Errorf("Invalid SDP media on line %d: %q", n+1, line)
+			}
+
+			var m Media
+			m.Type = f[0]
+			// Ports can come with a count, like "49170/2"
+			m.Port, err = strconv.Atoi(strings.SplitN(f[1], "/", 2)[0])
+			if err != nil {
+				return fmt.Errorf("Invalid SDP media port on line %d: %q", n+1, line)
+			}
+			m.Proto = f[2]
+			m.Formats = f[3:]
+
+			s.Media = append(s.Media, m)
+			media = &s.Media[len(s.Media)-1]
+
+		case 'a':
+			attr := parseAttribute(value)
+			if media != nil {
+				media.Attributes = append(media.Attributes, attr)
+			} else {
+				s.Attributes = append(s.Attributes, attr)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseAttribute(value string) Attribute {
+	kv := strings.SplitN(value, ":", 2)
+	if len(kv) == 1 {
+		return Attribute{Key: kv[0]}
+	}
+
+	return Attribute{Key: kv[0], Value: kv[1]}
+}
+
+func (c Connection) String() string {
+	return c.NetType + " " + c.AddrType + " " + c.Address
+}
+
+//
+// Attribute helpers for the things RAOP puts in a media description start here
+//
+
+// The value of the first attribute with this key
+func (m *Media) Attribute(key string) (value string, ok bool) {
+	for _, attr := range m.Attributes {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Replace the value of the attribute with this key, or add it if it isn't there
+func (m *Media) SetAttribute(key string, value string) {
+	for i := range m.Attributes {
+		if m.Attributes[i].Key == key {
+			m.Attributes[i].Value = value
+			return
+		}
+	}
+
+	m.Attributes = append(m.Attributes, Attribute{Key: key, Value: value})
+}
+
+// An rtpmap attribute, like "96 AppleLossless" or "96 L16/44100/2"
+type RTPMap struct {
+	Payload   int
+	Encoding  string
+	ClockRate int // 0 if not given
+	Channels  int // 0 if not given
+}
+
+func (m *Media) RTPMap() (rtpmap RTPMap, err error) {
+	value, ok := m.Attribute("rtpmap")
+	if ok == false {
+		return rtpmap, ErrNoAttribute
+	}
+
+	f := strings.Fields(value)
+	if len(f) != 2 {
+		return rtpmap, fmt.Errorf("Invalid rtpmap: %q", value)
+	}
+
+	rtpmap.Payload, err = strconv.Atoi(f[0])
+	if err != nil {
+		return rtpmap, fmt.Errorf("Invalid rtpmap: %q", value)
+	}
+
+	parts := strings.Split(f[1], "/")
+	rtpmap.Encoding = parts[0]
+	if len(parts) > 1 {
+		rtpmap.ClockRate, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return rtpmap, fmt.Errorf("Invalid rtpmap: %q", value)
+		}
+	}
+	if len(parts) > 2 {
+		rtpmap.Channels, err = strconv.Atoi(parts[2])
+		if err != nil {
+			return rtpmap, fmt.Errorf("Invalid rtpmap: %q", value)
+		}
+	}
+
+	return rtpmap, nil
+}
+
+func (m *Media) SetRTPMap(rtpmap RTPMap) {
+	value := strconv.Itoa(rtpmap.Payload) + " " + rtpmap.Encoding
+	if rtpmap.ClockRate != 0 {
+		value += "/" + strconv.Itoa(rtpmap.ClockRate)
+		if rtpmap.Channels != 0 {
+			value += "/" + strconv.Itoa(rtpmap.Channels)
+		}
+	}
+
+	m.SetAttribute("rtpmap", value)
+}
+
+// The 11 parameters of an Apple Lossless fmtp attribute, in order. These are the fields of the ALAC
+// "magic cookie" (ALACSpecificConfig), so they convert straight to an alac.Config
+type ALACParams struct {
+	FrameLength       uint32 // Samples per frame, 352 for RAOP
+	CompatibleVersion uint8  // Always 0
+	BitDepth          uint8  // 16 or 24
+	PB                uint8  // Rice history multiplier, usually 40
+	MB                uint8  // Rice initial history, usually 10
+	KB                uint8  // Rice parameter limit, usually 14
+	NumChannels       uint8
+	MaxRun            uint16 // Usually 255
+	MaxFrameBytes     uint32 // 0 if unknown
+	AvgBitRate        uint32 // 0 if unknown
+	SampleRate        uint32
+}
+
+// The ALAC parameters from the fmtp attribute, like "96 352 0 16 40 10 14 2 255 0 0 44100"
+func (m *Media) ALAC() (params ALACParams, err error) {
+	value, ok := m.Attribute("fmtp")
+	if ok == false {
+		return params, ErrNoAttribute
+	}
+
+	f := strings.Fields(value)
+	if len(f) != 12 {
+		return params, ErrInvalidFmtp
+	}
+
+	// How many bits each field has, so an out of range value is an error rather than wrapping around
+	sizes := [11]int{32, 8, 8, 8, 8, 8, 8, 16, 32, 32, 32}
+
+	var n [11]uint64
+	for i := range n {
+		n[i], err = strconv.ParseUint(f[i+1], 10, sizes[i])
+		if err != nil {
+			return params, ErrInvalidFmtp
+		}
+	}
+
+	params = ALACParams{
+		FrameLength:       uint32(n[0]),
+		CompatibleVersion: uint8(n[1]),
+		BitDepth:          uint8(n[2]),
+		PB:                uint8(n[3]),
+		MB:                uint8(n[4]),
+		KB:                uint8(n[5]),
+		NumChannels:       uint8(n[6]),
+		MaxRun:            uint16(n[7]),
+		MaxFrameBytes:     uint32(n[8]),
+		AvgBitRate:        uint32(n[9]),
+		SampleRate:        uint32(n[10]),
+	}
+
+	return params, nil
+}
+
+func (m *Media) SetALAC(payload int, params ALACParams) {
+	m.SetAttribute("fmtp", fmt.Sprintf("%d %d %d %d %d %d %d %d %d %d %d %d", payload,
+		params.FrameLength, params.CompatibleVersion, params.BitDepth, params.PB, params.MB, params.KB,
+		params.NumChannels, params.MaxRun, params.MaxFrameBytes, params.AvgBitRate, params.SampleRate))
+}
+
+// The RSA encrypted AES key from the rsaaeskey attribute
+func (m *Media) RSAAESKey() ([]byte, error) {
+	return m.base64Attribute("rsaaeskey")
+}
+
+func (m *Media) SetRSAAESKey(key []byte) {
+	m.SetAttribute("rsaaeskey", base64.RawStdEncoding.EncodeToString(key))
+}
+
+// The AES initialization vector from the aesiv attribute
+func (m *Media) AESIV() ([]byte, error) {
+	return m.base64Attribute("aesiv")
+}
+
+func (m *Media) SetAESIV(iv []byte) {
+	m.SetAttribute("aesiv", base64.RawStdEncoding.EncodeToString(iv))
+}
+
+// iTunes leaves the padding off its base64, but not everybody does
+func (m *Media) base64Attribute(key string) ([]byte, error) {
+	value, ok := m.Attribute(key)
+	if ok == false {
+		return nil, ErrNoAttribute
+	}
+
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// The min-latency attribute, in samples
+func (m *Media) MinLatency() (latency int, err error) {
+	value, ok := m.Attribute("min-latency")
+	if ok == false {
+		return 0, ErrNoAttribute
+	}
+
+	return strconv.Atoi(value)
+}
+
+func (m *Media) SetMinLatency(latency int) {
+	m.SetAttribute("min-latency", strconv.Itoa(latency))
+}
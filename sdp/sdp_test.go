@@ -0,0 +1,208 @@
+//
+// ANNOUNCE bodies laid out the way iTunes sends them. The key material is made up.
+//
+
+package sdp
+
+import (
+	"testing"
+)
+
+var (
+	// iTunes to an AirPort Express, with RSA/AES encryption
+	announceEncrypted = "v=0\r\n" +
+		"o=iTunes 3413821438 0 IN IP4 192.168.1.101\r\n" +
+		"s=iTunes\r\n" +
+		"c=IN IP4 192.168.1.120\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 AppleLossless\r\n" +
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n" +
+		"a=rsaaeskey:M1vSKO8BeLdxE5GD6i3MjS9ZUeqvjA/ynZk3xdOelWndHwtbFHM8MbD0IFa3NyuuBvA7rZwgjWqLd4Hqk7soiv7VLqnZMePE3GViU2H+Jx1zgNUL9Mtn8RCcxxKsLpbYqtSmd1x2sHqEMKrlnABAcynFtUW4SqedKO4TFKE0EG+0GxLuo9hIhBWukhPvrLcjccH+JZ6ubgfKs5KO15qeWiJs1vQ478OSJPmJWcApkd7dtYsMLWeLhRk63HFlI41l+4pR1EJGKOckLiNfSNS2YHv2xz0e0/f2WitJlATjdEcORb5Shp5vMTyoycubkpbaX6QCc7AL5k7Rre8jPZZ7Xw\r\n" +
+		"a=aesiv:8LU7LaBB/KSe8LmDkGCzRQ\r\n" +
+		"a=min-latency:11025\r\n"
+
+	// An older iTunes, unencrypted with 4096 sample frames and no min-latency
+	announcePlain = "v=0\r\n" +
+		"o=iTunes 1903264719 0 IN IP4 fe80::217:f2ff:fe0f:e0f6\r\n" +
+		"s=iTunes\r\n" +
+		"c=IN IP4 fe80::5a55:caff:fe1a:e187\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 AppleLossless\r\n" +
+		"a=fmtp:96 4096 0 16 40 10 14 2 255 0 0 44100\r\n"
+)
+
+func TestUnmarshalEncrypted(t *testing.T) {
+	var s Session
+	err := Unmarshal([]byte(announceEncrypted), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	if s.Origin.Username != "iTunes" || s.Origin.SessionID != "3413821438" || s.Origin.Address != "192.168.1.101" {
+		t.Errorf("Unexpected origin: %v", s.Origin)
+	}
+	if s.Name != "iTunes" {
+		t.Errorf("Unexpected session name: %s", s.Name)
+	}
+	if s.Connection.Address != "192.168.1.120" || s.Connection.AddrType != "IP4" {
+		t.Errorf("Unexpected connection: %v", s.Connection)
+	}
+	if len(s.Media) != 1 {
+		t.Fatalf("Expected 1 media description, got %d", len(s.Media))
+	}
+
+	m := &s.Media[0]
+	if m.Type != "audio" || m.Port != 0 || m.Proto != "RTP/AVP" || len(m.Formats) != 1 || m.Formats[0] != "96" {
+		t.Errorf("Unexpected media: %v", m)
+	}
+
+	////////
+	rtpmap, err := m.RTPMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtpmap.Payload != 96 || rtpmap.Encoding != "AppleLossless" || rtpmap.ClockRate != 0 {
+		t.Errorf("Unexpected rtpmap: %v", rtpmap)
+	}
+
+	params, err := m.ALAC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ALACParams{
+		FrameLength:   352,
+		BitDepth:      16,
+		PB:            40,
+		MB:            10,
+		KB:            14,
+		NumChannels:   2,
+		MaxRun:        255,
+		MaxFrameBytes: 0,
+		AvgBitRate:    0,
+		SampleRate:    44100,
+	}
+	if params != expected {
+		t.Errorf("Expected %v, got %v", expected, params)
+	}
+
+	key, err := m.RSAAESKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 256 {
+		t.Errorf("Expected a 256 byte key, got %d", len(key))
+	}
+
+	iv, err := m.AESIV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iv) != 16 {
+		t.Errorf("Expected a 16 byte IV, got %d", len(iv))
+	}
+
+	latency, err := m.MinLatency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency != 11025 {
+		t.Errorf("Unexpected min-latency: %d", latency)
+	}
+}
+
+func TestUnmarshalPlain(t *testing.T) {
+	var s Session
+	err := Unmarshal([]byte(announcePlain), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &s.Media[0]
+	params, err := m.ALAC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.FrameLength != 4096 {
+		t.Errorf("Unexpected frame length: %d", params.FrameLength)
+	}
+
+	if _, err = m.RSAAESKey(); err != ErrNoAttribute {
+		t.Errorf("Expected ErrNoAttribute for rsaaeskey, got %v", err)
+	}
+	if _, err = m.MinLatency(); err != ErrNoAttribute {
+		t.Errorf("Expected ErrNoAttribute for min-latency, got %v", err)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, announce := range []string{announceEncrypted, announcePlain} {
+		var s Session
+		err := Unmarshal([]byte(announce), &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := Marshal(&s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(out) != announce {
+			t.Errorf("Expected %q, got %q", announce, out)
+		}
+	}
+}
+
+func TestMarshalBuilt(t *testing.T) {
+	s := Session{
+		Origin:     Origin{"iTunes", "1", "0", "IN", "IP4", "10.0.0.2"},
+		Name:       "iTunes",
+		Connection: Connection{"IN", "IP4", "10.0.0.3"},
+		Media: []Media{
+			{Type: "audio", Proto: "RTP/AVP", Formats: []string{"96"}},
+		},
+	}
+	m := &s.Media[0]
+	m.SetRTPMap(RTPMap{Payload: 96, Encoding: "L16", ClockRate: 44100, Channels: 2})
+	m.SetAESIV([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+	m.SetMinLatency(11025)
+
+	out, err := Marshal(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "v=0\r\n" +
+		"o=iTunes 1 0 IN IP4 10.0.0.2\r\n" +
+		"s=iTunes\r\n" +
+		"c=IN IP4 10.0.0.3\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 L16/44100/2\r\n" +
+		"a=aesiv:AAECAwQFBgcICQoLDA0ODw\r\n" +
+		"a=min-latency:11025\r\n"
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	var s Session
+	for _, body := range []string{"v=zero\r\n", "o=iTunes\r\n", "garbage\r\n", "m=audio\r\n"} {
+		if Unmarshal([]byte(body), &s) == nil {
+			t.Errorf("Expected an error for %q", body)
+		}
+	}
+
+	// Each of these has a field too big for it, a bit depth of 300 and a max run of 70000
+	for _, fmtp := range []string{"96 352 0 300 40 10 14 2 255 0 0 44100", "96 352 0 16 40 10 14 2 70000 0 0 44100"} {
+		var m Media
+		m.SetAttribute("fmtp", fmtp)
+		if _, err := m.ALAC(); err != ErrInvalidFmtp {
+			t.Errorf("Expected ErrInvalidFmtp for %q, got %v", fmtp, err)
+		}
+	}
+}
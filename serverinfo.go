@@ -0,0 +1,156 @@
+//
+// What a device says about itself. It tells us twice: in the TXT records
+// it advertises over mDNS, and in the plist it answers GET /server-info
+// with. The TXT records can be stale, or come from a sleep proxy, so where
+// the two differ we go with what the device just told us, and fill in
+// anything it left out from the TXT records.
+//
+// http://nto.github.io/AirPlay.html#servicediscovery-airplayservice
+// http://nto.github.io/AirPlay.html#video-httprequests
+//
+
+package airplay
+
+import (
+	"context"
+	"github.com/grantmd/go-airplay/plist"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+type ServerInfo struct {
+	DeviceID        string `plist:"deviceid"`    // Usually the MAC address, like "58:55:CA:1A:E2:88"
+	Features        uint64 `plist:"features"`    // Bit field of what the device can do, like 0x1E5A7FFFF7
+	Model           string `plist:"model"`       // Like "AppleTV2,1"
+	ProtocolVersion string `plist:"protovers"`   // Like "1.0"
+	SourceVersion   string `plist:"srcvers"`     // The AirPlay server version, like "150.33"
+	VV              int    `plist:"vv"`          // Undocumented, usually 2
+	MACAddress      string `plist:"macAddress"`  // The MAC address of the interface we're talking to
+	StatusFlags     uint64 `plist:"statusFlags"` // Bit field of the device's status, like 0x4
+}
+
+// Ask the device about itself. Anything it doesn't say comes from the TXT records, if we used DialDevice
+func (a *Airplay) GetServerInfo() (info ServerInfo, err error) {
+	return a.GetServerInfoContext(context.Background())
+}
+
+// Like GetServerInfo, but gives up if ctx is done first
+func (a *Airplay) GetServerInfoContext(ctx context.Context) (info ServerInfo, err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	resp, err := a.airplayRequest(ctx, "GET", "/server-info", nil, nil)
+	if err != nil {
+		return info, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return info, err
+	}
+
+	err = plist.Unmarshal(body, &info)
+	if err != nil {
+		return info, err
+	}
+
+	// Which keys it sent, since 0 or "" is as good an answer as any
+	var reported map[string]interface{}
+	err = plist.Unmarshal(body, &reported)
+	if err != nil {
+		return info, err
+	}
+
+	info.reconcile(a.advertised, reported)
+	return info, nil
+}
+
+// What the device's TXT records say about it. _airplay._tcp and _raop._tcp name most of these differently,
+// so we look for both. The deviceid and MAC address come from MACAddress if there's no deviceid flag
+func (a *AirplayDevice) ServerInfo() (info ServerInfo) {
+	info.DeviceID = a.Flags["deviceid"]
+	if mac := a.MACAddress(); mac != nil {
+		info.MACAddress = strings.ToUpper(mac.String())
+		if info.DeviceID == "" {
+			info.DeviceID = info.MACAddress
+		}
+	}
+
+	info.Features = parseFeatures(firstFlag(a.Flags, "features", "ft"))
+	info.Model = firstFlag(a.Flags, "model", "am")
+	info.ProtocolVersion = a.Flags["protovers"]
+	info.SourceVersion = firstFlag(a.Flags, "srcvers", "vs")
+	info.VV, _ = strconv.Atoi(a.Flags["vv"])
+	info.StatusFlags, _ = strconv.ParseUint(firstFlag(a.Flags, "flags", "sf"), 0, 64)
+
+	return info
+}
+
+// Fill in whatever the device didn't tell us from what it advertised. reported has the keys it did send
+func (info *ServerInfo) reconcile(advertised ServerInfo, reported map[string]interface{}) {
+	missing := func(key string) bool {
+		_, ok := reported[key]
+		return ok == false
+	}
+
+	if missing("deviceid") {
+		info.DeviceID = advertised.DeviceID
+	}
+	if missing("features") {
+		info.Features = advertised.Features
+	}
+	if missing("model") {
+		info.Model = advertised.Model
+	}
+	if missing("protovers") {
+		info.ProtocolVersion = advertised.ProtocolVersion
+	}
+	if missing("srcvers") {
+		info.SourceVersion = advertised.SourceVersion
+	}
+	if missing("vv") {
+		info.VV = advertised.VV
+	}
+	if missing("macAddress") {
+		info.MACAddress = advertised.MACAddress
+	}
+	if missing("statusFlags") {
+		info.StatusFlags = advertised.StatusFlags
+	}
+
+	// Devices differ on the case, but it's the same address
+	info.DeviceID = strings.ToUpper(info.DeviceID)
+	info.MACAddress = strings.ToUpper(info.MACAddress)
+}
+
+// The value of the first of names that's set
+func firstFlag(flags map[string]string, names ...string) string {
+	for _, name := range names {
+		if value, ok := flags[name]; ok {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// Features are advertised as hex, split into the low and high 32 bits when there are more than 32 of them:
+// "0x5A7FFFF7,0x1E" is 0x1E5A7FFFF7. Returns 0 if we can't tell
+func parseFeatures(s string) uint64 {
+	parts := strings.Split(s, ",")
+	if len(parts) > 2 {
+		return 0
+	}
+
+	var features uint64
+	for i, part := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(part), 0, 32)
+		if err != nil {
+			return 0
+		}
+		features |= n << (32 * uint(i))
+	}
+
+	return features
+}
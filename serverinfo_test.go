@@ -0,0 +1,193 @@
+package airplay
+
+import (
+	"testing"
+)
+
+// A stand-in Apple TV that leaves the model and protocol version out of its server info
+func serverInfoTestHandler(req *testRequest) *testResponse {
+	if req.Method+" "+req.URI != "GET /server-info" {
+		return nil
+	}
+
+	return &testResponse{
+		StatusCode: 200,
+		Header:     map[string]string{"Content-Type": "text/x-apple-plist+xml"},
+		Body: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>deviceid</key> <string>58:55:ca:1a:e2:88</string>
+	<key>features</key> <integer>130367356919</integer>
+	<key>macAddress</key> <string>58:55:CA:1A:E2:88</string>
+	<key>srcvers</key> <string>150.33</string>
+	<key>statusFlags</key> <integer>4</integer>
+	<key>vv</key> <integer>2</integer>
+</dict>
+</plist>`),
+	}
+}
+
+////////
+
+func TestGetServerInfo(t *testing.T) {
+	receiver := startTestReceiver(t, serverInfoTestHandler)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	info, err := a.GetServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ServerInfo{
+		DeviceID:      "58:55:CA:1A:E2:88",
+		Features:      0x1E5A7FFFF7,
+		SourceVersion: "150.33",
+		VV:            2,
+		MACAddress:    "58:55:CA:1A:E2:88",
+		StatusFlags:   0x4,
+	}
+	if info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+}
+
+func TestGetServerInfoReconciled(t *testing.T) {
+	receiver := startTestReceiver(t, serverInfoTestHandler)
+	defer receiver.Close()
+
+	device := AirplayDevice{
+		Name: "5855CA1AE288@Living Room",
+		IP:   receiver.IP(),
+		Port: receiver.Port(),
+		Type: "airplay",
+		Flags: map[string]string{
+			"am": "AppleTV2,1",
+			"ft": "0x5A7FFFF7",
+			"vs": "130.14",
+			"sf": "0x44",
+		},
+	}
+
+	a, err := DialDevice(device, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	info, err := a.GetServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The model only came from the TXT records, everything else the device told us itself
+	if info.Model != "AppleTV2,1" || info.ProtocolVersion != "" {
+		t.Errorf("Expected the advertised model, got %+v", info)
+	}
+	if info.SourceVersion != "150.33" || info.Features != 0x1E5A7FFFF7 || info.StatusFlags != 0x4 {
+		t.Errorf("Expected the device's own values, got %+v", info)
+	}
+}
+
+func TestDeviceServerInfo(t *testing.T) {
+	raop := AirplayDevice{
+		Name:  "5855CA1AE288@Living Room",
+		Flags: map[string]string{"am": "AppleTV3,2", "ft": "0x5A7FFFF7,0x1E", "vs": "220.68", "sf": "0x4", "vv": "2"},
+	}
+	expected := ServerInfo{
+		DeviceID:      "58:55:CA:1A:E2:88",
+		Features:      0x1E5A7FFFF7,
+		Model:         "AppleTV3,2",
+		SourceVersion: "220.68",
+		VV:            2,
+		MACAddress:    "58:55:CA:1A:E2:88",
+		StatusFlags:   0x4,
+	}
+	if info := raop.ServerInfo(); info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+
+	airplay := AirplayDevice{
+		Name:  "Living Room",
+		Flags: map[string]string{"deviceid": "58:55:CA:1A:E2:88", "features": "0x39f7", "model": "AppleTV2,1", "srcvers": "130.14", "flags": "0x4", "protovers": "1.0"},
+	}
+	expected = ServerInfo{
+		DeviceID:        "58:55:CA:1A:E2:88",
+		Features:        0x39f7,
+		Model:           "AppleTV2,1",
+		ProtocolVersion: "1.0",
+		SourceVersion:   "130.14",
+		MACAddress:      "58:55:CA:1A:E2:88",
+		StatusFlags:     0x4,
+	}
+	if info := airplay.ServerInfo(); info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+
+	features := map[string]uint64{
+		"":                0,
+		"0x77":            0x77,
+		"0x5A7FFFF7,0x1E": 0x1E5A7FFFF7,
+		"0x1,0x2,0x3":     0,
+		"nonsense":        0,
+	}
+	for s, expected := range features {
+		if f := parseFeatures(s); f != expected {
+			t.Errorf("Expected %#x for %q, got %#x", expected, s, f)
+		}
+	}
+}
+
+func TestGetServerInfoZero(t *testing.T) {
+	receiver := startTestReceiver(t, func(req *testRequest) *testResponse {
+		if req.Method+" "+req.URI != "GET /server-info" {
+			return nil
+		}
+
+		return &testResponse{
+			StatusCode: 200,
+			Header:     map[string]string{"Content-Type": "text/x-apple-plist+xml"},
+			Body: []byte(`<plist version="1.0">
+<dict>
+	<key>features</key> <integer>0</integer>
+	<key>statusFlags</key> <integer>0</integer>
+	<key>model</key> <string></string>
+</dict>
+</plist>`),
+		}
+	})
+	defer receiver.Close()
+
+	device := AirplayDevice{
+		Name:  "Living Room",
+		IP:    receiver.IP(),
+		Port:  receiver.Port(),
+		Type:  "airplay",
+		Flags: map[string]string{"features": "0x39f7", "flags": "0x4", "model": "AppleTV2,1", "vv": "2"},
+	}
+
+	a, err := DialDevice(device, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	info, err := a.GetServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// It said 0 and "", which beats what it advertised. It didn't say vv at all
+	if info.StatusFlags != 0 || info.Features != 0 || info.Model != "" {
+		t.Errorf("Expected the device's zero values, got %+v", info)
+	}
+	if info.VV != 2 {
+		t.Errorf("Expected the advertised vv, got %d", info.VV)
+	}
+}
@@ -0,0 +1,365 @@
+//
+// The RAOP session lifecycle, as iTunes does it:
+//
+// ANNOUNCE - describe the stream we're about to send, as SDP
+// SETUP    - trade UDP ports for audio, control and timing with the receiver
+// RECORD   - start playing, from a given RTP sequence number and timestamp
+// FLUSH    - throw away buffered audio, for pausing and seeking
+// TEARDOWN - end the session
+//
+// https://xmms2.org/wiki/Technical_note_that_describes_the_Remote_Audio_Access_Protocol_(RAOP)_used_in_AirTunes
+// http://nto.github.io/AirPlay.html#audio
+//
+
+package airplay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/grantmd/go-airplay/sdp"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoSession        = errors.New("No RAOP session has been set up")
+	ErrInvalidTransport = errors.New("Airplay server reported an invalid Transport")
+)
+
+// Returned when the receiver answers a step of the session with anything but 200 OK
+type RTSPError struct {
+	Method     string // The request that failed, like "SETUP"
+	StatusCode int
+	Status     string
+}
+
+func (e *RTSPError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Method, e.Status)
+}
+
+// Make an RTSP request as part of the session, turning anything but 200 OK into an *RTSPError
+func (a *Airplay) sessionRequest(ctx context.Context, method string, headers http.Header, body string) (resp http.Response, err error) {
+	if a.session != "" {
+		if headers == nil {
+			headers = make(http.Header)
+		}
+		headers.Set("Session", a.session)
+	}
+
+	if body != "" {
+		resp, err = a.makeRTSPRequest(ctx, method, a.url, headers, strings.NewReader(body))
+	} else {
+		resp, err = a.makeRTSPRequest(ctx, method, a.url, headers, nil)
+	}
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		return resp, &RTSPError{
+			Method:     method,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	return resp, nil
+}
+
+// Tell the receiver about the stream we're going to send. This starts a new session
+func (a *Airplay) Announce() (err error) {
+	return a.AnnounceContext(context.Background())
+}
+
+// Like Announce, but gives up if ctx is done first
+func (a *Airplay) AnnounceContext(ctx context.Context) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	// IPv6 addresses go in brackets in a URI, like they do with a port
+	host := a.localIP().String()
+	if a.localIP().To4() == nil {
+		host = "[" + host + "]"
+	}
+
+	sessionNumber := rand.Uint32()
+	a.url = fmt.Sprintf("rtsp://%s/%d", host, sessionNumber)
+	a.session = ""
+	a.aesKey = nil
+	a.aesIV = nil
+	a.recording = false
+
+	var encryptedKey []byte
+	if a.Encryption == EncryptionRSA {
+		encryptedKey, err = a.newSessionKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	a.sdp = a.announceSDP(sessionNumber, encryptedKey)
+	return a.announce(ctx)
+}
+
+// Send the ANNOUNCE for a.url and a.sdp. Call with the lock held
+func (a *Airplay) announce(ctx context.Context) (err error) {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/sdp")
+
+	_, err = a.sessionRequest(ctx, "ANNOUNCE", headers, a.sdp)
+	return err
+}
+
+// The SDP body of our ANNOUNCE. This is always 44.1kHz 16-bit stereo in 352 sample frames, like iTunes sends,
+// as either ALAC or L16 depending on the codec, plus the encrypted session key if we have one
+func (a *Airplay) announceSDP(sessionNumber uint32, encryptedKey []byte) string {
+	local := a.localIP()
+	remote := a.ip
+
+	session := sdp.Session{
+		Origin: sdp.Origin{
+			Username:       "iTunes",
+			SessionID:      strconv.FormatUint(uint64(sessionNumber), 10),
+			SessionVersion: "0",
+			NetType:        "IN",
+			AddrType:       addrType(local),
+			Address:        local.String(),
+		},
+		Name: "iTunes",
+		Connection: sdp.Connection{
+			NetType:  "IN",
+			AddrType: addrType(remote),
+			Address:  remote.String(),
+		},
+		Media: []sdp.Media{
+			{
+				Type:    "audio",
+				Proto:   "RTP/AVP",
+				Formats: []string{"96"},
+			},
+		},
+	}
+
+	media := &session.Media[0]
+	if a.Codec == CodecALAC {
+		media.SetRTPMap(sdp.RTPMap{Payload: rtpPayloadType, Encoding: "AppleLossless"})
+		media.SetALAC(rtpPayloadType, sdp.ALACParams(alacConfig()))
+	} else {
+		media.SetRTPMap(sdp.RTPMap{Payload: rtpPayloadType, Encoding: "L16", ClockRate: SampleRate, Channels: 2})
+	}
+	if encryptedKey != nil {
+		media.SetRSAAESKey(encryptedKey)
+		media.SetAESIV(a.aesIV)
+	}
+	media.SetMinLatency(syncLatency)
+
+	body, _ := sdp.Marshal(&session)
+	return string(body)
+}
+
+// Open our control and timing ports and trade them for the receiver's audio, control and timing ports.
+// We answer timing requests from here until Teardown
+func (a *Airplay) Setup() (err error) {
+	return a.SetupContext(context.Background())
+}
+
+// Like Setup, but gives up if ctx is done first
+func (a *Airplay) SetupContext(ctx context.Context) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.url == "" {
+		return ErrNoSession
+	}
+
+	a.closeSessionSockets()
+
+	a.controlConn, err = net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+
+	// The receiver starts asking for the time as soon as it gets our SETUP, so be ready to answer
+	a.timing, err = startTimingServer()
+	if err != nil {
+		a.closeSessionSockets()
+		return err
+	}
+
+	err = a.setup(ctx)
+	if err != nil {
+		a.closeSessionSockets()
+		return err
+	}
+
+	return nil
+}
+
+// Send the SETUP with our control and timing ports, and note the receiver's. Call with the lock held
+func (a *Airplay) setup(ctx context.Context) (err error) {
+	headers := make(http.Header)
+	headers.Set("Transport", fmt.Sprintf("RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=%d;timing_port=%d",
+		a.controlConn.LocalAddr().(*net.UDPAddr).Port,
+		a.timing.Port()))
+
+	a.session = ""
+	a.recording = false
+
+	resp, err := a.sessionRequest(ctx, "SETUP", headers, "")
+	if err != nil {
+		return err
+	}
+
+	transport := parseTransport(resp.Header.Get("Transport"))
+	a.serverPort, _ = strconv.Atoi(transport["server_port"])
+	a.controlPort, _ = strconv.Atoi(transport["control_port"])
+	a.timingPort, _ = strconv.Atoi(transport["timing_port"])
+	if a.serverPort == 0 {
+		return ErrInvalidTransport
+	}
+
+	a.session = resp.Header.Get("Session")
+
+	return nil
+}
+
+// Start playback. The first audio packet we send should have this sequence number and RTP timestamp
+func (a *Airplay) Record(seq uint16, rtptime uint32) (err error) {
+	return a.RecordContext(context.Background(), seq, rtptime)
+}
+
+// Like Record, but gives up if ctx is done first
+func (a *Airplay) RecordContext(ctx context.Context, seq uint16, rtptime uint32) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.session == "" {
+		return ErrNoSession
+	}
+
+	return a.record(ctx, seq, rtptime)
+}
+
+// Send the RECORD. Call with the lock held
+func (a *Airplay) record(ctx context.Context, seq uint16, rtptime uint32) (err error) {
+	headers := make(http.Header)
+	headers.Set("Range", "npt=0-")
+	headers.Set("RTP-Info", fmt.Sprintf("seq=%d;rtptime=%d", seq, rtptime))
+
+	_, err = a.sessionRequest(ctx, "RECORD", headers, "")
+	if err != nil {
+		return err
+	}
+
+	a.recording = true
+	a.recordSeq = seq
+	a.recordTime = rtptime
+
+	return nil
+}
+
+// Throw away any audio the receiver has buffered up to this sequence number and RTP timestamp. Used to pause and seek
+func (a *Airplay) Flush(seq uint16, rtptime uint32) (err error) {
+	return a.FlushContext(context.Background(), seq, rtptime)
+}
+
+// Like Flush, but gives up if ctx is done first
+func (a *Airplay) FlushContext(ctx context.Context, seq uint16, rtptime uint32) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.session == "" {
+		return ErrNoSession
+	}
+
+	headers := make(http.Header)
+	headers.Set("RTP-Info", fmt.Sprintf("seq=%d;rtptime=%d", seq, rtptime))
+
+	_, err = a.sessionRequest(ctx, "FLUSH", headers, "")
+	if err != nil {
+		return err
+	}
+
+	a.recordSeq = seq
+	a.recordTime = rtptime
+
+	return nil
+}
+
+// End the session and close our side of it. The connection stays open for a new ANNOUNCE
+func (a *Airplay) Teardown() (err error) {
+	return a.TeardownContext(context.Background())
+}
+
+// Like Teardown, but gives up if ctx is done first
+func (a *Airplay) TeardownContext(ctx context.Context) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.session == "" {
+		return ErrNoSession
+	}
+
+	_, err = a.sessionRequest(ctx, "TEARDOWN", nil, "")
+
+	a.closeSessionSockets()
+	a.session = ""
+	a.url = ""
+	a.serverPort = 0
+	a.controlPort = 0
+	a.timingPort = 0
+	a.sdp = ""
+	a.recording = false
+
+	return err
+}
+
+func (a *Airplay) closeSessionSockets() {
+	if a.controlConn != nil {
+		a.controlConn.Close()
+		a.controlConn = nil
+	}
+
+	if a.timing != nil {
+		a.timing.Close()
+		a.timing = nil
+	}
+}
+
+// Our address on the connection to the receiver
+func (a *Airplay) localIP() net.IP {
+	if a.netConn == nil {
+		return net.IPv4zero
+	}
+
+	return a.netConn.LocalAddr().(*net.TCPAddr).IP
+}
+
+// The SDP address type for an IP
+func addrType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IP4"
+	}
+
+	return "IP6"
+}
+
+// Split a Transport header like "RTP/AVP/UDP;unicast;mode=record;server_port=53561;control_port=63379"
+// into its parameters. Parameters without a value map to an empty string
+func parseTransport(header string) (params map[string]string) {
+	params = make(map[string]string)
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+
+	return params
+}
@@ -0,0 +1,204 @@
+package airplay
+
+import (
+	"github.com/grantmd/go-airplay/sdp"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSessionLifecycle(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Codec = CodecALAC
+
+	////////
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announce := receiver.Requests("ANNOUNCE")
+	if len(announce) != 1 {
+		t.Fatalf("Expected 1 ANNOUNCE, got %d", len(announce))
+	}
+	if strings.HasPrefix(announce[0].URI, "rtsp://127.0.0.1/") == false {
+		t.Errorf("Unexpected ANNOUNCE URI: %s", announce[0].URI)
+	}
+	if announce[0].Header.Get("Content-Type") != "application/sdp" {
+		t.Errorf("Unexpected ANNOUNCE content type: %s", announce[0].Header.Get("Content-Type"))
+	}
+
+	var description sdp.Session
+	err = sdp.Unmarshal(announce[0].Body, &description)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description.Connection.Address != "127.0.0.1" {
+		t.Errorf("Unexpected ANNOUNCE connection address: %s", description.Connection.Address)
+	}
+	if len(description.Media) != 1 {
+		t.Fatalf("Expected 1 media description in ANNOUNCE, got %d", len(description.Media))
+	}
+	rtpmap, err := description.Media[0].RTPMap()
+	if err != nil || rtpmap.Encoding != "AppleLossless" {
+		t.Errorf("Unexpected ANNOUNCE rtpmap: %v", rtpmap)
+	}
+	params, err := description.Media[0].ALAC()
+	if err != nil || params.FrameLength != 352 || params.SampleRate != 44100 {
+		t.Errorf("Unexpected ANNOUNCE fmtp: %v", params)
+	}
+
+	////////
+	err = a.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setup := receiver.Requests("SETUP")
+	if len(setup) != 1 {
+		t.Fatalf("Expected 1 SETUP, got %d", len(setup))
+	}
+	if setup[0].URI != announce[0].URI {
+		t.Errorf("SETUP URI %s doesn't match ANNOUNCE URI %s", setup[0].URI, announce[0].URI)
+	}
+
+	transport := parseTransport(setup[0].Header.Get("Transport"))
+	if transport["control_port"] == "" || transport["timing_port"] == "" {
+		t.Errorf("SETUP is missing our ports: %s", setup[0].Header.Get("Transport"))
+	}
+
+	if a.serverPort != 53561 || a.controlPort != 63379 || a.timingPort != 50607 {
+		t.Errorf("Unexpected receiver ports: %d, %d, %d", a.serverPort, a.controlPort, a.timingPort)
+	}
+
+	////////
+	err = a.Record(1000, 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := receiver.Requests("RECORD")
+	if len(record) != 1 {
+		t.Fatalf("Expected 1 RECORD, got %d", len(record))
+	}
+	if record[0].Header.Get("Session") != "DEADBEEF" {
+		t.Errorf("Unexpected RECORD session: %s", record[0].Header.Get("Session"))
+	}
+	if record[0].Header.Get("RTP-Info") != "seq=1000;rtptime=44100" {
+		t.Errorf("Unexpected RECORD RTP-Info: %s", record[0].Header.Get("RTP-Info"))
+	}
+
+	////////
+	err = a.Flush(2000, 396900)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flush := receiver.Requests("FLUSH")
+	if len(flush) != 1 || flush[0].Header.Get("RTP-Info") != "seq=2000;rtptime=396900" {
+		t.Error("Unexpected FLUSH")
+	}
+
+	////////
+	err = a.Teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receiver.Requests("TEARDOWN")) != 1 {
+		t.Error("Expected 1 TEARDOWN")
+	}
+	if a.controlConn != nil || a.timing != nil {
+		t.Error("Session sockets were left open")
+	}
+
+	err = a.Record(1000, 44100)
+	if err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession after TEARDOWN, got %v", err)
+	}
+}
+
+func TestAnnounceIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("No IPv6 loopback:", err)
+	}
+	receiver := &testReceiver{listener: listener}
+	go receiver.serve()
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announce := receiver.Requests("ANNOUNCE")
+	if len(announce) != 1 {
+		t.Fatalf("Expected 1 ANNOUNCE, got %d", len(announce))
+	}
+	uri, err := url.Parse(announce[0].URI)
+	if err != nil || uri.Hostname() != "::1" {
+		t.Errorf("Unexpected ANNOUNCE URI: %s", announce[0].URI)
+	}
+
+	var description sdp.Session
+	err = sdp.Unmarshal(announce[0].Body, &description)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description.Connection.AddrType != "IP6" || description.Connection.Address != "::1" {
+		t.Errorf("Unexpected ANNOUNCE connection: %v", description.Connection)
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	receiver := startTestReceiver(t, func(req *testRequest) *testResponse {
+		if req.Method == "SETUP" {
+			return &testResponse{StatusCode: 453, Status: "453 Not Enough Bandwidth"}
+		}
+		return nil
+	})
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.Setup()
+	if err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession before ANNOUNCE, got %v", err)
+	}
+
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.Setup()
+	rtspErr, ok := err.(*RTSPError)
+	if ok == false {
+		t.Fatalf("Expected an RTSPError, got %v", err)
+	}
+	if rtspErr.Method != "SETUP" || rtspErr.StatusCode != 453 {
+		t.Errorf("Unexpected error: %s", rtspErr)
+	}
+	if a.controlConn != nil || a.timing != nil {
+		t.Error("Session sockets were left open after a failed SETUP")
+	}
+}
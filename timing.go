@@ -0,0 +1,110 @@
+//
+// The RAOP timing channel. Receivers sync their clocks to ours by sending
+// NTP-style timing requests to the timing port we gave them in SETUP, and
+// won't play anything until we answer.
+//
+// Packets are RTP-ish: a 0x80 byte, the payload type (0x52 for requests,
+// 0x53 for replies, with the marker bit set), a sequence number of 7 and
+// four zero bytes, followed by three 64-bit NTP timestamps: reference,
+// receive and transmit.
+//
+// http://www.ietf.org/rfc/rfc5905.txt - NTP, for the timestamp format
+//
+
+package airplay
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	timingRequest     = 0x52
+	timingReply       = 0x53
+	timingPacketBytes = 32
+
+	// Seconds between the NTP epoch (1900) and the Unix epoch (1970)
+	ntpEpochOffset = 2208988800
+)
+
+// Answers timing requests for as long as a session is set up
+type timingServer struct {
+	conn *net.UDPConn
+	done chan struct{} // Closed once serve has returned
+}
+
+// Open a timing port and start answering requests on it
+func startTimingServer() (t *timingServer, err error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+
+	t = &timingServer{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	go t.serve()
+
+	return t, nil
+}
+
+// The local port to hand to the receiver in SETUP
+func (t *timingServer) Port() int {
+	return t.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Stop answering, and wait until we really have
+func (t *timingServer) Close() (err error) {
+	err = t.conn.Close()
+	<-t.done
+
+	return err
+}
+
+func (t *timingServer) serve() {
+	defer close(t.done)
+
+	buffer := make([]byte, 128)
+	for {
+		read, addr, err := t.conn.ReadFromUDP(buffer)
+		if err != nil {
+			// Closed
+			return
+		}
+		received := time.Now()
+
+		if read < timingPacketBytes || buffer[1]&0x7F != timingRequest {
+			continue
+		}
+
+		reply := make([]byte, timingPacketBytes)
+		reply[0] = 0x80
+		reply[1] = 0x80 | timingReply
+		reply[2] = 0x00
+		reply[3] = 0x07
+
+		// The reference timestamp is the transmit time of their request, so they can match it up
+		copy(reply[8:16], buffer[24:32])
+		putNTPTime(reply[16:24], received)
+		putNTPTime(reply[24:32], time.Now())
+
+		t.conn.WriteToUDP(reply, addr)
+	}
+}
+
+// Convert a time to NTP's format: 32 bits of seconds since 1900, then 32 bits of fractions of a second
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+
+	return seconds<<32 | fraction
+}
+
+// Write the NTP time for t into the first 8 bytes of buffer
+func putNTPTime(buffer []byte, t time.Time) {
+	ntp := ntpTime(t)
+	for i := 0; i < 8; i++ {
+		buffer[i] = byte(ntp >> uint(56-8*i))
+	}
+}
@@ -0,0 +1,111 @@
+package airplay
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNTPTime(t *testing.T) {
+	ntp := ntpTime(time.Unix(0, int64(time.Second/2)))
+	if ntp != 2208988800<<32|0x80000000 {
+		t.Errorf("Unexpected NTP time: %x", ntp)
+	}
+
+	ntp = ntpTime(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+	if ntp>>32 != 3597523200 {
+		t.Errorf("Unexpected NTP seconds: %d", ntp>>32)
+	}
+}
+
+// Ask for the time from a timing port, like a receiver would
+func requestTiming(t *testing.T, port int) (reply []byte, err error) {
+	conn, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := make([]byte, timingPacketBytes)
+	request[0] = 0x80
+	request[1] = 0x80 | timingRequest
+	request[3] = 0x07
+	copy(request[24:32], []byte{0xd6, 0x9b, 0x43, 0x7a, 0x12, 0x34, 0x56, 0x78})
+
+	_, err = conn.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	reply = make([]byte, 128)
+	read, err := conn.Read(reply)
+
+	return reply[:read], err
+}
+
+func TestTimingServer(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, _ := strconv.Atoi(parseTransport(receiver.Requests("SETUP")[0].Header.Get("Transport"))["timing_port"])
+
+	////////
+	before := ntpTime(time.Now())
+	reply, err := requestTiming(t, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := ntpTime(time.Now())
+
+	if len(reply) != timingPacketBytes {
+		t.Fatalf("Unexpected timing reply length: %d", len(reply))
+	}
+	if reply[0] != 0x80 || reply[1] != 0xd3 || reply[3] != 0x07 {
+		t.Errorf("Unexpected timing reply header: %x", reply[:8])
+	}
+
+	reference := uint64(0)
+	received := uint64(0)
+	transmitted := uint64(0)
+	for i := 0; i < 8; i++ {
+		reference = reference<<8 | uint64(reply[8+i])
+		received = received<<8 | uint64(reply[16+i])
+		transmitted = transmitted<<8 | uint64(reply[24+i])
+	}
+
+	if reference != 0xd69b437a12345678 {
+		t.Errorf("Reference timestamp was not our transmit timestamp: %x", reference)
+	}
+	if received < before || received > transmitted || transmitted > after {
+		t.Errorf("Timestamps out of order: %x <= %x <= %x <= %x", before, received, transmitted, after)
+	}
+
+	////////
+	err = a.Teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = requestTiming(t, port)
+	if err == nil {
+		t.Error("Timing server was still answering after TEARDOWN")
+	}
+}
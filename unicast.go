@@ -0,0 +1,227 @@
+//
+// Wide-area service discovery. This asks a regular unicast DNS server the same
+// questions that Discover multicasts on the local network, for when the devices
+// we want live on a subnet that multicast doesn't reach.
+//
+// Relevant RFCs:
+// http://www.ietf.org/rfc/rfc6763.txt - DNS-Based Service Discovery, section 11 in particular
+// http://www.ietf.org/rfc/rfc1035.txt - DNS, section 4.2 for the transports
+//
+
+package airplay
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDNSMismatch = errors.New("DNS response did not match the query")
+	ErrDNSFailed   = errors.New("DNS server returned an error")
+)
+
+// A stub resolver that talks to a single unicast DNS server
+type Resolver struct {
+	Server  string        // Address of the DNS server, as host:port
+	Timeout time.Duration // How long to wait for each response. Defaults to 5 seconds
+}
+
+// Send a query to the DNS server over UDP, retrying over TCP if the answer was truncated
+func (r *Resolver) Exchange(query *DNSMessage) (resp DNSMessage, err error) {
+	query.Id = uint16(rand.Intn(0x10000))
+	query.IsRecursionDesired = true
+
+	buffer, err := query.Pack()
+	if err != nil {
+		return resp, err
+	}
+
+	resp, err = r.exchangeUDP(buffer)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.IsTruncated {
+		resp, err = r.exchangeTCP(buffer)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	if resp.Id != query.Id || resp.IsResponse == false {
+		return resp, ErrDNSMismatch
+	}
+
+	// NXDOMAIN just means there's nothing there
+	if resp.Rcode != 0 && resp.Rcode != 3 {
+		return resp, ErrDNSFailed
+	}
+
+	return resp, nil
+}
+
+func (r *Resolver) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return 5 * time.Second
+	}
+
+	return r.Timeout
+}
+
+func (r *Resolver) exchangeUDP(query []byte) (resp DNSMessage, err error) {
+	conn, err := net.DialTimeout("udp", r.Server, r.timeout())
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout()))
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return resp, err
+	}
+
+	buffer := getMessageBuffer()
+	defer putMessageBuffer(buffer)
+
+	read, err := conn.Read(*buffer)
+	if err != nil {
+		return resp, err
+	}
+
+	err = resp.Parse((*buffer)[:read])
+	return resp, err
+}
+
+// Over TCP, every message is prefixed with a two byte length
+func (r *Resolver) exchangeTCP(query []byte) (resp DNSMessage, err error) {
+	conn, err := net.DialTimeout("tcp", r.Server, r.timeout())
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout()))
+
+	_, err = conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...))
+	if err != nil {
+		return resp, err
+	}
+
+	length := make([]byte, 2)
+	_, err = io.ReadFull(conn, length)
+	if err != nil {
+		return resp, err
+	}
+
+	buffer := make([]byte, int(length[0])<<8|int(length[1]))
+	_, err = io.ReadFull(conn, buffer)
+	if err != nil {
+		return resp, err
+	}
+
+	err = resp.Parse(buffer)
+	return resp, err
+}
+
+// Ask a single question and return the response
+func (r *Resolver) query(name string, qtype uint16) (resp DNSMessage, err error) {
+	var msg DNSMessage
+	msg.AddQuestion(Question{
+		Name:  name,
+		Type:  qtype,
+		Class: 1,
+	})
+
+	return r.Exchange(&msg)
+}
+
+// Find the domains that are recommended for browsing under domain, by looking up b._dns-sd._udp.<domain>
+func (r *Resolver) BrowseDomains(domain string) (domains []string, err error) {
+	resp, err := r.query("b._dns-sd._udp."+fqdn(domain), 12) // PTR
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resp.Answers {
+		if resp.Answers[i].Type == 12 {
+			domains = append(domains, resp.Answers[i].Rdata.(PTRRecord).Name)
+		}
+	}
+
+	return domains, nil
+}
+
+// Find the airplay devices registered in a browsing domain. This follows each instance from
+// the PTR answers with SRV, TXT and address lookups, so the devices come back complete.
+func (r *Resolver) Browse(domain string) (devices []AirplayDevice, err error) {
+	instances := make(map[string]string)
+
+	for _, q := range airplayQuestions(fqdn(domain)) {
+		resp, err := r.query(q.Name, q.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range resp.Answers {
+			rr := &resp.Answers[i]
+			if rr.Type != 12 {
+				continue
+			}
+
+			instance := rr.Rdata.(PTRRecord).Name
+			deviceName, deviceType := parseInstanceName(instance)
+			if deviceType == "" {
+				continue
+			}
+
+			// The same device is usually under both _raop and _airplay, we only need it once
+			if _, ok := instances[deviceName]; ok {
+				continue
+			}
+			instances[deviceName] = instance
+
+			devices = append(devices, AirplayDevice{
+				Name: deviceName,
+				Type: deviceType,
+			})
+		}
+	}
+
+	for i := range devices {
+		device := &devices[i]
+		instance := instances[device.Name]
+
+		for _, qtype := range []uint16{33, 16} { // SRV, TXT
+			resp, err := r.query(instance, qtype)
+			if err != nil {
+				return nil, err
+			}
+			device.updateFromDNS(&resp)
+		}
+
+		if device.Hostname != "" && device.IP == nil {
+			resp, err := r.query(device.Hostname, 1) // A
+			if err != nil {
+				return nil, err
+			}
+			device.updateFromDNS(&resp)
+		}
+	}
+
+	return devices, nil
+}
+
+// Make sure a domain name ends with the root label
+func fqdn(domain string) string {
+	if strings.HasSuffix(domain, ".") {
+		return domain
+	}
+
+	return domain + "."
+}
@@ -0,0 +1,207 @@
+package airplay
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A stand-in unicast DNS server that answers from a fixed set of records, over UDP and TCP on the same port
+type testDNSServer struct {
+	udp      *net.UDPConn
+	tcp      *net.TCPListener
+	records  []ResourceRecord
+	truncate bool // If true, UDP answers are empty and truncated so the client has to use TCP
+}
+
+func startTestDNSServer(t *testing.T, records []ResourceRecord, truncate bool) *testDNSServer {
+	var udp *net.UDPConn
+	var tcp *net.TCPListener
+	var err error
+
+	// The kernel picks a free UDP port, but something may already have it for TCP, so try a few
+	for attempt := 0; attempt < 10; attempt++ {
+		udp, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tcp, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udp.LocalAddr().(*net.UDPAddr).Port})
+		if err == nil {
+			break
+		}
+		udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testDNSServer{udp: udp, tcp: tcp, records: records, truncate: truncate}
+	go s.serveUDP()
+	go s.serveTCP()
+
+	return s
+}
+
+func (s *testDNSServer) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *testDNSServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *testDNSServer) answer(buffer []byte, truncate bool) []byte {
+	var query DNSMessage
+	err := query.Parse(buffer)
+	if err != nil {
+		return nil
+	}
+
+	resp := DNSMessage{
+		Id:         query.Id,
+		IsResponse: true,
+		Questions:  query.Questions,
+	}
+
+	if truncate {
+		resp.IsTruncated = true
+	} else {
+		for _, q := range query.Questions {
+			for _, rr := range s.records {
+				if rr.Name == q.Name && rr.Type == q.Type {
+					resp.AddAnswer(rr)
+				}
+			}
+		}
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return packed
+}
+
+func (s *testDNSServer) serveUDP() {
+	buffer := make([]byte, 4096)
+	for {
+		read, addr, err := s.udp.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		s.udp.WriteToUDP(s.answer(buffer[:read], s.truncate), addr)
+	}
+}
+
+func (s *testDNSServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		length := make([]byte, 2)
+		_, err = io.ReadFull(conn, length)
+		if err == nil {
+			buffer := make([]byte, int(length[0])<<8|int(length[1]))
+			_, err = io.ReadFull(conn, buffer)
+			if err == nil {
+				resp := s.answer(buffer, false)
+				conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			}
+		}
+		conn.Close()
+	}
+}
+
+var testWideAreaRecords = []ResourceRecord{
+	{Name: "b._dns-sd._udp.example.com.", Type: 12, Class: 1, TTL: 3600, Rdata: PTRRecord{Name: "office.example.com."}},
+	{Name: "_raop._tcp.office.example.com.", Type: 12, Class: 1, TTL: 3600, Rdata: PTRRecord{Name: "Office Speaker._raop._tcp.office.example.com."}},
+	{Name: "Office Speaker._raop._tcp.office.example.com.", Type: 33, Class: 1, TTL: 3600, Rdata: SRVRecord{Port: 5000, Target: "speaker.office.example.com."}},
+	{Name: "Office Speaker._raop._tcp.office.example.com.", Type: 16, Class: 1, TTL: 3600, Rdata: TXTRecord{CStrings: []string{"cn=0,1", "et=0,1", "pw=false"}}},
+	{Name: "speaker.office.example.com.", Type: 1, Class: 1, TTL: 3600, Rdata: ARecord{Address: net.IPv4(10, 0, 2, 15)}},
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	var msg DNSMessage
+	msg.IsResponse = true
+	for _, rr := range testWideAreaRecords {
+		msg.AddAnswer(rr)
+	}
+
+	buffer, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed DNSMessage
+	err = parsed.Parse(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed.Answers) != len(testWideAreaRecords) {
+		t.Fatalf("Expected %d answers, got %d", len(testWideAreaRecords), len(parsed.Answers))
+	}
+
+	for i := range parsed.Answers {
+		if parsed.Answers[i].String() != msg.Answers[i].String() {
+			t.Errorf("Expected %q, got %q", msg.Answers[i].String(), parsed.Answers[i].String())
+		}
+	}
+}
+
+func TestResolverBrowse(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		server := startTestDNSServer(t, testWideAreaRecords, truncate)
+
+		r := Resolver{Server: server.Addr(), Timeout: time.Second}
+
+		////////
+		domains, err := r.BrowseDomains("example.com")
+		if err != nil {
+			server.Close()
+			t.Fatal(err)
+		}
+
+		if len(domains) != 1 || domains[0] != "office.example.com." {
+			t.Errorf("Unexpected browsing domains: %v", domains)
+		}
+
+		////////
+		devices, err := r.Browse(domains[0])
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(devices) != 1 {
+			t.Fatalf("Expected 1 device, got %d", len(devices))
+		}
+
+		device := devices[0]
+		if device.Name != "Office Speaker" {
+			t.Errorf("Unexpected device name: %s", device.Name)
+		}
+		if device.Type != "airplay" {
+			t.Errorf("Unexpected device type: %s", device.Type)
+		}
+		if device.Hostname != "speaker.office.example.com." {
+			t.Errorf("Unexpected device hostname: %s", device.Hostname)
+		}
+		if device.Port != 5000 {
+			t.Errorf("Unexpected device port: %d", device.Port)
+		}
+		if device.IP.Equal(net.IPv4(10, 0, 2, 15)) == false {
+			t.Errorf("Unexpected device IP: %s", device.IP)
+		}
+		if device.Flags["et"] != "0,1" {
+			t.Errorf("Unexpected device flags: %v", device.Flags)
+		}
+	}
+}
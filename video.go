@@ -0,0 +1,223 @@
+//
+// AirPlay video, which is HTTP on the same connection rather than RTSP. We
+// give the receiver a URL and it fetches and plays the video itself:
+//
+// POST /play          - start playing a URL, from a fraction of the way in
+// GET /scrub          - where playback has got to, in seconds
+// POST /scrub         - seek, to a position in seconds
+// POST /rate          - 0 pauses, 1 plays
+// POST /stop          - stop playing
+// GET /playback-info  - everything about playback, as a plist
+//
+// The parameter bodies look like:
+//
+//	Content-Location: http://192.168.1.18:3689/airplay.mp4
+//	Start-Position: 0.174051
+//
+// http://nto.github.io/AirPlay.html#video
+//
+
+package airplay
+
+import (
+	"context"
+	"fmt"
+	"github.com/grantmd/go-airplay/plist"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Returned when the receiver answers an AirPlay request with anything but 200 OK
+type HTTPError struct {
+	Method     string // The request that failed, like "POST"
+	Path       string // And where, like "/play"
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s", e.Method, e.Path, e.Status)
+}
+
+// Where playback has got to, from Scrub
+type ScrubPosition struct {
+	Duration float64 // How long the video is, in seconds. 0 if nothing's loaded
+	Position float64 // How far in we are, in seconds
+}
+
+// A stretch of the video, in seconds
+type TimeRange struct {
+	Start    float64 `plist:"start"`
+	Duration float64 `plist:"duration"`
+}
+
+// The receiver's view of playback, from PlaybackInfo
+type PlaybackInfo struct {
+	Duration               float64     `plist:"duration"`    // How long the video is, in seconds
+	Position               float64     `plist:"position"`    // How far in we are, in seconds
+	Rate                   float64     `plist:"rate"`        // 0 for paused, 1 for playing
+	ReadyToPlay            bool        `plist:"readyToPlay"` // False until the receiver has loaded enough to start, and when nothing's playing
+	PlaybackBufferEmpty    bool        `plist:"playbackBufferEmpty"`
+	PlaybackBufferFull     bool        `plist:"playbackBufferFull"`
+	PlaybackLikelyToKeepUp bool        `plist:"playbackLikelyToKeepUp"`
+	LoadedTimeRanges       []TimeRange `plist:"loadedTimeRanges"`   // What the receiver has buffered
+	SeekableTimeRanges     []TimeRange `plist:"seekableTimeRanges"` // Where it's possible to scrub to
+}
+
+// Have the receiver play the video at url, starting startPosition of the way through, from 0 to 1
+func (a *Airplay) Play(url string, startPosition float64) (err error) {
+	return a.PlayContext(context.Background(), url, startPosition)
+}
+
+// Like Play, but gives up if ctx is done first
+func (a *Airplay) PlayContext(ctx context.Context, url string, startPosition float64) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/parameters")
+
+	body := fmt.Sprintf("Content-Location: %s\nStart-Position: %f\n", url, startPosition)
+	_, err = a.airplayRequest(ctx, "POST", "/play", headers, strings.NewReader(body))
+	return err
+}
+
+// Find out where playback has got to
+func (a *Airplay) Scrub() (position ScrubPosition, err error) {
+	return a.ScrubContext(context.Background())
+}
+
+// Like Scrub, but gives up if ctx is done first
+func (a *Airplay) ScrubContext(ctx context.Context) (position ScrubPosition, err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	resp, err := a.airplayRequest(ctx, "GET", "/scrub", nil, nil)
+	if err != nil {
+		return position, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return position, err
+	}
+
+	params := parseParameters(string(body))
+	position.Duration, err = strconv.ParseFloat(params["duration"], 64)
+	if err != nil {
+		return position, ErrMalformedResponse
+	}
+	position.Position, err = strconv.ParseFloat(params["position"], 64)
+	if err != nil {
+		return position, ErrMalformedResponse
+	}
+
+	return position, nil
+}
+
+// Seek to position, in seconds
+func (a *Airplay) ScrubTo(position float64) (err error) {
+	return a.ScrubToContext(context.Background(), position)
+}
+
+// Like ScrubTo, but gives up if ctx is done first
+func (a *Airplay) ScrubToContext(ctx context.Context, position float64) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	_, err = a.airplayRequest(ctx, "POST", fmt.Sprintf("/scrub?position=%f", position), nil, nil)
+	return err
+}
+
+// Set the playback rate. 0 pauses and 1 plays
+func (a *Airplay) Rate(rate float64) (err error) {
+	return a.RateContext(context.Background(), rate)
+}
+
+// Like Rate, but gives up if ctx is done first
+func (a *Airplay) RateContext(ctx context.Context, rate float64) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	_, err = a.airplayRequest(ctx, "POST", fmt.Sprintf("/rate?value=%f", rate), nil, nil)
+	return err
+}
+
+// Stop playing
+func (a *Airplay) Stop() (err error) {
+	return a.StopContext(context.Background())
+}
+
+// Like Stop, but gives up if ctx is done first
+func (a *Airplay) StopContext(ctx context.Context) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	_, err = a.airplayRequest(ctx, "POST", "/stop", nil, nil)
+	return err
+}
+
+// Ask the receiver everything about playback
+func (a *Airplay) PlaybackInfo() (info PlaybackInfo, err error) {
+	return a.PlaybackInfoContext(context.Background())
+}
+
+// Like PlaybackInfo, but gives up if ctx is done first
+func (a *Airplay) PlaybackInfoContext(ctx context.Context) (info PlaybackInfo, err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	resp, err := a.airplayRequest(ctx, "GET", "/playback-info", nil, nil)
+	if err != nil {
+		return info, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return info, err
+	}
+
+	err = plist.Unmarshal(body, &info)
+	if err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
+
+// Make an AirPlay request, turning anything but 200 OK into an *HTTPError. Call with the lock held
+func (a *Airplay) airplayRequest(ctx context.Context, method string, path string, headers http.Header, body io.Reader) (resp http.Response, err error) {
+	resp, err = a.makeHTTPRequest(ctx, method, path, headers, body)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		return resp, &HTTPError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	return resp, nil
+}
+
+// Split text/parameters into names and values
+func parseParameters(body string) (params map[string]string) {
+	params = make(map[string]string)
+	for _, line := range strings.Split(body, "\n") {
+		f := strings.SplitN(line, ":", 2)
+		if len(f) != 2 {
+			continue
+		}
+
+		params[strings.TrimSpace(f[0])] = strings.TrimSpace(f[1])
+	}
+
+	return params
+}
@@ -0,0 +1,191 @@
+package airplay
+
+import (
+	"context"
+	"github.com/grantmd/go-airplay/plist"
+	"testing"
+)
+
+// A stand-in video receiver, partway through a video
+func videoTestHandler(req *testRequest) *testResponse {
+	switch req.Method + " " + req.URI {
+	case "GET /scrub":
+		return &testResponse{
+			StatusCode: 200,
+			Header:     map[string]string{"Content-Type": "text/parameters"},
+			Body:       []byte("duration: 83.124794\r\nposition: 14.467000\r\n"),
+		}
+
+	case "GET /playback-info":
+		return &testResponse{
+			StatusCode: 200,
+			Header:     map[string]string{"Content-Type": "text/x-apple-plist+xml"},
+			Body: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>duration</key> <real>1801</real>
+	<key>loadedTimeRanges</key>
+	<array>
+		<dict>
+			<key>duration</key> <real>51.541130402</real>
+			<key>start</key> <real>18.118717650000001</real>
+		</dict>
+	</array>
+	<key>playbackBufferEmpty</key> <true/>
+	<key>playbackBufferFull</key> <false/>
+	<key>playbackLikelyToKeepUp</key> <true/>
+	<key>position</key> <real>18.043869775000001</real>
+	<key>rate</key> <integer>1</integer>
+	<key>readyToPlay</key> <true/>
+	<key>seekableTimeRanges</key>
+	<array>
+		<dict>
+			<key>duration</key> <real>1801</real>
+			<key>start</key> <real>0.0</real>
+		</dict>
+	</array>
+</dict>
+</plist>`),
+		}
+
+	case "POST /nothing-here":
+		return &testResponse{StatusCode: 404, Status: "404 Not Found"}
+	}
+
+	return nil
+}
+
+////////
+
+func TestVideoControls(t *testing.T) {
+	receiver := startTestReceiver(t, videoTestHandler)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.Play("http://192.168.1.18:3689/airplay.mp4", 0.174051)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ScrubTo(20.097)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Rate(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := receiver.Requests("POST")
+	if len(requests) != 4 {
+		t.Fatalf("Expected 4 POSTs, got %d", len(requests))
+	}
+
+	play := requests[0]
+	if play.URI != "/play" || play.Proto != "HTTP/1.1" || play.Header.Get("Content-Type") != "text/parameters" {
+		t.Errorf("Unexpected request: %s %s %v", play.URI, play.Proto, play.Header)
+	}
+	if string(play.Body) != "Content-Location: http://192.168.1.18:3689/airplay.mp4\nStart-Position: 0.174051\n" {
+		t.Errorf("Unexpected body: %q", play.Body)
+	}
+
+	expected := []string{"/scrub?position=20.097000", "/rate?value=0.000000", "/stop"}
+	for i, uri := range expected {
+		if requests[i+1].URI != uri || len(requests[i+1].Body) != 0 {
+			t.Errorf("Expected %s, got %s %q", uri, requests[i+1].URI, requests[i+1].Body)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	receiver := startTestReceiver(t, videoTestHandler)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	position, err := a.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position.Duration != 83.124794 || position.Position != 14.467 {
+		t.Errorf("Unexpected position: %v", position)
+	}
+}
+
+func TestPlaybackInfo(t *testing.T) {
+	receiver := startTestReceiver(t, videoTestHandler)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	info, err := a.PlaybackInfoContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Duration != 1801 || info.Position != 18.043869775000001 || info.Rate != 1 {
+		t.Errorf("Unexpected info: %v", info)
+	}
+	if info.ReadyToPlay == false || info.PlaybackBufferEmpty == false || info.PlaybackBufferFull || info.PlaybackLikelyToKeepUp == false {
+		t.Errorf("Unexpected info: %v", info)
+	}
+	if len(info.LoadedTimeRanges) != 1 || info.LoadedTimeRanges[0] != (TimeRange{Start: 18.118717650000001, Duration: 51.541130402}) {
+		t.Errorf("Unexpected loaded ranges: %v", info.LoadedTimeRanges)
+	}
+	if len(info.SeekableTimeRanges) != 1 || info.SeekableTimeRanges[0] != (TimeRange{Start: 0, Duration: 1801}) {
+		t.Errorf("Unexpected seekable ranges: %v", info.SeekableTimeRanges)
+	}
+}
+
+func TestVideoErrors(t *testing.T) {
+	receiver := startTestReceiver(t, videoTestHandler)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	_, err = a.airplayRequest(context.Background(), "POST", "/nothing-here", nil, nil)
+	httpErr, ok := err.(*HTTPError)
+	if ok == false || httpErr.StatusCode != 404 || httpErr.Error() != "POST /nothing-here failed: 404 Not Found" {
+		t.Errorf("Expected an HTTPError, got %v", err)
+	}
+
+	// The stand-in receiver answers anything else with an empty 200, which isn't a plist
+	receiver = startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	b, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	_, err = b.PlaybackInfo()
+	if err != plist.ErrInvalid {
+		t.Errorf("Expected plist.ErrInvalid, got %v", err)
+	}
+	_, err = b.Scrub()
+	if err != ErrMalformedResponse {
+		t.Errorf("Expected ErrMalformedResponse, got %v", err)
+	}
+}
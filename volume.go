@@ -0,0 +1,73 @@
+//
+// Receiver volume, set with SET_PARAMETER while a session is up. RAOP
+// volume is in dB, from -30 (quietest) to 0 (loudest), with -144 for mute:
+//
+//	SET_PARAMETER rtsp://192.168.1.101/3413821438 RTSP/1.0
+//	Content-Type: text/parameters
+//
+//	volume: -11.123877
+//
+// http://nto.github.io/AirPlay.html#audio-volumecontrol
+//
+
+package airplay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const (
+	VolumeMin  = -30.0  // The quietest a receiver goes without muting, in dB
+	VolumeMax  = 0.0    // Full volume, in dB
+	VolumeMute = -144.0 // Silence
+)
+
+// Set the receiver's volume in dB. Anything below VolumeMin mutes, and anything above VolumeMax is full volume
+func (a *Airplay) SetVolume(db float64) (err error) {
+	return a.SetVolumeContext(context.Background(), db)
+}
+
+// Like SetVolume, but gives up if ctx is done first
+func (a *Airplay) SetVolumeContext(ctx context.Context, db float64) (err error) {
+	a.lockSession()
+	defer a.unlockSession()
+
+	if a.url == "" {
+		return ErrNoSession
+	}
+
+	if db < VolumeMin {
+		db = VolumeMute
+	} else if db > VolumeMax {
+		db = VolumeMax
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/parameters")
+
+	_, err = a.sessionRequest(ctx, "SET_PARAMETER", headers, fmt.Sprintf("volume: %f\r\n", db))
+	return err
+}
+
+// Set the receiver's volume from 0 (mute) to 100 (full volume), spread evenly over the dB range
+func (a *Airplay) SetVolumePercent(percent float64) (err error) {
+	return a.SetVolumeContext(context.Background(), volumeFromPercent(percent))
+}
+
+// Like SetVolumePercent, but gives up if ctx is done first
+func (a *Airplay) SetVolumePercentContext(ctx context.Context, percent float64) (err error) {
+	return a.SetVolumeContext(ctx, volumeFromPercent(percent))
+}
+
+func volumeFromPercent(percent float64) float64 {
+	if percent <= 0 {
+		return VolumeMute
+	}
+	if percent >= 100 {
+		return VolumeMax
+	}
+
+	return VolumeMin + (VolumeMax-VolumeMin)*percent/100
+}
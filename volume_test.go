@@ -0,0 +1,65 @@
+package airplay
+
+import (
+	"testing"
+)
+
+func TestSetVolume(t *testing.T) {
+	receiver := startTestReceiver(t, nil)
+	defer receiver.Close()
+
+	a, err := Dial(receiver.IP(), receiver.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if a.SetVolume(-10) != ErrNoSession {
+		t.Error("Expected ErrNoSession before ANNOUNCE")
+	}
+
+	err = a.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	volumes := []struct {
+		set      func() error
+		expected string
+	}{
+		{func() error { return a.SetVolume(-11.5) }, "volume: -11.500000\r\n"},
+		{func() error { return a.SetVolume(-50) }, "volume: -144.000000\r\n"},
+		{func() error { return a.SetVolume(6) }, "volume: 0.000000\r\n"},
+		{func() error { return a.SetVolumePercent(50) }, "volume: -15.000000\r\n"},
+		{func() error { return a.SetVolumePercent(0) }, "volume: -144.000000\r\n"},
+		{func() error { return a.SetVolumePercent(100) }, "volume: 0.000000\r\n"},
+	}
+
+	for i, v := range volumes {
+		err = v.set()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests := receiver.Requests("SET_PARAMETER")
+		if len(requests) != i+1 {
+			t.Fatalf("Expected %d SET_PARAMETERs, got %d", i+1, len(requests))
+		}
+
+		req := requests[i]
+		if string(req.Body) != v.expected {
+			t.Errorf("Expected %q, got %q", v.expected, req.Body)
+		}
+		if req.Header.Get("Content-Type") != "text/parameters" {
+			t.Errorf("Unexpected content type: %s", req.Header.Get("Content-Type"))
+		}
+		if req.Header.Get("Session") != "DEADBEEF" {
+			t.Errorf("Unexpected session: %s", req.Header.Get("Session"))
+		}
+	}
+}
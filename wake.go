@@ -0,0 +1,86 @@
+//
+// Waking up devices that have gone to sleep behind a Bonjour Sleep Proxy.
+// While a device sleeps the proxy answers mDNS for it, and we get it back
+// with a regular Wake-on-LAN magic packet.
+//
+// http://en.wikipedia.org/wiki/Wake-on-LAN#Magic_packet
+//
+
+package airplay
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoWakeAddress = errors.New("No MAC address known for device")
+
+	// How long DialDevice keeps trying to connect to a device it just woke up
+	WakeTimeout = 10 * time.Second
+
+	// Where magic packets are sent. The discard port on the local broadcast address is the usual choice
+	wakeAddr = &net.UDPAddr{
+		IP:   net.IPv4bcast,
+		Port: 9,
+	}
+)
+
+// Send a Wake-on-LAN magic packet for the device
+func Wake(device AirplayDevice) (err error) {
+	mac := device.MACAddress()
+	if mac == nil {
+		return ErrNoWakeAddress
+	}
+
+	socket, err := net.DialUDP("udp4", nil, wakeAddr)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	_, err = socket.Write(magicPacket(mac))
+	return err
+}
+
+// The best MAC address we know of for the device: from the sleep proxy if it told us, otherwise from the
+// deviceid TXT record, otherwise from the front of the RAOP service name ("0024369AC88C@Living Room").
+// Returns nil if we can't tell
+func (a *AirplayDevice) MACAddress() net.HardwareAddr {
+	if a.WakeMAC != nil {
+		return a.WakeMAC
+	}
+
+	if deviceID, ok := a.Flags["deviceid"]; ok {
+		mac, err := net.ParseMAC(deviceID)
+		if err == nil {
+			return mac
+		}
+	}
+
+	if i := strings.Index(a.Name, "@"); i == 12 {
+		mac, err := hex.DecodeString(a.Name[:i])
+		if err == nil {
+			return net.HardwareAddr(mac)
+		}
+	}
+
+	return nil
+}
+
+// A magic packet is 6 bytes of 0xFF followed by the MAC address 16 times
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := make([]byte, 6, 6+16*len(mac))
+	for i := range packet {
+		packet[i] = 0xFF
+	}
+
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+
+	return packet
+}
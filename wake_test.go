@@ -0,0 +1,162 @@
+package airplay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+var testOwnerOption = []byte{
+	0x00, 0x02, // Version, sequence
+	0x58, 0x55, 0xca, 0x1a, 0xe2, 0x88, // Primary MAC
+	0x58, 0x55, 0xca, 0x1a, 0xe2, 0x89, // Wakeup MAC
+}
+
+func TestOwnerOption(t *testing.T) {
+	var msg DNSMessage
+	msg.IsResponse = true
+	msg.AddAnswer(ResourceRecord{Name: "_airplay._tcp.local.", Type: 12, Class: 1, TTL: 4500, Rdata: PTRRecord{Name: "Apple TV._airplay._tcp.local."}})
+	msg.AddExtra(ResourceRecord{Name: "", Type: 41, Class: 1440, Rdata: OPTRecord{Options: []EDNS0Option{{Code: 4, Data: testOwnerOption}}}})
+
+	buffer, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed DNSMessage
+	err = parsed.Parse(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	////////
+	if len(parsed.Extras) != 1 {
+		t.Fatalf("Expected 1 extra, got %d", len(parsed.Extras))
+	}
+	if TypeToString[parsed.Extras[0].Type] != "OPT" {
+		t.Errorf("Unexpected extra type: %d", parsed.Extras[0].Type)
+	}
+	if parsed.Extras[0].Class != 1440 {
+		t.Errorf("Unexpected UDP payload size: %d", parsed.Extras[0].Class)
+	}
+
+	owner, ok := parsed.Owner()
+	if ok == false {
+		t.Fatal("Owner option not found")
+	}
+	if owner.Sequence != 2 {
+		t.Errorf("Unexpected owner sequence: %d", owner.Sequence)
+	}
+	if owner.PrimaryMAC.String() != "58:55:ca:1a:e2:88" {
+		t.Errorf("Unexpected primary MAC: %s", owner.PrimaryMAC)
+	}
+	if owner.WakeupMAC.String() != "58:55:ca:1a:e2:89" {
+		t.Errorf("Unexpected wakeup MAC: %s", owner.WakeupMAC)
+	}
+
+	////////
+	device := AirplayDevice{Name: "Apple TV"}
+	if device.updateFromDNS(&parsed) == false {
+		t.Fatal("Device was not updated")
+	}
+	device.updateSleepState(parsed.Owner())
+
+	if device.Asleep == false {
+		t.Error("Device behind a sleep proxy was not marked asleep")
+	}
+	if device.MACAddress().String() != "58:55:ca:1a:e2:89" {
+		t.Errorf("Unexpected wake MAC: %s", device.MACAddress())
+	}
+
+	// Hearing from the device itself means it's awake again
+	device.updateSleepState(EDNS0Owner{}, false)
+	if device.Asleep {
+		t.Error("Device was still marked asleep")
+	}
+}
+
+func TestOwnerOptionTruncated(t *testing.T) {
+	var msg DNSMessage
+	msg.IsResponse = true
+	msg.AddExtra(ResourceRecord{Name: "", Type: 41, Class: 1440, Rdata: OPTRecord{Options: []EDNS0Option{{Code: 4, Data: testOwnerOption}}}})
+
+	buffer, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Owner option claims more than the OPT record holds
+	long := append([]byte{}, buffer...)
+	long[len(long)-len(testOwnerOption)-1] += 4
+
+	var parsed DNSMessage
+	err = parsed.Parse(long)
+	if err == nil {
+		t.Error("Expected an error for an option longer than its record")
+	}
+
+	// The message stops partway through the Owner option
+	err = parsed.Parse(buffer[:len(buffer)-4])
+	if err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
+
+func TestMACAddress(t *testing.T) {
+	device := AirplayDevice{Name: "0024369AC88C@Living Room"}
+	if device.MACAddress().String() != "00:24:36:9a:c8:8c" {
+		t.Errorf("Unexpected MAC from RAOP name: %s", device.MACAddress())
+	}
+
+	device = AirplayDevice{Name: "Apple TV", Flags: map[string]string{"deviceid": "58:55:CA:1A:E2:88"}}
+	if device.MACAddress().String() != "58:55:ca:1a:e2:88" {
+		t.Errorf("Unexpected MAC from deviceid: %s", device.MACAddress())
+	}
+
+	device = AirplayDevice{Name: "Apple TV"}
+	if device.MACAddress() != nil {
+		t.Errorf("Unexpected MAC: %s", device.MACAddress())
+	}
+	if Wake(device) != ErrNoWakeAddress {
+		t.Error("Expected an error waking a device without a MAC")
+	}
+}
+
+func TestWake(t *testing.T) {
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	oldWakeAddr := wakeAddr
+	wakeAddr = socket.LocalAddr().(*net.UDPAddr)
+	defer func() { wakeAddr = oldWakeAddr }()
+
+	////////
+	mac, _ := net.ParseMAC("58:55:ca:1a:e2:88")
+	err = Wake(AirplayDevice{Name: "Apple TV", Asleep: true, WakeMAC: mac})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 1024)
+	read, _, err := socket.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read != 102 {
+		t.Fatalf("Expected a 102 byte magic packet, got %d", read)
+	}
+	if bytes.Equal(buffer[:6], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) == false {
+		t.Errorf("Unexpected magic packet header: %x", buffer[:6])
+	}
+	for i := 6; i < read; i += 6 {
+		if bytes.Equal(buffer[i:i+6], mac) == false {
+			t.Errorf("Unexpected MAC at offset %d: %x", i, buffer[i:i+6])
+		}
+	}
+}